@@ -0,0 +1,891 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"project/database"
+	"project/handlers"
+	"project/jobs"
+	"project/models"
+	"project/secrets"
+	"project/utils"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func runCommand(name string, args []string) int {
+	// Reports broken configuration files itself
+	if name == "doctor" {
+		return doctorCommand(args)
+	}
+
+	// Extra IoT product lines, see jobs.System
+	if path := os.Getenv("SYSTEMS_FILE"); path != "" {
+		if err := jobs.LoadSystems(path); err != nil {
+			fmt.Println("❌", err)
+			return 1
+		}
+	}
+
+	// Region/province/site parsing of pi names, see jobs.PopRule
+	if path := os.Getenv("POP_RULES_FILE"); path != "" {
+		if err := jobs.LoadPopRules(path); err != nil {
+			fmt.Println("❌", err)
+			return 1
+		}
+	}
+
+	switch name {
+	case "run":
+		return runPipelineCommand(args)
+	case "report-sites":
+		return reportSitesCommand(args)
+	case "plan":
+		return planCommand(args)
+	case "serve":
+		return serveCommand(args)
+	case "worker":
+		return workerCommand(args)
+	case "inventory":
+		return inventoryCommand(args)
+	case "rerun-failed":
+		return rerunFailedCommand(args)
+	case "runs":
+		return runsCommand(args)
+	case "diff":
+		return diffCommand(args)
+	case "secrets":
+		return secretsCommand(args)
+	default:
+		fmt.Println("Unknown command:", name)
+		fmt.Println("Usage: main [run | plan | report-sites | rerun-failed <report> | runs | diff <before> <after> | inventory sync | serve | worker | secrets | doctor]")
+		return 2
+	}
+}
+
+type selectionFlags struct {
+	folderId    *string
+	ids         *string
+	idsFile     *string
+	excludeIds  *string
+	name        *string
+	excludeName *string
+	offset      *int
+	limit       *int
+	sample      *int
+	seed        *int64
+	shard       *string
+}
+
+func addSelectionFlags(fs *flag.FlagSet) selectionFlags {
+	return selectionFlags{
+		folderId:    fs.String("folder", "", "only pis of this folder id"),
+		ids:         fs.String("ids", "", "comma separated pi ids to select"),
+		idsFile:     fs.String("ids-file", "", "file with the pi ids to select, one per line"),
+		excludeIds:  fs.String("exclude-ids", "", "comma separated pi ids to skip"),
+		name:        fs.String("name", "", "regex the pi name must match"),
+		excludeName: fs.String("exclude-name", "", "regex of pi names to skip"),
+		offset:      fs.Int("offset", 0, "skip the first N selected pis"),
+		limit:       fs.Int("limit", -1, "select at most N pis, -1 for all"),
+		sample:      fs.Int("sample", 0, "pick N pis at random"),
+		seed:        fs.Int64("seed", 0, "random seed for --sample, defaults to the current time"),
+		shard:       fs.String("shard", "", "i/n, only crawl the i-th of n shards"),
+	}
+}
+
+func (f selectionFlags) selection() (jobs.Selection, error) {
+	sel := jobs.Selection{
+		FolderId:         *f.folderId,
+		NameRegex:        *f.name,
+		ExcludeNameRegex: *f.excludeName,
+		Offset:           *f.offset,
+		Limit:            *f.limit,
+		Sample:           *f.sample,
+		Seed:             *f.seed,
+	}
+
+	var err error
+
+	if sel.PiIds, err = jobs.ParsePiIds(*f.ids); err != nil {
+		return sel, err
+	}
+
+	if *f.idsFile != "" {
+		fileIds, err := jobs.ReadPiIdsFile(*f.idsFile)
+		if err != nil {
+			return sel, err
+		}
+		sel.PiIds = append(sel.PiIds, fileIds...)
+	}
+
+	if sel.ExcludePiIds, err = jobs.ParsePiIds(*f.excludeIds); err != nil {
+		return sel, err
+	}
+
+	if *f.shard != "" {
+		if sel.ShardIndex, sel.ShardCount, err = jobs.ParseShard(*f.shard); err != nil {
+			return sel, err
+		}
+	}
+
+	if sel.Sample > 0 && sel.Seed == 0 {
+		sel.Seed = time.Now().UnixNano()
+		fmt.Printf("Sampling with --seed %d\n", sel.Seed)
+	}
+
+	return sel, nil
+}
+
+type thresholdFlags struct {
+	tempWarning         *float64
+	tempCritical        *float64
+	acCurrentOn         *float64
+	acShortCycleMinutes *float64
+	acShortCyclesPerDay *float64
+	gapMinutes          *float64
+	windowMaxEntries    *int
+}
+
+func addThresholdFlags(fs *flag.FlagSet) thresholdFlags {
+	return thresholdFlags{
+		tempWarning:         fs.Float64("temp-warning", jobs.TEMP_WARNING_DEFAULT, "degrees at or above which TEMP counts warning minutes"),
+		tempCritical:        fs.Float64("temp-critical", jobs.TEMP_CRITICAL_DEFAULT, "degrees at or above which TEMP counts critical minutes"),
+		acCurrentOn:         fs.Float64("ac-current-on", jobs.AC_CURRENT_ON_DEFAULT, "amperes at or above which AC counts the compressor as running"),
+		acShortCycleMinutes: fs.Float64("ac-short-cycle", jobs.AC_SHORT_CYCLE_MINUTES_DEFAULT, "AC runs shorter than this many minutes are short cycles"),
+		acShortCyclesPerDay: fs.Float64("ac-short-cycle-alert", jobs.AC_SHORT_CYCLES_PER_DAY_DEFAULT, "short AC cycles a day of measured time that raise the short cycling alert"),
+		gapMinutes:          fs.Float64("gap-minutes", jobs.QUALITY_GAP_MINUTES_DEFAULT, "samples further apart than this count as a gap in the data quality report"),
+		windowMaxEntries:    fs.Int("window-max-entries", jobs.WINDOW_MAX_ENTRIES_DEFAULT, "entries one request may return before its window is split in half"),
+	}
+}
+
+func (f thresholdFlags) apply() error {
+	if err := jobs.SetTempThresholds(*f.tempWarning, *f.tempCritical); err != nil {
+		return err
+	}
+
+	if err := jobs.SetAcThresholds(*f.acCurrentOn, *f.acShortCycleMinutes, *f.acShortCyclesPerDay); err != nil {
+		return err
+	}
+
+	if err := jobs.SetQualityGapMinutes(*f.gapMinutes); err != nil {
+		return err
+	}
+
+	return jobs.SetWindowMaxEntries(*f.windowMaxEntries)
+}
+
+func runPipelineCommand(args []string) int {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	system := fs.String("system", "opms", "opms, ipms or a system from SYSTEMS_FILE")
+	mode := fs.String("mode", "TEMP", "FAN, FAN_HEALTH, TEMP, AC or CURRENT")
+	from := fs.String("from", "", "start time, RFC3339")
+	to := fs.String("to", "", "end time, RFC3339")
+	outputFile := fs.String("out", "", "output CSV file, defaults to <system>.csv")
+	rateLimit := fs.Int("rate-limit", 50, "requests fired before cooling down")
+	delaySeconds := fs.Int("delay", 25, "cool down in seconds once the rate limit is reached")
+	rollup := fs.String("rollup", "", "comma separated levels to roll metrics up by: region, province, site")
+	bucket := fs.String("bucket", "", "write a series per pi in buckets of 5m, 1h, 1d, ... or calendar day, week, month")
+	seriesFormat := fs.String("series-format", jobs.SERIES_FORMAT_LONG, "long (pi, bucket, metric, value) or wide (pi, bucket, metrics...)")
+	store := fs.Bool("store", false, "also store the metrics in Postgres for the REST API")
+	thresholds := addThresholdFlags(fs)
+	selFlags := addSelectionFlags(fs)
+	fs.Parse(args)
+
+	sel, err := selFlags.selection()
+	if err != nil {
+		fmt.Println("❌", err)
+		return 2
+	}
+
+	if err := thresholds.apply(); err != nil {
+		fmt.Println("❌", err)
+		return 2
+	}
+
+	startTime, endTime, ok := parseTimeRange(*from, *to)
+	if !ok {
+		return 2
+	}
+
+	if *rateLimit < 1 {
+		fmt.Println("❌ --rate-limit must be at least 1")
+		return 2
+	}
+
+	levels := []string{}
+	for _, level := range strings.Split(*rollup, ",") {
+		switch level = strings.TrimSpace(level); level {
+		case "":
+		case "region", "province", "site":
+			levels = append(levels, level)
+		default:
+			fmt.Println("❌ Unknown rollup level:", level)
+			return 2
+		}
+	}
+
+	bucketing, err := jobs.ParseBucketing(*bucket)
+	if err != nil {
+		fmt.Println("❌", err)
+		return 2
+	}
+
+	if *seriesFormat != jobs.SERIES_FORMAT_LONG && *seriesFormat != jobs.SERIES_FORMAT_WIDE {
+		fmt.Println("❌ --series-format must be long or wide")
+		return 2
+	}
+
+	if *outputFile == "" {
+		*outputFile = *system + ".csv"
+	}
+
+	sys, ok := jobs.GetSystem(*system)
+	if !ok {
+		fmt.Printf("❌ Unknown system %s, expected one of %s\n", *system, strings.Join(jobs.SystemNames(), ", "))
+		return 2
+	}
+
+	manifest, err := jobs.NewRunManifest(sys, *mode, startTime, endTime, sel, *rateLimit, *delaySeconds, *outputFile)
+	if err != nil {
+		fmt.Println("❌", err)
+		return 1
+	}
+	manifest.Rollups = levels
+
+	if *store {
+		manifest.Sink = jobs.JOB_SINK_POSTGRES
+	}
+
+	var results []jobs.ApiResponse
+
+	if bucketing.Enabled() {
+		manifest.Bucket, manifest.SeriesFormat = bucketing.String(), *seriesFormat
+		results = jobs.RunBucketedPipeline(context.Background(), sys, sel, startTime, endTime, *rateLimit, *delaySeconds, *outputFile, *mode, bucketing, *seriesFormat)
+	} else {
+		results = jobs.RunPipeline(context.Background(), sys, sel, startTime, endTime, *rateLimit, *delaySeconds, *outputFile, *mode)
+	}
+
+	jobs.WriteRollups(sys, results, *outputFile, *mode, levels)
+
+	manifest.Finish(results)
+
+	if *store {
+		db, err := database.Open()
+		if err != nil {
+			fmt.Println("❌ Database is not reachable:", err)
+			return 1
+		}
+		defer db.Close()
+
+		if err := jobs.StoreResults(db, sys, *mode, startTime, endTime, bucketing, results); err != nil {
+			fmt.Println("❌ Storing the metrics failed:", err)
+			return 1
+		}
+	}
+
+	return 0
+}
+
+func parseTimeRange(from string, to string) (int64, int64, bool) {
+	startTime := utils.ISOToUnix(from)
+	endTime := utils.ISOToUnix(to)
+
+	if startTime == -1 || endTime == -1 || endTime <= startTime {
+		fmt.Println("❌ --from and --to must be RFC3339 times with --from before --to")
+		return 0, 0, false
+	}
+
+	return startTime, endTime, true
+}
+
+func planCommand(args []string) int {
+	fs := flag.NewFlagSet("plan", flag.ExitOnError)
+	systemNames := fs.String("system", "opms", "comma separated systems: opms, ipms or systems from SYSTEMS_FILE")
+	modes := fs.String("mode", "", "comma separated modes, defaults to every mode of the system")
+	from := fs.String("from", "", "start time, RFC3339")
+	to := fs.String("to", "", "end time, RFC3339")
+	rateLimit := fs.Int("rate-limit", 50, "requests fired before cooling down")
+	delaySeconds := fs.Int("delay", 25, "cool down in seconds once the rate limit is reached")
+	bucket := fs.String("bucket", "", "plan a bucketed run, see run --bucket")
+	requestSeconds := fs.Float64("request-seconds", jobs.PLAN_REQUEST_SECONDS_DEFAULT, "seconds one log request is assumed to take")
+	piCache := fs.String("pi-cache", "", "JSON file caching the pi list, fetched and saved when missing")
+	format := fs.String("format", "table", "table or json")
+	outputFile := fs.String("out", "", "write the plan to this file instead of stdout")
+	selFlags := addSelectionFlags(fs)
+	fs.Parse(args)
+
+	sel, err := selFlags.selection()
+	if err != nil {
+		fmt.Println("❌", err)
+		return 2
+	}
+
+	startTime, endTime, ok := parseTimeRange(*from, *to)
+	if !ok {
+		return 2
+	}
+
+	if *rateLimit < 1 {
+		fmt.Println("❌ --rate-limit must be at least 1")
+		return 2
+	}
+
+	if *format != "table" && *format != "json" {
+		fmt.Println("❌ --format must be table or json")
+		return 2
+	}
+
+	bucketing, err := jobs.ParseBucketing(*bucket)
+	if err != nil {
+		fmt.Println("❌", err)
+		return 2
+	}
+
+	plans := []jobs.Plan{}
+
+	for _, name := range strings.Split(*systemNames, ",") {
+		sys, ok := jobs.GetSystem(strings.TrimSpace(name))
+		if !ok {
+			fmt.Printf("❌ Unknown system %s, expected one of %s\n", name, strings.Join(jobs.SystemNames(), ", "))
+			return 2
+		}
+
+		cacheFile := *piCache
+		if cacheFile != "" && strings.Contains(*systemNames, ",") {
+			// One pi list per system
+			cacheFile = strings.TrimSuffix(cacheFile, filepath.Ext(cacheFile)) + "." + strings.ToLower(sys.Name) + filepath.Ext(cacheFile)
+		}
+
+		var pis []jobs.Pi
+
+		if cacheFile != "" {
+			pis, err = jobs.CachedPis(sys, sel, cacheFile)
+		} else {
+			pis, err = jobs.GetPis(sys, sel)
+		}
+
+		if err != nil {
+			fmt.Println("❌", err)
+			return 1
+		}
+
+		systemModes := []string{}
+		for _, mode := range strings.Split(*modes, ",") {
+			if mode = strings.TrimSpace(mode); mode != "" {
+				systemModes = append(systemModes, mode)
+			}
+		}
+
+		if len(systemModes) == 0 {
+			systemModes = sys.Modes()
+		}
+
+		for _, mode := range systemModes {
+			plan, err := jobs.PlanPipeline(sys, pis, startTime, endTime, *rateLimit, *delaySeconds, mode, bucketing, *requestSeconds)
+			if err != nil {
+				fmt.Println("❌", err)
+				return 2
+			}
+
+			plans = append(plans, plan)
+		}
+	}
+
+	out := io.Writer(os.Stdout)
+
+	if *outputFile != "" {
+		file, err := os.Create(*outputFile)
+		if err != nil {
+			fmt.Println("❌", err)
+			return 1
+		}
+		defer file.Close()
+
+		out = file
+	}
+
+	if *format == "json" {
+		data, err := json.MarshalIndent(plans, "", "  ")
+		if err != nil {
+			fmt.Println("❌", err)
+			return 1
+		}
+
+		fmt.Fprintln(out, string(data))
+	} else {
+		table := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		for _, record := range jobs.PlanRecords(plans) {
+			fmt.Fprintln(table, strings.Join(record, "\t"))
+		}
+		table.Flush()
+	}
+
+	total := 0.0
+
+	for _, plan := range plans {
+		fmt.Printf("📋 %s %s: %d pis, %d requests, about %s\n", plan.System, plan.Mode, len(plan.Pis), plan.Requests, time.Duration(plan.EstimatedSeconds*float64(time.Second)).Round(time.Second))
+		total += plan.EstimatedSeconds
+	}
+
+	fmt.Printf("⏱️ About %s in total, without any splitting of busy pis\n", time.Duration(total*float64(time.Second)).Round(time.Second))
+
+	return 0
+}
+
+func reportSitesCommand(args []string) int {
+	fs := flag.NewFlagSet("report-sites", flag.ExitOnError)
+	from := fs.String("from", "", "start time, RFC3339")
+	to := fs.String("to", "", "end time, RFC3339")
+	outputFile := fs.String("out", "sites.csv", "output CSV file")
+	rateLimit := fs.Int("rate-limit", 50, "requests fired before cooling down")
+	delaySeconds := fs.Int("delay", 25, "cool down in seconds once the rate limit is reached")
+	thresholds := addThresholdFlags(fs)
+	selFlags := addSelectionFlags(fs)
+	fs.Parse(args)
+
+	sel, err := selFlags.selection()
+	if err != nil {
+		fmt.Println("❌", err)
+		return 2
+	}
+
+	if err := thresholds.apply(); err != nil {
+		fmt.Println("❌", err)
+		return 2
+	}
+
+	startTime, endTime, ok := parseTimeRange(*from, *to)
+	if !ok {
+		return 2
+	}
+
+	if *rateLimit < 1 {
+		fmt.Println("❌ --rate-limit must be at least 1")
+		return 2
+	}
+
+	jobs.GetCrossSystemReport(sel, startTime, endTime, *rateLimit, *delaySeconds, *outputFile)
+
+	return 0
+}
+
+func serveCommand(args []string) int {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := fs.String("addr", ":8080", "address to listen on")
+	jobsDir := fs.String("jobs-dir", "jobs-output", "directory the crawls started through /jobs write to")
+	retention := fs.Duration("job-retention", jobs.JOB_RETENTION_DEFAULT, "how long finished /jobs crawls are kept in memory, without --queue")
+	queue := fs.Bool("queue", false, "queue the /jobs crawls in Postgres for the workers instead of running them in memory")
+	workers := fs.Int("workers", 0, "with --queue, units to work on in this process too")
+	fs.Parse(args)
+
+	database.Connect()
+
+	if *queue {
+		if err := database.CreateQueueTables(database.DB); err != nil {
+			fmt.Println("❌ Creating the queue tables failed:", err)
+			return 1
+		}
+
+		handlers.Jobs = jobs.NewJobQueue(database.DB)
+
+		if *workers > 0 {
+			go jobs.NewWorker(database.DB, workerName(), *jobsDir).Run(context.Background(), *workers)
+		}
+	} else {
+		handlers.Jobs = jobs.NewJobManager(*jobsDir, *retention)
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/users", handlers.GetUsers).Methods("GET")
+	router.HandleFunc("/users/{id}", handlers.GetUser).Methods("GET")
+	router.HandleFunc("/users", handlers.CreateUser).Methods("POST")
+	router.HandleFunc("/users/{id}", handlers.UpdateUser).Methods("PUT")
+	router.HandleFunc("/users/{id}", handlers.DeleteUser).Methods("DELETE")
+	router.HandleFunc("/pis", handlers.GetPis).Methods("GET")
+	router.HandleFunc("/pis/{id}", handlers.GetPi).Methods("GET")
+	router.HandleFunc("/pis/{id}/metrics", handlers.GetPiMetrics).Methods("GET")
+	router.HandleFunc("/jobs", handlers.CreateJob).Methods("POST")
+	router.HandleFunc("/jobs/{id}", handlers.GetJob).Methods("GET")
+	router.HandleFunc("/jobs/{id}", handlers.CancelJob).Methods("DELETE")
+	router.HandleFunc("/jobs/{id}/result", handlers.GetJobResult).Methods("GET")
+	router.HandleFunc("/jobs/{id}/events", handlers.GetJobEvents).Methods("GET")
+
+	fmt.Printf("Server running on %s\n", *addr)
+
+	if err := http.ListenAndServe(*addr, router); err != nil {
+		fmt.Println("❌", err)
+		return 1
+	}
+
+	return 0
+}
+
+func workerName() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
+
+// workerCommand crawls the units of the durable queue until interrupted, putting the
+// units it is working on back in the queue.
+func workerCommand(args []string) int {
+	fs := flag.NewFlagSet("worker", flag.ExitOnError)
+	name := fs.String("name", workerName(), "worker name recorded on the units it claims")
+	concurrency := fs.Int("concurrency", 4, "units to work on at the same time")
+	jobsDir := fs.String("jobs-dir", "jobs-output", "directory the merged outputs are written to, shared by the workers")
+	visibility := fs.Duration("visibility", jobs.QUEUE_VISIBILITY_DEFAULT, "time without heartbeat after which a unit goes to another worker")
+	poll := fs.Duration("poll", jobs.QUEUE_POLL_DEFAULT, "wait between two looks at an empty queue")
+	thresholds := addThresholdFlags(fs)
+	fs.Parse(args)
+
+	if err := thresholds.apply(); err != nil {
+		fmt.Println("❌", err)
+		return 2
+	}
+
+	if *concurrency < 1 || *visibility < 3*time.Second {
+		fmt.Println("❌ --concurrency must be at least 1 and --visibility at least 3s")
+		return 2
+	}
+
+	db, err := database.Open()
+	if err != nil {
+		fmt.Println("❌ Database is not reachable:", err)
+		return 1
+	}
+	defer db.Close()
+
+	if err := database.CreateQueueTables(db); err != nil {
+		fmt.Println("❌ Creating the queue tables failed:", err)
+		return 1
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	worker := jobs.NewWorker(db, *name, *jobsDir)
+	worker.Visibility, worker.Poll = *visibility, *poll
+
+	fmt.Printf("Worker %s waiting for units\n", *name)
+
+	worker.Run(ctx, *concurrency)
+
+	fmt.Println("Worker stopped")
+
+	return 0
+}
+
+func inventoryCommand(args []string) int {
+	if len(args) == 0 || args[0] != "sync" {
+		fmt.Println("Usage: main inventory sync [--system opms,ipms] [--out changes.csv] [--force]")
+		return 2
+	}
+
+	fs := flag.NewFlagSet("inventory sync", flag.ExitOnError)
+	systemNames := fs.String("system", "opms,ipms", "comma separated systems to sync")
+	outputFile := fs.String("out", "", "also write the changes to this CSV file")
+	force := fs.Bool("force", false, fmt.Sprintf("sync even a pi list removing every pi or more than %.0f%% of them", database.INVENTORY_MAX_REMOVED_PCT))
+	fs.Parse(args[1:])
+
+	db, err := database.Open()
+	if err != nil {
+		fmt.Println("❌ Database is not reachable:", err)
+		return 1
+	}
+	defer db.Close()
+
+	changes := []models.InventoryChange{}
+
+	for _, name := range strings.Split(*systemNames, ",") {
+		sys, ok := jobs.GetSystem(strings.TrimSpace(name))
+		if !ok {
+			fmt.Printf("❌ Unknown system %s, expected one of %s\n", name, strings.Join(jobs.SystemNames(), ", "))
+			return 2
+		}
+
+		systemChanges, err := jobs.SyncInventory(db, sys, *force)
+		if err != nil {
+			fmt.Printf("❌ Syncing %s: %v\n", sys.Name, err)
+			return 1
+		}
+
+		changes = append(changes, systemChanges...)
+	}
+
+	if len(changes) == 0 {
+		fmt.Println("✅ The inventory was up to date")
+		return 0
+	}
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, record := range jobs.InventoryChangeRecords(changes) {
+		fmt.Fprintln(table, strings.Join(record, "\t"))
+	}
+	table.Flush()
+
+	if *outputFile != "" {
+		jobs.WriteInventoryChanges(changes, *outputFile)
+		fmt.Printf("Changes have been written to %s\n", *outputFile)
+	}
+
+	fmt.Printf("✅ %d changes saved to the inventory\n", len(changes))
+
+	return 0
+}
+
+func rerunFailedCommand(args []string) int {
+	fs := flag.NewFlagSet("rerun-failed", flag.ExitOnError)
+	rateLimit := fs.Int("rate-limit", 50, "requests fired before cooling down")
+	delaySeconds := fs.Int("delay", 25, "cool down in seconds once the rate limit is reached")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fmt.Println("Usage: main rerun-failed [--rate-limit N] [--delay S] <report>")
+		return 2
+	}
+
+	if err := jobs.RerunFailed(fs.Arg(0), *rateLimit, *delaySeconds); err != nil {
+		fmt.Println("❌", err)
+		return 1
+	}
+
+	return 0
+}
+
+// runsCommand lists the recorded runs, shows one with the state of its outputs and
+// re-runs one with the same parameters.
+func runsCommand(args []string) int {
+	usage := func() int {
+		fmt.Println("Usage: main runs [list [--system opms] [--limit 20] | show <id|manifest> | rerun [--out file] <id|manifest>]")
+		return 2
+	}
+
+	if len(args) == 0 {
+		return usage()
+	}
+
+	// Manifest files are read without a database
+	var db *sql.DB
+
+	if args[0] == "list" || database.Configured() {
+		var err error
+		if db, err = database.Open(); err != nil {
+			fmt.Println("❌ Database is not reachable:", err)
+			return 1
+		}
+		defer db.Close()
+	}
+
+	switch args[0] {
+	case "list":
+		fs := flag.NewFlagSet("runs list", flag.ExitOnError)
+		system := fs.String("system", "", "only the runs of this system")
+		limit := fs.Int("limit", 20, "latest runs to list")
+		fs.Parse(args[1:])
+
+		runs, err := database.ListRuns(db, *system, *limit)
+		if err != nil {
+			fmt.Println("❌", err)
+			return 1
+		}
+
+		table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(table, "ID\tSYSTEM\tMODE\tFROM\tTO\tSTARTED\tPIS\tFAILED\tOUTPUT")
+		for _, run := range runs {
+			fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\t%s\t%d\t%d\t%s\n", run.Id, run.System, run.Mode, run.From, run.To,
+				run.StartedAt.Local().Format(time.DateTime), run.Pis, run.Failed, run.OutputFile)
+		}
+		table.Flush()
+
+	case "show":
+		if len(args) != 2 {
+			return usage()
+		}
+
+		manifest, err := jobs.ReadRunManifest(db, args[1])
+		if err != nil {
+			fmt.Println("❌", err)
+			return 1
+		}
+
+		data, _ := json.MarshalIndent(manifest, "", "  ")
+		fmt.Println(string(data))
+
+		states := manifest.Verify()
+		for _, output := range manifest.Outputs {
+			mark := "✅"
+			if states[output.Path] != "unchanged" {
+				mark = "⚠️"
+			}
+			fmt.Printf("%s %s %s\n", mark, output.Path, states[output.Path])
+		}
+
+		fmt.Println("Re-run with: main run", strings.Join(manifest.Args(jobs.RerunPath(manifest.OutputFile, time.Now())), " "))
+
+	case "rerun":
+		fs := flag.NewFlagSet("runs rerun", flag.ExitOnError)
+		outputFile := fs.String("out", "", "output CSV file, defaults to the one of the run with a .rerun-<time> suffix")
+		fs.Parse(args[1:])
+
+		if fs.NArg() != 1 {
+			return usage()
+		}
+
+		manifest, err := jobs.ReadRunManifest(db, fs.Arg(0))
+		if err != nil {
+			fmt.Println("❌", err)
+			return 1
+		}
+
+		if *outputFile == "" {
+			*outputFile = jobs.RerunPath(manifest.OutputFile, time.Now())
+		}
+
+		fmt.Printf("Re-running %s into %s\n", manifest.Id, *outputFile)
+
+		return runPipelineCommand(manifest.Args(*outputFile))
+
+	default:
+		return usage()
+	}
+
+	return 0
+}
+
+func diffCommand(args []string) int {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	minAbsolute := fs.Float64("min-abs", 0, "smallest absolute change of a metric to report")
+	minPercent := fs.Float64("min-pct", jobs.DIFF_MIN_PERCENT_DEFAULT, "smallest percent change of a metric to report")
+	format := fs.String("format", jobs.DIFF_FORMAT_TABLE, "table, csv or markdown")
+	outputFile := fs.String("out", "", "write the diff to this file instead of stdout")
+	fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		fmt.Println("Usage: main diff [--min-abs 0] [--min-pct 10] [--format table|csv|markdown] [--out file] <before.csv> <after.csv>")
+		return 2
+	}
+
+	if *format != jobs.DIFF_FORMAT_TABLE && *format != jobs.DIFF_FORMAT_CSV && *format != jobs.DIFF_FORMAT_MARKDOWN {
+		fmt.Println("❌ --format must be table, csv or markdown")
+		return 2
+	}
+
+	if *minAbsolute < 0 || *minPercent < 0 {
+		fmt.Println("❌ --min-abs and --min-pct must not be negative")
+		return 2
+	}
+
+	rows, err := jobs.DiffFiles(fs.Arg(0), fs.Arg(1), jobs.DiffThresholds{MinAbsolute: *minAbsolute, MinPercent: *minPercent})
+	if err != nil {
+		fmt.Println("❌", err)
+		return 1
+	}
+
+	out := io.Writer(os.Stdout)
+
+	if *outputFile != "" {
+		file, err := os.Create(*outputFile)
+		if err != nil {
+			fmt.Println("❌", err)
+			return 1
+		}
+		defer file.Close()
+
+		out = file
+	}
+
+	records := jobs.DiffRecords(rows)
+
+	switch *format {
+	case jobs.DIFF_FORMAT_CSV:
+		writer := csv.NewWriter(out)
+		writer.WriteAll(records)
+		if err := writer.Error(); err != nil {
+			fmt.Println("❌", err)
+			return 1
+		}
+	case jobs.DIFF_FORMAT_MARKDOWN:
+		fmt.Fprint(out, jobs.MarkdownTable(records))
+	default:
+		table := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		for _, record := range records {
+			fmt.Fprintln(table, strings.Join(record, "\t"))
+		}
+		table.Flush()
+	}
+
+	counts := map[string]int{}
+	for _, row := range rows {
+		counts[row.Change]++
+	}
+
+	fmt.Printf("📋 %d status changes, %d missing pis, %d new pis, %d metric changes\n",
+		counts[jobs.DIFF_STATUS], counts[jobs.DIFF_MISSING], counts[jobs.DIFF_NEW], counts[jobs.DIFF_CHANGED])
+
+	return 0
+}
+
+func secretsCommand(args []string) int {
+	usage := func() int {
+		fmt.Println("Usage: main secrets [list | set <key> <value|-> | delete <key>]")
+		fmt.Println("The vault is SECRETS_VAULT_FILE, unlocked with SECRETS_VAULT_PASSPHRASE(_FILE)")
+		return 2
+	}
+
+	if len(args) == 0 {
+		return usage()
+	}
+
+	vault, err := secrets.OpenVaultFromEnv()
+	if err != nil {
+		fmt.Println("❌", err)
+		return 1
+	}
+
+	switch {
+	case args[0] == "list" && len(args) == 1:
+		for _, key := range vault.Keys() {
+			fmt.Println(key)
+		}
+		return 0
+	case args[0] == "set" && len(args) == 3:
+		value := args[2]
+
+		// "-" reads the value from stdin so it does not end up in the shell history
+		if value == "-" {
+			data, err := io.ReadAll(os.Stdin)
+			if err != nil {
+				fmt.Println("❌", err)
+				return 1
+			}
+			value = strings.TrimRight(string(data), "\r\n")
+		}
+
+		vault.Set(args[1], value)
+	case args[0] == "delete" && len(args) == 2:
+		vault.Delete(args[1])
+	default:
+		return usage()
+	}
+
+	if err := vault.Save(); err != nil {
+		fmt.Println("❌", err)
+		return 1
+	}
+
+	fmt.Println("✅ Vault saved")
+
+	return 0
+}
@@ -4,9 +4,11 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
-	"os"
+	"net"
+	"net/url"
+	"project/secrets"
+	"project/utils"
 
-	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
 )
 
@@ -15,30 +17,51 @@ var DB *sql.DB
 func Connect() {
 	var err error
 
-	godotenv.Load()
+	DB, err = Open()
+	if err != nil {
+		log.Fatalf("Database is not reachable: %v", err)
+	}
+	fmt.Println("Connected to the database!")
 
-	host := os.Getenv("PG_HOST")
+	createTable()
+
+}
+
+// Configured tells whether PG_HOST is set anywhere
+func Configured() bool {
+	return secrets.Get("PG_HOST") != ""
+}
+
+// Open connects with the PG_* secrets and pings the database.
+func Open() (*sql.DB, error) {
+	host := secrets.Get("PG_HOST")
 	port := "5432"
-	user := os.Getenv("PG_USERNAME")
-	password := os.Getenv("PG_PASSWORD")
-	dbname := os.Getenv("PG_DB")
+	user := secrets.Get("PG_USERNAME")
+	password := secrets.Get("PG_PASSWORD")
+	dbname := secrets.Get("PG_DB")
 
-	fmt.Println("host", host)
-	fmt.Println("user", user)
-	fmt.Println("password", password)
+	// Only what locates the database is logged, the password only goes in the DSN
+	utils.Logln("Connecting to", fmt.Sprintf("host=%s port=%s user=%s dbname=%s", host, port, user, dbname))
 
-	connStr := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable", host, port, user, password, dbname)
-	DB, err = sql.Open("postgres", connStr)
-	if err != nil {
-		log.Fatalf("Failed to connect to the database: %v", err)
+	dsn := url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(user, password),
+		Host:     net.JoinHostPort(host, port),
+		Path:     "/" + dbname,
+		RawQuery: "sslmode=disable&connect_timeout=10",
 	}
-	if err = DB.Ping(); err != nil {
-		log.Fatalf("Database is not reachable: %v", err)
+
+	db, err := sql.Open("postgres", dsn.String())
+	if err != nil {
+		return nil, err
 	}
-	fmt.Println("Connected to the database!")
 
-	createTable()
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
 
+	return db, nil
 }
 
 func createTable() {
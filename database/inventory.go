@@ -0,0 +1,235 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"project/models"
+	"sort"
+	"time"
+)
+
+// Share of its pis a sync may remove unless forced, a pi list missing that many is more
+// likely an API failure than pis taken down
+const INVENTORY_MAX_REMOVED_PCT = 20.0
+
+func createInventoryTable(db *sql.DB) error {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS pi_inventory (
+		id SERIAL PRIMARY KEY,
+		system VARCHAR(50) NOT NULL,
+		pi_id INTEGER NOT NULL,
+		name VARCHAR(255),
+		ip VARCHAR(100),
+		address TEXT,
+		backend_port INTEGER,
+		broker_url TEXT,
+		role VARCHAR(50),
+		valid_from TIMESTAMPTZ NOT NULL,
+		valid_to TIMESTAMPTZ,
+		last_seen TIMESTAMPTZ NOT NULL
+	);
+	CREATE UNIQUE INDEX IF NOT EXISTS pi_inventory_current ON pi_inventory (system, pi_id) WHERE valid_to IS NULL;
+	`)
+
+	return err
+}
+
+// SyncInventory brings the current versions of the pis of system in line with pis as
+// of now: a pi that changed gets its version closed and a new one opened, a missing
+// pi gets its version closed. It returns what changed since the last sync. Unless
+// forced, it refuses to remove every pi or more than INVENTORY_MAX_REMOVED_PCT of them.
+func SyncInventory(db *sql.DB, system string, pis []models.InventoryPi, now time.Time, force bool) ([]models.InventoryChange, error) {
+	if err := createInventoryTable(db); err != nil {
+		return nil, fmt.Errorf("creating the inventory table: %w", err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		SELECT pi_id, name, ip, address, backend_port, broker_url, role, valid_from
+		FROM pi_inventory WHERE system = $1 AND valid_to IS NULL FOR UPDATE`, system)
+	if err != nil {
+		return nil, err
+	}
+
+	current := []models.InventoryPi{}
+
+	for rows.Next() {
+		pi := models.InventoryPi{System: system}
+
+		if err := rows.Scan(&pi.PiId, &pi.Name, &pi.Ip, &pi.Address, &pi.BackendPort, &pi.BrokerUrl, &pi.Role, &pi.ValidFrom); err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		current = append(current, pi)
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	changes, closed, opened := DiffInventory(system, current, pis)
+
+	if err := checkInventoryShrink(system, len(current), changes); err != nil && !force {
+		return nil, err
+	}
+
+	for _, piId := range closed {
+		if _, err := tx.Exec(`UPDATE pi_inventory SET valid_to = $1 WHERE system = $2 AND pi_id = $3 AND valid_to IS NULL`, now, system, piId); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, pi := range opened {
+		_, err := tx.Exec(`
+			INSERT INTO pi_inventory (system, pi_id, name, ip, address, backend_port, broker_url, role, valid_from, last_seen)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $9)`,
+			system, pi.PiId, pi.Name, pi.Ip, pi.Address, pi.BackendPort, pi.BrokerUrl, pi.Role, now)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := tx.Exec(`UPDATE pi_inventory SET last_seen = $1 WHERE system = $2 AND valid_to IS NULL`, now, system); err != nil {
+		return nil, err
+	}
+
+	return changes, tx.Commit()
+}
+
+// DiffInventory compares the current versions of the inventory with a fresh pi list.
+// It returns the changes, the pi ids whose version must be closed and the pis that
+// need a new version.
+func DiffInventory(system string, current []models.InventoryPi, fetched []models.InventoryPi) ([]models.InventoryChange, []int, []models.InventoryPi) {
+	changes := []models.InventoryChange{}
+	closed := []int{}
+	opened := []models.InventoryPi{}
+
+	known := map[int]models.InventoryPi{}
+	for _, pi := range current {
+		known[pi.PiId] = pi
+	}
+
+	seen := map[int]bool{}
+
+	for _, pi := range fetched {
+		// Pi lists have been seen to repeat a pi, the first one wins
+		if seen[pi.PiId] {
+			continue
+		}
+		seen[pi.PiId] = true
+
+		change := func(kind string, before string, after string) {
+			changes = append(changes, models.InventoryChange{System: system, PiId: pi.PiId, Kind: kind, Before: before, After: after})
+		}
+
+		previous, ok := known[pi.PiId]
+		if !ok {
+			change(models.INVENTORY_ADDED, "", pi.Name)
+			opened = append(opened, pi)
+			continue
+		}
+
+		changed := false
+
+		if previous.Name != pi.Name {
+			change(models.INVENTORY_RENAMED, previous.Name, pi.Name)
+			changed = true
+		}
+
+		if before, after := location(previous), location(pi); before != after {
+			change(models.INVENTORY_READDRESSED, before, after)
+			changed = true
+		}
+
+		if previous.Role != pi.Role {
+			change(models.INVENTORY_CHANGED, "role "+previous.Role, "role "+pi.Role)
+			changed = true
+		}
+
+		if changed {
+			closed = append(closed, pi.PiId)
+			opened = append(opened, pi)
+		}
+	}
+
+	for _, pi := range current {
+		if !seen[pi.PiId] {
+			changes = append(changes, models.InventoryChange{System: system, PiId: pi.PiId, Kind: models.INVENTORY_REMOVED, Before: pi.Name})
+			closed = append(closed, pi.PiId)
+		}
+	}
+
+	sort.SliceStable(changes, func(i, j int) bool { return changes[i].PiId < changes[j].PiId })
+
+	return changes, closed, opened
+}
+
+// checkInventoryShrink refuses changes removing every one of the current pis, or more
+// than INVENTORY_MAX_REMOVED_PCT of them
+func checkInventoryShrink(system string, current int, changes []models.InventoryChange) error {
+	removed := 0
+	for _, change := range changes {
+		if change.Kind == models.INVENTORY_REMOVED {
+			removed++
+		}
+	}
+
+	if removed == 0 || (removed < current && float64(removed)/float64(current)*100 <= INVENTORY_MAX_REMOVED_PCT) {
+		return nil
+	}
+
+	return fmt.Errorf("the %s pi list would remove %d of the %d pis, force the sync if they are really gone", system, removed, current)
+}
+
+func location(pi models.InventoryPi) string {
+	return fmt.Sprintf("%s:%d %s %s", pi.Ip, pi.BackendPort, pi.Address, pi.BrokerUrl)
+}
+
+// ListInventory returns the current version of every pi, of one system unless system is
+// "" and with a name containing name, ignoring case.
+func ListInventory(db *sql.DB, system string, name string) ([]models.InventoryPi, error) {
+	return queryInventory(db, `valid_to IS NULL
+		AND ($1 = '' OR lower(system) = lower($1))
+		AND ($2 = '' OR name ILIKE '%' || $2 || '%')`, system, name)
+}
+
+// InventoryVersions returns every version of a pi, the newest first.
+func InventoryVersions(db *sql.DB, system string, piId int) ([]models.InventoryPi, error) {
+	return queryInventory(db, `pi_id = $2 AND ($1 = '' OR lower(system) = lower($1))`, system, piId)
+}
+
+func queryInventory(db *sql.DB, where string, args ...any) ([]models.InventoryPi, error) {
+	if err := createInventoryTable(db); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`
+		SELECT system, pi_id, name, ip, address, backend_port, broker_url, role, valid_from, valid_to
+		FROM pi_inventory WHERE `+where+`
+		ORDER BY system, pi_id, valid_from DESC`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	pis := []models.InventoryPi{}
+
+	for rows.Next() {
+		var pi models.InventoryPi
+
+		if err := rows.Scan(&pi.System, &pi.PiId, &pi.Name, &pi.Ip, &pi.Address, &pi.BackendPort, &pi.BrokerUrl, &pi.Role, &pi.ValidFrom, &pi.ValidTo); err != nil {
+			return nil, err
+		}
+
+		pis = append(pis, pi)
+	}
+
+	return pis, rows.Err()
+}
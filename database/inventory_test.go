@@ -0,0 +1,74 @@
+package database
+
+import (
+	"project/models"
+	"reflect"
+	"testing"
+)
+
+func TestDiffInventory(t *testing.T) {
+	current := []models.InventoryPi{
+		{PiId: 1, Name: "HNI0001", Ip: "10.0.0.1", BackendPort: 80},
+		{PiId: 2, Name: "HNI0002", Ip: "10.0.0.2", BackendPort: 80},
+		{PiId: 3, Name: "HNI0003", Ip: "10.0.0.3", BackendPort: 80, Role: "pop"},
+		{PiId: 4, Name: "HNI0004", Ip: "10.0.0.4", BackendPort: 80},
+	}
+
+	fetched := []models.InventoryPi{
+		{PiId: 1, Name: "HNI0001", Ip: "10.0.0.1", BackendPort: 80},
+		{PiId: 2, Name: "HNI0002-CAB", Ip: "10.0.0.2", BackendPort: 8080},
+		{PiId: 3, Name: "HNI0003", Ip: "10.0.0.3", BackendPort: 80, Role: "hub"},
+		{PiId: 5, Name: "HNI0005", Ip: "10.0.0.5", BackendPort: 80},
+		{PiId: 5, Name: "HNI0005-DUP", Ip: "10.0.0.5", BackendPort: 80},
+	}
+
+	changes, closed, opened := DiffInventory("opms", current, fetched)
+
+	kinds := []string{}
+	for _, change := range changes {
+		kinds = append(kinds, change.Kind)
+	}
+
+	want := []string{models.INVENTORY_RENAMED, models.INVENTORY_READDRESSED, models.INVENTORY_CHANGED, models.INVENTORY_REMOVED, models.INVENTORY_ADDED}
+	if !reflect.DeepEqual(kinds, want) {
+		t.Errorf("changes = %+v; want %v", changes, want)
+	}
+
+	if changes[1].Before != "10.0.0.2:80  " || changes[1].After != "10.0.0.2:8080  " {
+		t.Errorf("readdressed = %+v", changes[1])
+	}
+
+	if !reflect.DeepEqual(closed, []int{2, 3, 4}) || len(opened) != 3 || opened[2].Name != "HNI0005" {
+		t.Errorf("closed = %v, opened = %+v; want 2, 3 and 4 closed, 2, 3 and 5 opened", closed, opened)
+	}
+}
+
+func TestCheckInventoryShrink(t *testing.T) {
+	current := []models.InventoryPi{}
+	for id := 1; id <= 10; id++ {
+		current = append(current, models.InventoryPi{PiId: id, Name: "HNI"})
+	}
+
+	tests := map[string]struct {
+		fetched []models.InventoryPi
+		refused bool
+	}{
+		"empty list":      {nil, true},
+		"2 of 10 removed": {current[2:], false},
+		"3 of 10 removed": {current[3:], true},
+		"nothing removed": {current, false},
+	}
+
+	for name, test := range tests {
+		changes, _, _ := DiffInventory("opms", current, test.fetched)
+
+		if err := checkInventoryShrink("opms", len(current), changes); (err != nil) != test.refused {
+			t.Errorf("%s: err = %v; want refused %v", name, err, test.refused)
+		}
+	}
+
+	// A first sync has nothing to remove
+	if err := checkInventoryShrink("opms", 0, nil); err != nil {
+		t.Errorf("first sync: %v", err)
+	}
+}
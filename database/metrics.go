@@ -0,0 +1,129 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"project/models"
+	"strings"
+	"time"
+)
+
+func createMetricsTable(db *sql.DB) error {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS pi_metrics (
+		id SERIAL PRIMARY KEY,
+		system VARCHAR(50) NOT NULL,
+		mode VARCHAR(50) NOT NULL,
+		pi_id INTEGER NOT NULL,
+		pop VARCHAR(255),
+		bucket VARCHAR(20) NOT NULL,
+		period_start TIMESTAMPTZ NOT NULL,
+		period_end TIMESTAMPTZ NOT NULL,
+		metrics JSONB NOT NULL,
+		stored_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		UNIQUE (system, mode, pi_id, bucket, period_start, period_end)
+	);
+	`)
+
+	return err
+}
+
+// SaveMetrics stores rows, replacing the metrics of a pi already stored for the same
+// period so that a rerun fixes earlier rows instead of doubling them.
+func SaveMetrics(db *sql.DB, rows []models.MetricsRow) error {
+	if err := createMetricsTable(db); err != nil {
+		return fmt.Errorf("creating the metrics table: %w", err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, row := range rows {
+		metrics, err := json.Marshal(row.Metrics)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`
+			INSERT INTO pi_metrics (system, mode, pi_id, pop, bucket, period_start, period_end, metrics)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+			ON CONFLICT (system, mode, pi_id, bucket, period_start, period_end)
+			DO UPDATE SET pop = EXCLUDED.pop, metrics = EXCLUDED.metrics, stored_at = now()`,
+			row.System, row.Mode, row.PiId, row.Pop, row.Bucket, row.Start, row.End, metrics)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// MetricsQuery selects the stored metrics of one pi, zero times and "" match everything
+// except Bucket, "" being the rows of whole run windows.
+type MetricsQuery struct {
+	System string
+	PiId   int
+	Mode   string
+	Bucket string
+	From   time.Time
+	To     time.Time
+}
+
+func QueryMetrics(db *sql.DB, query MetricsQuery) ([]models.MetricsRow, error) {
+	if err := createMetricsTable(db); err != nil {
+		return nil, err
+	}
+
+	conditions := []string{"pi_id = $1", "bucket = $2"}
+	args := []any{query.PiId, query.Bucket}
+
+	where := func(condition string, arg any) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+
+	if query.System != "" {
+		where("lower(system) = lower($%d)", query.System)
+	}
+	if query.Mode != "" {
+		where("mode = $%d", query.Mode)
+	}
+	if !query.From.IsZero() {
+		where("period_start >= $%d", query.From)
+	}
+	if !query.To.IsZero() {
+		where("period_end <= $%d", query.To)
+	}
+
+	rows, err := db.Query(`
+		SELECT system, mode, pi_id, pop, bucket, period_start, period_end, metrics
+		FROM pi_metrics WHERE `+strings.Join(conditions, " AND ")+`
+		ORDER BY system, mode, period_start`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []models.MetricsRow{}
+
+	for rows.Next() {
+		var row models.MetricsRow
+		var metrics []byte
+
+		if err := rows.Scan(&row.System, &row.Mode, &row.PiId, &row.Pop, &row.Bucket, &row.Start, &row.End, &metrics); err != nil {
+			return nil, err
+		}
+
+		if err := json.Unmarshal(metrics, &row.Metrics); err != nil {
+			return nil, err
+		}
+
+		results = append(results, row)
+	}
+
+	return results, rows.Err()
+}
@@ -0,0 +1,365 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"project/models"
+	"time"
+)
+
+// ErrUnitLost means a worker no longer owns its unit or job: its visibility timeout
+// expired and another worker claimed it, or the job was canceled.
+var ErrUnitLost = errors.New("unit no longer owned by this worker")
+
+// CreateQueueTables creates the tables of the job queue, once when a process using it
+// starts rather than on every poll.
+func CreateQueueTables(db *sql.DB) error {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS jobs (
+		id VARCHAR(32) PRIMARY KEY,
+		spec JSONB NOT NULL,
+		status VARCHAR(20) NOT NULL,
+		error TEXT NOT NULL DEFAULT '',
+		output_file TEXT NOT NULL DEFAULT '',
+		result JSONB,
+		worker VARCHAR(100),
+		heartbeat_at TIMESTAMPTZ,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		started_at TIMESTAMPTZ,
+		finished_at TIMESTAMPTZ,
+		events BIGINT NOT NULL DEFAULT 0
+	);
+	CREATE TABLE IF NOT EXISTS job_units (
+		id BIGSERIAL PRIMARY KEY,
+		job_id VARCHAR(32) NOT NULL REFERENCES jobs (id) ON DELETE CASCADE,
+		pi_id INTEGER NOT NULL,
+		pop VARCHAR(255) NOT NULL DEFAULT '',
+		mode VARCHAR(50) NOT NULL,
+		period_start BIGINT NOT NULL,
+		period_end BIGINT NOT NULL,
+		status VARCHAR(20) NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		worker VARCHAR(100),
+		heartbeat_at TIMESTAMPTZ,
+		result JSONB,
+		finished_at TIMESTAMPTZ,
+		event BIGINT,
+		UNIQUE (job_id, pi_id, mode, period_start, period_end)
+	);
+	ALTER TABLE jobs ADD COLUMN IF NOT EXISTS events BIGINT NOT NULL DEFAULT 0;
+	ALTER TABLE job_units ADD COLUMN IF NOT EXISTS event BIGINT;
+	CREATE INDEX IF NOT EXISTS job_units_pending ON job_units (status, id);
+	`)
+
+	return err
+}
+
+// EnqueueJob stores a job and its units, all queued.
+func EnqueueJob(db *sql.DB, job models.QueuedJob, units []models.JobUnit) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`INSERT INTO jobs (id, spec, status, created_at) VALUES ($1, $2, $3, $4)`,
+		job.Id, []byte(job.Spec), models.JOB_QUEUED, job.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	for _, unit := range units {
+		_, err := tx.Exec(`
+			INSERT INTO job_units (job_id, pi_id, pop, mode, period_start, period_end, status)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+			job.Id, unit.PiId, unit.Pop, unit.Mode, unit.Start, unit.End, models.UNIT_QUEUED)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// ClaimUnit hands the oldest queued unit of a job still running to worker, or a unit
+// whose worker missed its heartbeats for longer than visibility. Units claimed
+// maxAttempts times without finishing fail instead. It returns nil when there is none.
+func ClaimUnit(db *sql.DB, worker string, visibility time.Duration, maxAttempts int) (*models.JobUnit, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Units abandoned for good, or by a worker that died after its job was canceled
+	_, err = tx.Exec(`
+		UPDATE job_units SET status = $1, finished_at = now()
+		WHERE status = $2 AND heartbeat_at < now() - $3 * interval '1 second'
+			AND (attempts >= $4 OR job_id IN (SELECT id FROM jobs WHERE status = $5))`,
+		models.UNIT_FAILED, models.UNIT_RUNNING, visibility.Seconds(), maxAttempts, models.JOB_CANCELED)
+	if err != nil {
+		return nil, err
+	}
+
+	unit := models.JobUnit{Status: models.UNIT_RUNNING, Worker: worker}
+
+	err = tx.QueryRow(`
+		UPDATE job_units SET status = $1, worker = $2, heartbeat_at = now(), attempts = attempts + 1
+		WHERE id = (
+			SELECT u.id FROM job_units u JOIN jobs j ON j.id = u.job_id
+			WHERE j.status IN ($3, $4)
+				AND (u.status = $5 OR (u.status = $1 AND u.heartbeat_at < now() - $6 * interval '1 second'))
+			ORDER BY u.id
+			FOR UPDATE OF u SKIP LOCKED
+			LIMIT 1)
+		RETURNING id, job_id, pi_id, pop, mode, period_start, period_end, attempts`,
+		models.UNIT_RUNNING, worker, models.JOB_QUEUED, models.JOB_RUNNING, models.UNIT_QUEUED, visibility.Seconds(),
+	).Scan(&unit.Id, &unit.JobId, &unit.PiId, &unit.Pop, &unit.Mode, &unit.Start, &unit.End, &unit.Attempts)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, tx.Commit()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec(`UPDATE jobs SET status = $1, started_at = now() WHERE id = $2 AND status = $3`,
+		models.JOB_RUNNING, unit.JobId, models.JOB_QUEUED)
+	if err != nil {
+		return nil, err
+	}
+
+	return &unit, tx.Commit()
+}
+
+// HeartbeatUnit keeps a claimed unit from being handed to another worker.
+func HeartbeatUnit(db *sql.DB, unitId int64, worker string) error {
+	return expectOne(db.Exec(`
+		UPDATE job_units u SET heartbeat_at = now()
+		FROM jobs j
+		WHERE u.id = $1 AND u.worker = $2 AND u.status = $3 AND j.id = u.job_id AND j.status = $4`,
+		unitId, worker, models.UNIT_RUNNING, models.JOB_RUNNING))
+}
+
+// ReleaseUnit puts a claimed unit back in the queue, for a worker shutting down.
+func ReleaseUnit(db *sql.DB, unitId int64, worker string) error {
+	return expectOne(db.Exec(`
+		UPDATE job_units SET status = $1, worker = NULL, heartbeat_at = NULL
+		WHERE id = $2 AND worker = $3 AND status = $4`,
+		models.UNIT_QUEUED, unitId, worker, models.UNIT_RUNNING))
+}
+
+// FinishUnit records the result of a claimed unit as done or failed.
+func FinishUnit(db *sql.DB, unitId int64, worker string, status string, result json.RawMessage) error {
+	return expectOne(db.Exec(`
+		UPDATE job_units SET status = $1, result = $2, finished_at = now()
+		WHERE id = $3 AND worker = $4 AND status = $5`,
+		status, []byte(result), unitId, worker, models.UNIT_RUNNING))
+}
+
+// ClaimMerge hands worker a job whose units are all finished, or a merge whose worker
+// missed its heartbeats for longer than visibility. It returns nil when there is none.
+func ClaimMerge(db *sql.DB, worker string, visibility time.Duration) (*models.QueuedJob, error) {
+	var id string
+
+	err := db.QueryRow(`
+		UPDATE jobs SET status = $1, worker = $2, heartbeat_at = now()
+		WHERE id = (
+			SELECT j.id FROM jobs j
+			WHERE (j.status IN ($3, $4) OR (j.status = $1 AND j.heartbeat_at < now() - $5 * interval '1 second'))
+				AND NOT EXISTS (SELECT 1 FROM job_units u WHERE u.job_id = j.id AND u.status IN ($6, $7))
+			ORDER BY j.created_at
+			FOR UPDATE SKIP LOCKED
+			LIMIT 1)
+		RETURNING id`,
+		models.JOB_MERGING, worker, models.JOB_QUEUED, models.JOB_RUNNING, visibility.Seconds(), models.UNIT_QUEUED, models.UNIT_RUNNING,
+	).Scan(&id)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return GetQueuedJob(db, id)
+}
+
+// HeartbeatJob keeps a claimed merge from being handed to another worker.
+func HeartbeatJob(db *sql.DB, jobId string, worker string) error {
+	return expectOne(db.Exec(`UPDATE jobs SET heartbeat_at = now() WHERE id = $1 AND worker = $2 AND status = $3`,
+		jobId, worker, models.JOB_MERGING))
+}
+
+// FinishJob records the outcome of a merge and the merged results.
+func FinishJob(db *sql.DB, jobId string, worker string, status string, errText string, outputFile string, result json.RawMessage) error {
+	return expectOne(db.Exec(`
+		UPDATE jobs SET status = $1, error = $2, output_file = $3, result = $4, finished_at = now()
+		WHERE id = $5 AND worker = $6 AND status = $7`,
+		status, errText, outputFile, []byte(result), jobId, worker, models.JOB_MERGING))
+}
+
+// QueuedJobResult returns the merged results of a job, nil before its merge.
+func QueuedJobResult(db *sql.DB, jobId string) (json.RawMessage, error) {
+	var result []byte
+
+	err := db.QueryRow(`SELECT result FROM jobs WHERE id = $1`, jobId).Scan(&result)
+
+	return result, err
+}
+
+// CancelQueuedJob cancels a job that is not finished, its queued units with it. The
+// units running stop at their next heartbeat. It returns false for a finished job.
+func CancelQueuedJob(db *sql.DB, jobId string) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		UPDATE jobs SET status = $1, finished_at = now() WHERE id = $2 AND status IN ($3, $4)`,
+		models.JOB_CANCELED, jobId, models.JOB_QUEUED, models.JOB_RUNNING)
+	if err != nil {
+		return false, err
+	}
+
+	if canceled, err := result.RowsAffected(); err != nil || canceled == 0 {
+		return false, err
+	}
+
+	_, err = tx.Exec(`UPDATE job_units SET status = $1, finished_at = now() WHERE job_id = $2 AND status = $3`,
+		models.UNIT_CANCELED, jobId, models.UNIT_QUEUED)
+	if err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+// GetQueuedJob returns a job with its unit counts, sql.ErrNoRows when there is none.
+func GetQueuedJob(db *sql.DB, jobId string) (*models.QueuedJob, error) {
+	job := models.QueuedJob{}
+	var spec []byte
+	var startedAt, finishedAt sql.NullTime
+
+	err := db.QueryRow(`
+		SELECT j.id, j.spec, j.status, j.error, j.output_file, j.created_at, j.started_at, j.finished_at,
+			count(u.id),
+			count(u.id) FILTER (WHERE u.status IN ($2, $3, $4)),
+			count(u.id) FILTER (WHERE u.status IN ($3, $4))
+		FROM jobs j LEFT JOIN job_units u ON u.job_id = j.id
+		WHERE j.id = $1
+		GROUP BY j.id`,
+		jobId, models.UNIT_DONE, models.UNIT_FAILED, models.UNIT_CANCELED,
+	).Scan(&job.Id, &spec, &job.Status, &job.Error, &job.OutputFile, &job.CreatedAt, &startedAt, &finishedAt,
+		&job.Units, &job.Done, &job.Failed)
+	if err != nil {
+		return nil, err
+	}
+
+	job.Spec = spec
+
+	if startedAt.Valid {
+		job.StartedAt = &startedAt.Time
+	}
+	if finishedAt.Valid {
+		job.FinishedAt = &finishedAt.Time
+	}
+
+	return &job, nil
+}
+
+// NumberJobEvents numbers the units of a job finished since it last ran after the ones
+// already numbered. A unit keeps its event number whatever the order the workers
+// commit in, a unit committed late with an early finished_at coming last.
+func NumberJobEvents(db *sql.DB, jobId string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// The job row serializes the numbering
+	var numbered int64
+	if err := tx.QueryRow(`SELECT events FROM jobs WHERE id = $1 FOR UPDATE`, jobId).Scan(&numbered); err != nil {
+		return err
+	}
+
+	result, err := tx.Exec(`
+		UPDATE job_units u SET event = $2 + n.seq
+		FROM (
+			SELECT id, row_number() OVER (ORDER BY finished_at, id) AS seq FROM job_units
+			WHERE job_id = $1 AND finished_at IS NOT NULL AND event IS NULL) n
+		WHERE u.id = n.id`, jobId, numbered)
+	if err != nil {
+		return err
+	}
+
+	added, err := result.RowsAffected()
+	if err != nil || added == 0 {
+		return err
+	}
+
+	if _, err := tx.Exec(`UPDATE jobs SET events = events + $2 WHERE id = $1`, jobId, added); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// JobUnits returns the units of a job with status, or all of them for "", the numbered
+// ones first by event, see NumberJobEvents, then the finished ones as they finished.
+func JobUnits(db *sql.DB, jobId string, status string) ([]models.JobUnit, error) {
+	rows, err := db.Query(`
+		SELECT id, job_id, pi_id, pop, mode, period_start, period_end, status, attempts,
+			COALESCE(worker, ''), result, finished_at, COALESCE(event, 0)
+		FROM job_units WHERE job_id = $1 AND ($2 = '' OR status = $2)
+		ORDER BY event NULLS LAST, finished_at NULLS LAST, id`, jobId, status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	units := []models.JobUnit{}
+
+	for rows.Next() {
+		var unit models.JobUnit
+		var result []byte
+		var finishedAt sql.NullTime
+
+		err := rows.Scan(&unit.Id, &unit.JobId, &unit.PiId, &unit.Pop, &unit.Mode, &unit.Start, &unit.End,
+			&unit.Status, &unit.Attempts, &unit.Worker, &result, &finishedAt, &unit.Event)
+		if err != nil {
+			return nil, err
+		}
+
+		unit.Result = result
+
+		if finishedAt.Valid {
+			unit.FinishedAt = &finishedAt.Time
+		}
+
+		units = append(units, unit)
+	}
+
+	return units, rows.Err()
+}
+
+func expectOne(result sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if updated == 0 {
+		return ErrUnitLost
+	}
+
+	return nil
+}
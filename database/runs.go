@@ -0,0 +1,100 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"project/models"
+)
+
+func createRunsTable(db *sql.DB) error {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS pipeline_runs (
+		id VARCHAR(32) PRIMARY KEY,
+		system VARCHAR(50) NOT NULL,
+		mode VARCHAR(50) NOT NULL,
+		period_start VARCHAR(40) NOT NULL,
+		period_end VARCHAR(40) NOT NULL,
+		started_at TIMESTAMPTZ NOT NULL,
+		finished_at TIMESTAMPTZ NOT NULL,
+		pis INTEGER NOT NULL,
+		succeeded INTEGER NOT NULL,
+		failed INTEGER NOT NULL,
+		output_file TEXT NOT NULL,
+		manifest JSONB NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS pipeline_runs_started ON pipeline_runs (started_at DESC);
+	`)
+
+	return err
+}
+
+// SaveRun records a finished run.
+func SaveRun(db *sql.DB, run models.PipelineRun) error {
+	if err := createRunsTable(db); err != nil {
+		return fmt.Errorf("creating the runs table: %w", err)
+	}
+
+	_, err := db.Exec(`
+		INSERT INTO pipeline_runs (id, system, mode, period_start, period_end, started_at, finished_at, pis, succeeded, failed, output_file, manifest)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)`,
+		run.Id, run.System, run.Mode, run.From, run.To, run.StartedAt, run.FinishedAt,
+		run.Pis, run.Succeeded, run.Failed, run.OutputFile, []byte(run.Manifest))
+
+	return err
+}
+
+// ListRuns returns the runs of system, or of every system for "", the latest first and
+// without their manifest.
+func ListRuns(db *sql.DB, system string, limit int) ([]models.PipelineRun, error) {
+	if err := createRunsTable(db); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`
+		SELECT id, system, mode, period_start, period_end, started_at, finished_at, pis, succeeded, failed, output_file
+		FROM pipeline_runs WHERE $1 = '' OR lower(system) = lower($1)
+		ORDER BY started_at DESC LIMIT $2`, system, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	runs := []models.PipelineRun{}
+
+	for rows.Next() {
+		var run models.PipelineRun
+
+		err := rows.Scan(&run.Id, &run.System, &run.Mode, &run.From, &run.To, &run.StartedAt, &run.FinishedAt,
+			&run.Pis, &run.Succeeded, &run.Failed, &run.OutputFile)
+		if err != nil {
+			return nil, err
+		}
+
+		runs = append(runs, run)
+	}
+
+	return runs, rows.Err()
+}
+
+// GetRun returns a run with its manifest, sql.ErrNoRows when there is none.
+func GetRun(db *sql.DB, id string) (*models.PipelineRun, error) {
+	if err := createRunsTable(db); err != nil {
+		return nil, err
+	}
+
+	var run models.PipelineRun
+	var manifest []byte
+
+	err := db.QueryRow(`
+		SELECT id, system, mode, period_start, period_end, started_at, finished_at, pis, succeeded, failed, output_file, manifest
+		FROM pipeline_runs WHERE id = $1`, id,
+	).Scan(&run.Id, &run.System, &run.Mode, &run.From, &run.To, &run.StartedAt, &run.FinishedAt,
+		&run.Pis, &run.Succeeded, &run.Failed, &run.OutputFile, &manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	run.Manifest = manifest
+
+	return &run, nil
+}
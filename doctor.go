@@ -0,0 +1,90 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"project/database"
+	"project/jobs"
+	"project/secrets"
+	"project/utils"
+	"strings"
+	"time"
+)
+
+// doctorCommand checks the configuration, the credentials and every dependency of a
+// crawl, printing one line per check. It exits with 1 when any check fails.
+func doctorCommand(args []string) int {
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	systemNames := fs.String("system", "opms,ipms", "comma separated systems to check")
+	timeout := fs.Duration("timeout", 10*time.Second, "timeout of every network check")
+	fs.Parse(args)
+
+	checks := []jobs.Check{}
+
+	configFile := func(env string, load func(string) error) {
+		path := os.Getenv(env)
+		if path == "" {
+			checks = append(checks, jobs.Check{Name: env, Status: jobs.CHECK_SKIP, Detail: "not set, using the built-in defaults"})
+			return
+		}
+
+		checks = append(checks, jobs.CheckResult(env, load(path), path))
+	}
+
+	configFile("SYSTEMS_FILE", jobs.LoadSystems)
+	configFile("POP_RULES_FILE", jobs.LoadPopRules)
+
+	providers := os.Getenv("SECRETS_PROVIDERS")
+	if providers == "" {
+		providers = "env,file"
+	}
+	_, err := secrets.FromEnv()
+	checks = append(checks, jobs.CheckResult("secret providers", err, providers))
+
+	expiresAt, known, err := utils.DefaultTokenProvider().Status()
+	detail := "expiry unknown"
+	if known {
+		detail = "valid until " + expiresAt.Format(time.RFC3339)
+	}
+	checks = append(checks, jobs.CheckResult("IoT token", err, detail))
+
+	for _, name := range strings.Split(*systemNames, ",") {
+		sys, ok := jobs.GetSystem(strings.TrimSpace(name))
+		if !ok {
+			checks = append(checks, jobs.CheckResult("system "+name, fmt.Errorf("unknown, expected one of %s", strings.Join(jobs.SystemNames(), ", ")), ""))
+			continue
+		}
+
+		checks = append(checks, jobs.DiagnoseSystem(sys, *timeout)...)
+	}
+
+	if database.Configured() {
+		db, err := database.Open()
+		if err == nil {
+			db.Close()
+		}
+		checks = append(checks, jobs.CheckResult("Postgres", err, "connected"))
+	} else {
+		checks = append(checks, jobs.Check{Name: "Postgres", Status: jobs.CHECK_SKIP, Detail: "PG_HOST is not set"})
+	}
+
+	failed := 0
+
+	for _, check := range checks {
+		fmt.Println(check)
+
+		if check.Status == jobs.CHECK_FAIL {
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		fmt.Printf("❌ %d of %d checks failed\n", failed, len(checks))
+		return 1
+	}
+
+	fmt.Println("✅ All checks passed")
+
+	return 0
+}
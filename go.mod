@@ -10,13 +10,7 @@ require (
 	github.com/lib/pq v1.10.9
 )
 
-require github.com/briandowns/spinner v1.23.2
-
 require (
-	github.com/fatih/color v1.7.0 // indirect
-	github.com/mattn/go-colorable v0.1.2 // indirect
-	github.com/mattn/go-isatty v0.0.17 // indirect
-	golang.org/x/sys v0.6.0 // indirect
-	golang.org/x/term v0.6.0 // indirect
-	golang.org/x/text v0.24.0 // indirect
+	golang.org/x/crypto v0.37.0
+	golang.org/x/text v0.24.0
 )
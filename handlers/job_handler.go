@@ -0,0 +1,182 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"project/jobs"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Jobs runs the crawls started through /jobs, set by the serve command.
+var Jobs jobs.JobRunner
+
+// Comment lines sent while a job is quiet, so that proxies keep the stream open
+const EVENTS_KEEPALIVE = 15 * time.Second
+
+var resultContentTypes = map[string]string{
+	jobs.JOB_RESULT_CSV:  "text/csv",
+	jobs.JOB_RESULT_JSON: "application/json",
+	jobs.JOB_RESULT_XLSX: "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+}
+
+func writeJobError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, jobs.ErrJobNotFound):
+		http.Error(w, "Job not found", http.StatusNotFound)
+	case errors.Is(err, jobs.ErrJobFinished), errors.Is(err, jobs.ErrJobNotFinished):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// CreateJob queues the crawl of a jobs.JobSpec and answers 202 with the job.
+func CreateJob(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+
+	var spec jobs.JobSpec
+	if err := json.NewDecoder(r.Body).Decode(&spec); err != nil {
+		http.Error(w, "Invalid job: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	job, err := Jobs.Submit(spec)
+	if err != nil {
+		http.Error(w, "Invalid job: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Location", "/jobs/"+job.Id)
+	w.WriteHeader(http.StatusAccepted)
+	writeResponse(w, job, 1, start)
+}
+
+// GetJob returns the status, progress and first errors of a job.
+func GetJob(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+
+	job, err := Jobs.Get(mux.Vars(r)["id"])
+	if err != nil {
+		writeJobError(w, err)
+		return
+	}
+
+	writeResponse(w, job, 1, start)
+}
+
+// CancelJob stops a queued or running job.
+func CancelJob(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+
+	job, err := Jobs.Cancel(mux.Vars(r)["id"])
+	if err != nil {
+		writeJobError(w, err)
+		return
+	}
+
+	writeResponse(w, job, 1, start)
+}
+
+// GetJobResult downloads the metrics of a finished job, ?format= csv (default), json or xlsx.
+func GetJobResult(w http.ResponseWriter, r *http.Request) {
+	id, format := mux.Vars(r)["id"], r.URL.Query().Get("format")
+	if format == "" {
+		format = jobs.JOB_RESULT_CSV
+	}
+
+	contentType, ok := resultContentTypes[format]
+	if !ok {
+		http.Error(w, "Invalid format, expected csv, json or xlsx", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := Jobs.Get(id); err != nil {
+		writeJobError(w, err)
+		return
+	}
+
+	// Errors before the first byte still get their own status
+	pending := &pendingWriter{w: w, contentType: contentType, filename: id + "." + format}
+
+	if err := Jobs.WriteResult(id, format, pending); err != nil && !pending.started {
+		writeJobError(w, err)
+	}
+}
+
+// pendingWriter sets the download headers on the first write
+type pendingWriter struct {
+	w                     http.ResponseWriter
+	contentType, filename string
+	started               bool
+}
+
+func (p *pendingWriter) Write(data []byte) (int, error) {
+	if !p.started {
+		p.started = true
+		p.w.Header().Set("Content-Type", p.contentType)
+		p.w.Header().Set("Content-Disposition", `attachment; filename="`+p.filename+`"`)
+	}
+
+	return p.w.Write(data)
+}
+
+// GetJobEvents streams the events of a job as Server-Sent Events, from the first one or
+// the one after Last-Event-ID, and ends after the complete event.
+func GetJobEvents(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	next := 0
+	if last, err := strconv.Atoi(r.Header.Get("Last-Event-ID")); err == nil {
+		next = last + 1
+	}
+
+	keepalive := time.NewTicker(EVENTS_KEEPALIVE)
+	defer keepalive.Stop()
+
+	for started := false; ; started = true {
+		events, wake, completed, err := Jobs.Events(id, next)
+		if err != nil {
+			if !started {
+				writeJobError(w, err)
+			}
+			return
+		}
+
+		if !started {
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Header().Set("Cache-Control", "no-cache")
+			w.WriteHeader(http.StatusOK)
+		}
+
+		for _, event := range events {
+			data, _ := json.Marshal(event)
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", next, event.Type, data)
+			next++
+		}
+
+		flusher.Flush()
+
+		if completed {
+			return
+		}
+
+		select {
+		case <-wake:
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"project/database"
+	"project/jobs"
+	"project/models"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func writeResponse(w http.ResponseWriter, data any, total int, start time.Time) {
+	response := models.Response{
+		Data:        data,
+		Total:       total,
+		ExecuteTime: time.Since(start).String(),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// GetPis lists the current inventory, filtered by ?system=, ?folder= (with a system),
+// ?name= (part of the name) and ?region= (see jobs.ParsePopName).
+func GetPis(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	query := r.URL.Query()
+
+	system, folder, region := query.Get("system"), query.Get("folder"), query.Get("region")
+
+	var folderIds map[int]bool
+
+	if folder != "" {
+		sys, ok := jobs.GetSystem(system)
+		if !ok {
+			http.Error(w, "folder needs a known system", http.StatusBadRequest)
+			return
+		}
+
+		ids, err := jobs.FolderPiIds(sys, folder)
+		if err != nil {
+			http.Error(w, "Failed to fetch the folder", http.StatusBadGateway)
+			return
+		}
+		folderIds = ids
+	}
+
+	all, err := database.ListInventory(database.DB, system, query.Get("name"))
+	if err != nil {
+		http.Error(w, "Failed to fetch pis", http.StatusInternalServerError)
+		return
+	}
+
+	pis := []models.InventoryPi{}
+
+	for _, pi := range all {
+		if folderIds != nil && !folderIds[pi.PiId] {
+			continue
+		}
+
+		if region != "" && !strings.EqualFold(jobs.ParsePopName(pi.Name).Region, region) {
+			continue
+		}
+
+		pis = append(pis, pi)
+	}
+
+	writeResponse(w, pis, len(pis), start)
+}
+
+// GetPi returns every version of a pi, the current one first. Pi ids are only unique
+// within a system, ?system= picks one.
+func GetPi(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid pi id", http.StatusBadRequest)
+		return
+	}
+
+	pis, err := database.InventoryVersions(database.DB, r.URL.Query().Get("system"), id)
+	if err != nil {
+		http.Error(w, "Failed to fetch pi", http.StatusInternalServerError)
+		return
+	}
+
+	if len(pis) == 0 {
+		http.Error(w, "Pi not found", http.StatusNotFound)
+		return
+	}
+
+	writeResponse(w, pis, len(pis), start)
+}
+
+// GetPiMetrics returns the metrics stored by run --store for ?mode=, between ?from= and
+// ?to= (RFC3339) and for ?bucket= (1h, day, ...), whole run windows by default.
+func GetPiMetrics(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	query := r.URL.Query()
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid pi id", http.StatusBadRequest)
+		return
+	}
+
+	bucketing, err := jobs.ParseBucketing(query.Get("bucket"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	metricsQuery := database.MetricsQuery{System: query.Get("system"), PiId: id, Mode: query.Get("mode"), Bucket: bucketing.String()}
+
+	for param, value := range map[string]*time.Time{"from": &metricsQuery.From, "to": &metricsQuery.To} {
+		if text := query.Get(param); text != "" {
+			if *value, err = time.Parse(time.RFC3339, text); err != nil {
+				http.Error(w, "Invalid "+param+", expected RFC3339", http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	rows, err := database.QueryMetrics(database.DB, metricsQuery)
+	if err != nil {
+		http.Error(w, "Failed to fetch metrics", http.StatusInternalServerError)
+		return
+	}
+
+	writeResponse(w, rows, len(rows), start)
+}
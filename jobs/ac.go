@@ -0,0 +1,396 @@
+package jobs
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+)
+
+const (
+	AC_CURRENT_ON_DEFAULT          = 1.0 // amperes
+	AC_SHORT_CYCLE_MINUTES_DEFAULT = 5.0
+	// Short cycles a day of measured time that raise the alert
+	AC_SHORT_CYCLES_PER_DAY_DEFAULT = 3.0
+)
+
+var (
+	acCurrentOn, acShortCycleMinutes = AC_CURRENT_ON_DEFAULT, AC_SHORT_CYCLE_MINUTES_DEFAULT
+	acShortCyclesPerDay              = AC_SHORT_CYCLES_PER_DAY_DEFAULT
+)
+
+// SetAcThresholds sets the current above which the compressor counts as running, the
+// run length under which a cycle is short and the short cycles a day raising the alert.
+func SetAcThresholds(currentOn float64, shortCycleMinutes float64, shortCyclesPerDay float64) error {
+	if currentOn <= 0 || shortCycleMinutes <= 0 || shortCyclesPerDay <= 0 {
+		return fmt.Errorf("the AC current, short cycle and short cycling thresholds must be positive")
+	}
+
+	acCurrentOn, acShortCycleMinutes, acShortCyclesPerDay = currentOn, shortCycleMinutes, shortCyclesPerDay
+
+	return nil
+}
+
+// acProcessor follows the AC state as commanded (control_ac == 1) and as measured
+// (current_ac >= acCurrentOn). A cycle is a compressor run by current whose start and
+// stop both fall inside the window, or inside the parts merged. Metrics of a source without samples are left out.
+type acProcessor struct{}
+
+func (acProcessor) Columns() []Column {
+	return []Column{
+		{"acDurationOnByControl", "AC Duration On By Control"},
+		{"acDurationOffByControl", "AC Duration Off By Control"},
+		{"acDurationOnByCurrent", "AC Duration On By Current"},
+		{"acDurationOffByCurrent", "AC Duration Off By Current"},
+		{"acDutyCycle", "AC Duty Cycle %"},
+		{"acCycles", "AC Cycles"},
+		{"acCycleMeanMinutes", "AC Cycle Mean Minutes"},
+		{"acCycleShortestMinutes", "AC Cycle Shortest Minutes"},
+		{"acShortCycles", "AC Short Cycles"},
+		{"acShortCycling", "AC Short Cycling"},
+		{"acDisagreementMinutes", "AC Control/Current Disagreement Minutes"},
+		{"acDisagreementPct", "AC Control/Current Disagreement %"},
+	}
+}
+
+func (acProcessor) Keys() []string {
+	return []string{"control_ac", "current_ac"}
+}
+
+// acState follows the samples as they stream in, each sample lasting until the next
+type acState struct {
+	hasPrevious     bool
+	first, previous AcEntry
+
+	// Seconds per state
+	onByControl, offByControl, onByCurrent, offByCurrent, disagreement, compared float64
+	hasControl, hasCurrent                                                       bool
+
+	cycles   []float64
+	runStart float64 // NaN while the start of the current run was not seen
+
+	// The run going on at the first sample, whose start was not seen: still going on,
+	// or when it stopped (NaN if it was interrupted)
+	headOpen bool
+	headStop float64
+}
+
+func (state *acState) add(next AcEntry) {
+	// Out of order samples are skipped, the durations need a sorted series
+	if state.hasPrevious && next.Timestamp.Value < state.previous.Timestamp.Value {
+		return
+	}
+
+	prev, hasPrevious := state.previous, state.hasPrevious
+	state.hasPrevious, state.previous = true, next
+
+	if !hasPrevious {
+		state.first = next
+		state.headOpen = next.CurrentAc.Valid && next.CurrentAc.Value >= acCurrentOn
+		return
+	}
+
+	duration := next.Timestamp.Value - prev.Timestamp.Value
+
+	if duration > MAX_SAMPLE_SECONDS {
+		state.runStart, state.headOpen = math.NaN(), false
+		return
+	}
+
+	if prev.ControlAc.Valid {
+		state.hasControl = true
+		if prev.ControlAc.Value == 1 {
+			state.onByControl += duration
+		} else {
+			state.offByControl += duration
+		}
+	}
+
+	if !prev.CurrentAc.Valid {
+		return
+	}
+
+	state.hasCurrent = true
+	running := prev.CurrentAc.Value >= acCurrentOn
+
+	if running {
+		state.onByCurrent += duration
+	} else {
+		state.offByCurrent += duration
+	}
+
+	if prev.ControlAc.Valid {
+		state.compared += duration
+		if (prev.ControlAc.Value == 1) != running {
+			state.disagreement += duration
+		}
+	}
+
+	if !next.CurrentAc.Valid {
+		state.runStart, state.headOpen = math.NaN(), false
+		return
+	}
+
+	nextRunning := next.CurrentAc.Value >= acCurrentOn
+
+	switch {
+	case !running && nextRunning:
+		state.runStart = next.Timestamp.Value
+	case running && !nextRunning:
+		if state.headOpen {
+			state.headStop = next.Timestamp.Value
+		}
+
+		if !math.IsNaN(state.runStart) {
+			state.cycles = append(state.cycles, next.Timestamp.Value-state.runStart)
+		}
+		state.runStart = math.NaN()
+	}
+
+	state.headOpen = state.headOpen && nextRunning
+}
+
+// acPartial is what the totals of a part lose: its edge samples and the runs crossing them.
+type acPartial struct {
+	First *AcEntry `json:"first,omitempty"`
+	Last  *AcEntry `json:"last,omitempty"`
+	// Seconds measured by both control and current
+	Compared float64 `json:"compared,omitempty"`
+	// Start of the run going on at Last, when it was seen
+	OpenStart *float64 `json:"openStart,omitempty"`
+	// The run going on at First: still going on at Last, or when it stopped
+	HeadOpen bool     `json:"headOpen,omitempty"`
+	HeadStop *float64 `json:"headStop,omitempty"`
+}
+
+// seenTime is nil for a NaN timestamp, JSON has no NaN
+func seenTime(ts float64) *float64 {
+	if math.IsNaN(ts) {
+		return nil
+	}
+
+	return &ts
+}
+
+func (state *acState) partial() acPartial {
+	if !state.hasPrevious {
+		return acPartial{}
+	}
+
+	first, last := state.first, state.previous
+
+	return acPartial{
+		First:     &first,
+		Last:      &last,
+		Compared:  state.compared,
+		OpenStart: seenTime(state.runStart),
+		HeadOpen:  state.headOpen,
+		HeadStop:  seenTime(state.headStop),
+	}
+}
+
+// follow joins the next part, returning the boundary between them: the last sample
+// lasting until the first of next, and the cycles of the runs crossing it.
+func (partial *acPartial) follow(next acPartial) *acState {
+	boundary := &acState{runStart: math.NaN(), headStop: math.NaN()}
+
+	if next.First == nil {
+		return boundary
+	}
+
+	if partial.First == nil {
+		*partial = next
+		return boundary
+	}
+
+	boundary.hasPrevious, boundary.previous, boundary.headOpen = true, *partial.Last, partial.HeadOpen
+	if partial.OpenStart != nil {
+		boundary.runStart = *partial.OpenStart
+	}
+
+	// Parts out of order are not joined, the runs across them are interrupted
+	if next.First.Timestamp.Value >= partial.Last.Timestamp.Value {
+		boundary.add(*next.First)
+	} else {
+		boundary.runStart, boundary.headOpen = math.NaN(), false
+	}
+
+	// A run going on at the first sample of next is its head run
+	if !math.IsNaN(boundary.runStart) && next.HeadStop != nil {
+		boundary.cycles = append(boundary.cycles, *next.HeadStop-boundary.runStart)
+	}
+
+	if partial.HeadOpen {
+		partial.HeadOpen, partial.HeadStop = false, seenTime(boundary.headStop)
+
+		if boundary.headOpen {
+			partial.HeadOpen, partial.HeadStop = next.HeadOpen, next.HeadStop
+		}
+	}
+
+	partial.OpenStart = next.OpenStart
+	if next.HeadOpen {
+		partial.OpenStart = seenTime(boundary.runStart)
+	}
+
+	partial.Last = next.Last
+	partial.Compared += boundary.compared + next.Compared
+
+	return boundary
+}
+
+func (state *acState) metrics() map[string]float64 {
+	metrics := map[string]float64{}
+
+	if state.hasControl {
+		metrics["acDurationOnByControl"] = state.onByControl / 60
+		metrics["acDurationOffByControl"] = state.offByControl / 60
+	}
+
+	if state.hasCurrent {
+		metrics["acDurationOnByCurrent"] = state.onByCurrent / 60
+		metrics["acDurationOffByCurrent"] = state.offByCurrent / 60
+		metrics["acCycles"] = float64(len(state.cycles))
+		metrics["acShortCycles"] = 0
+
+		shortest, total := math.Inf(1), 0.0
+
+		for _, cycle := range state.cycles {
+			total += cycle
+			shortest = math.Min(shortest, cycle)
+
+			if cycle < acShortCycleMinutes*60 {
+				metrics["acShortCycles"]++
+			}
+		}
+
+		if len(state.cycles) > 0 {
+			metrics["acCycleMeanMinutes"] = total / float64(len(state.cycles)) / 60
+			metrics["acCycleShortestMinutes"] = shortest / 60
+		}
+	}
+
+	if state.hasControl && state.hasCurrent {
+		metrics["acDisagreementMinutes"] = state.disagreement / 60
+	}
+
+	acRatios(metrics, state.compared/60)
+
+	return metrics
+}
+
+func (acProcessor) NewAggregator() Aggregator {
+	state := &acState{runStart: math.NaN(), headStop: math.NaN()}
+
+	partial := func() json.RawMessage {
+		data, _ := json.Marshal(state.partial())
+		return data
+	}
+
+	return &typedAggregator[AcEntry]{decode: decodeAcEntry, add: state.add, result: state.metrics, partial: partial}
+}
+
+// acRatios derives the duty cycle, disagreement % and short cycling alert from the totals,
+// comparedMinutes being the minutes measured by both control and current.
+func acRatios(metrics map[string]float64, comparedMinutes float64) {
+	if _, ok := metrics["acDurationOnByCurrent"]; ok {
+		metrics["acShortCycling"] = 0
+
+		if measured := metrics["acDurationOnByCurrent"] + metrics["acDurationOffByCurrent"]; measured > 0 {
+			metrics["acDutyCycle"] = metrics["acDurationOnByCurrent"] / measured * 100
+
+			if metrics["acShortCycles"]/(measured/(24*60)) >= acShortCyclesPerDay {
+				metrics["acShortCycling"] = 1
+			}
+		}
+	}
+
+	if _, ok := metrics["acDisagreementMinutes"]; ok && comparedMinutes > 0 {
+		metrics["acDisagreementPct"] = metrics["acDisagreementMinutes"] / comparedMinutes * 100
+	}
+}
+
+// acPartials reads the partial of every part, nil when a part has none
+func acPartials(parts []Part) []acPartial {
+	partials := []acPartial{}
+
+	for _, part := range parts {
+		var partial acPartial
+
+		if part.Partial == nil || json.Unmarshal(part.Partial, &partial) != nil {
+			return nil
+		}
+
+		partials = append(partials, partial)
+	}
+
+	return partials
+}
+
+// Merge adds up the durations and cycles of the parts. With the partials the samples
+// and runs across the boundaries count as in one window, without them the runs
+// crossing a boundary are not counted as cycles and the disagreement % is left out.
+func (acProcessor) Merge(parts []Part) Part {
+	metrics := partMetrics(parts)
+	partials := acPartials(parts)
+
+	var joined acPartial
+	for _, partial := range partials {
+		metrics = append(metrics, joined.follow(partial).metrics())
+	}
+
+	merged := acTotals(metrics)
+	acRatios(merged, joined.Compared/60)
+
+	if partials == nil {
+		return Part{Metrics: merged}
+	}
+
+	data, _ := json.Marshal(joined)
+
+	return Part{Metrics: merged, Partial: data}
+}
+
+// Rollup adds up the durations and cycles of the pis, the ratios coming from the totals.
+// The disagreement % is left out without partials.
+func (acProcessor) Rollup(parts []Part) map[string]float64 {
+	merged := acTotals(partMetrics(parts))
+
+	compared := 0.0
+	for _, partial := range acPartials(parts) {
+		compared += partial.Compared
+	}
+
+	acRatios(merged, compared/60)
+
+	return merged
+}
+
+// acTotals adds up the durations and cycles of the metrics, without the ratios
+func acTotals(metrics []map[string]float64) map[string]float64 {
+	merged := map[string]float64{}
+	cycleMinutes := 0.0
+
+	for _, part := range metrics {
+		for _, key := range []string{
+			"acDurationOnByControl", "acDurationOffByControl", "acDurationOnByCurrent", "acDurationOffByCurrent",
+			"acCycles", "acShortCycles", "acDisagreementMinutes",
+		} {
+			if value, ok := part[key]; ok {
+				merged[key] += value
+			}
+		}
+
+		if shortest, ok := part["acCycleShortestMinutes"]; ok {
+			if current, seen := merged["acCycleShortestMinutes"]; !seen || shortest < current {
+				merged["acCycleShortestMinutes"] = shortest
+			}
+			cycleMinutes += part["acCycleMeanMinutes"] * part["acCycles"]
+		}
+	}
+
+	if merged["acCycles"] > 0 {
+		merged["acCycleMeanMinutes"] = cycleMinutes / merged["acCycles"]
+	}
+
+	return merged
+}
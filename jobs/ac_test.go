@@ -0,0 +1,84 @@
+package jobs
+
+import (
+	"math"
+	"testing"
+)
+
+func acEntries(currents []float64, controls []float64) []map[string]any {
+	entries := []map[string]any{}
+
+	for i := range currents {
+		entries = append(entries, map[string]any{"timestamp": float64(i * 60), "current_ac": currents[i], "control_ac": controls[i]})
+	}
+
+	return entries
+}
+
+func TestAcProcessorCycles(t *testing.T) {
+	processor, _ := GetProcessor("ac")
+
+	entries := acEntries(
+		[]float64{0, 5, 5, 0, 5, 0, 0, 5, 5, 5, 0},
+		[]float64{0, 1, 1, 1, 1, 0, 0, 1, 1, 1, 1},
+	)
+
+	got, _ := processEntries(processor, rawEntries(t, entries))
+
+	want := map[string]float64{
+		"acDurationOnByCurrent": 6, "acDurationOffByCurrent": 4, "acDutyCycle": 60,
+		"acDurationOnByControl": 7, "acDurationOffByControl": 3,
+		"acCycles": 3, "acCycleMeanMinutes": 2, "acCycleShortestMinutes": 1,
+		"acShortCycles": 3, "acShortCycling": 1,
+		"acDisagreementMinutes": 1, "acDisagreementPct": 10,
+	}
+
+	for key, value := range want {
+		if math.Abs(got[key]-value) > 1e-9 {
+			t.Errorf("%s = %v; want %v", key, got[key], value)
+		}
+	}
+
+	// Wherever the parts split the runs, they merge as the whole range
+	for i := 1; i < len(entries); i++ {
+		for j := i; j < len(entries); j++ {
+			parts := []Part{processPart(t, processor, entries[:i]), processPart(t, processor, entries[i:j]), processPart(t, processor, entries[j:])}
+			merged := processor.Merge(parts).Metrics
+
+			for key, value := range got {
+				if math.Abs(merged[key]-value) > 1e-9 {
+					t.Errorf("split at %d and %d: %s = %v; want %v", i, j, key, merged[key], value)
+				}
+			}
+		}
+	}
+
+	// Without the partials, the runs across the split are dropped
+	first, second := processPart(t, processor, entries[:3]), processPart(t, processor, entries[3:])
+	first.Partial, second.Partial = nil, nil
+
+	if merged := processor.Merge([]Part{first, second}).Metrics; merged["acCycles"] != 2 || merged["acDurationOnByCurrent"] != 5 {
+		t.Errorf("merged without partials = %v; want the run and the minute across the split dropped", merged)
+	}
+
+	// The alert is by day of measured time, 3 short cycles in 2 days are not short cycling
+	twoDays := map[string]float64{"acDurationOnByCurrent": 600, "acDurationOffByCurrent": 2*24*60 - 600, "acShortCycles": 3}
+	if acRatios(twoDays, 0); twoDays["acShortCycling"] != 0 {
+		t.Errorf("3 short cycles in 2 days = %v; want no alert", twoDays)
+	}
+
+	if _, ok := got["acComparedMinutes"]; ok {
+		t.Errorf("metrics %v have the compared minutes", got)
+	}
+
+	// On the whole window: no cycle, but a 100% duty cycle rather than a comparison with the average
+	alwaysOn, _ := processEntries(processor, rawEntries(t, acEntries([]float64{8, 8, 9, 8}, []float64{1, 1, 1, 1})))
+
+	if alwaysOn["acDutyCycle"] != 100 || alwaysOn["acCycles"] != 0 || alwaysOn["acDisagreementMinutes"] != 0 {
+		t.Errorf("always on = %v", alwaysOn)
+	}
+
+	if _, ok := alwaysOn["acCycleMeanMinutes"]; ok {
+		t.Errorf("always on has a cycle length: %v", alwaysOn)
+	}
+}
@@ -0,0 +1,310 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SERIES_FORMAT_LONG = "long" // one row per pi, bucket and metric
+	SERIES_FORMAT_WIDE = "wide" // one row per pi and bucket
+)
+
+const (
+	BUCKET_DAY   = "day"
+	BUCKET_WEEK  = "week"
+	BUCKET_MONTH = "month"
+)
+
+// Bucketing cuts a time range into half-open [start, end) buckets. Fixed sizes are
+// aligned on Location's clock ("1h" buckets start on the hour), calendar buckets
+// follow the calendar of Location (days, weeks starting Monday, months).
+type Bucketing struct {
+	Size     int64 // seconds
+	Calendar string
+	Location *time.Location
+}
+
+type BucketResult struct {
+	Start         int64              `json:"start"`
+	End           int64              `json:"end"`
+	ProcessedData map[string]float64 `json:"processedData"`
+	// See ApiResponse.Partial
+	Partial json.RawMessage `json:"partial,omitempty"`
+}
+
+// ParseBucketing reads "5m", "1h", "1d" style sizes or "day", "week", "month".
+// An empty spec disables bucketing.
+func ParseBucketing(spec string) (Bucketing, error) {
+	bucketing := Bucketing{Location: time.Local}
+
+	switch spec = strings.TrimSpace(strings.ToLower(spec)); spec {
+	case "":
+		return bucketing, nil
+	case BUCKET_DAY, BUCKET_WEEK, BUCKET_MONTH:
+		bucketing.Calendar = spec
+		return bucketing, nil
+	}
+
+	var size time.Duration
+
+	if days, ok := strings.CutSuffix(spec, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return bucketing, fmt.Errorf("invalid bucket %q", spec)
+		}
+		size = time.Duration(n) * 24 * time.Hour
+	} else {
+		var err error
+		if size, err = time.ParseDuration(spec); err != nil {
+			return bucketing, fmt.Errorf("invalid bucket %q", spec)
+		}
+	}
+
+	if size < time.Minute || size%time.Second != 0 {
+		return bucketing, fmt.Errorf("invalid bucket %q, buckets are whole seconds of at least a minute", spec)
+	}
+
+	bucketing.Size = int64(size / time.Second)
+
+	return bucketing, nil
+}
+
+// String is the spec of b the way ParseBucketing reads it, "" without bucketing
+func (b Bucketing) String() string {
+	switch {
+	case b.Calendar != "":
+		return b.Calendar
+	case b.Size == 0:
+		return ""
+	case b.Size%86400 == 0:
+		return fmt.Sprintf("%dd", b.Size/86400)
+	case b.Size%3600 == 0:
+		return fmt.Sprintf("%dh", b.Size/3600)
+	case b.Size%60 == 0:
+		return fmt.Sprintf("%dm", b.Size/60)
+	default:
+		return fmt.Sprintf("%ds", b.Size)
+	}
+}
+
+func (b Bucketing) Enabled() bool {
+	return b.Size > 0 || b.Calendar != ""
+}
+
+func (b Bucketing) location() *time.Location {
+	if b.Location == nil {
+		return time.Local
+	}
+
+	return b.Location
+}
+
+// Start is the start of the bucket holding ts.
+func (b Bucketing) Start(ts int64) int64 {
+	t := time.Unix(ts, 0).In(b.location())
+
+	switch b.Calendar {
+	case BUCKET_DAY:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location()).Unix()
+	case BUCKET_WEEK:
+		daysSinceMonday := (int(t.Weekday()) + 6) % 7
+		return time.Date(t.Year(), t.Month(), t.Day()-daysSinceMonday, 0, 0, 0, 0, t.Location()).Unix()
+	case BUCKET_MONTH:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location()).Unix()
+	}
+
+	_, offset := t.Zone()
+
+	local := ts + int64(offset)
+	rest := local % b.Size
+	if rest < 0 {
+		rest += b.Size
+	}
+
+	return ts - rest
+}
+
+// End is the start of the bucket after the one starting at start.
+func (b Bucketing) End(start int64) int64 {
+	t := time.Unix(start, 0).In(b.location())
+
+	switch b.Calendar {
+	case BUCKET_DAY:
+		return t.AddDate(0, 0, 1).Unix()
+	case BUCKET_WEEK:
+		return t.AddDate(0, 0, 7).Unix()
+	case BUCKET_MONTH:
+		return t.AddDate(0, 1, 0).Unix()
+	}
+
+	return start + b.Size
+}
+
+// splitBucketedRange cuts [start, end) in intervals of at most delta ending on bucket
+// boundaries, so that a bucket only spans several intervals when it is longer than
+// delta. nextWindow uses it for the windows of fetchWindow, unitIntervals for the units.
+func splitBucketedRange(startTime, endTime int64, delta int64, b Bucketing) [][2]int64 {
+	var intervals [][2]int64
+
+	for from := startTime; from < endTime; {
+		to := from
+
+		for to < endTime {
+			next := min(b.End(b.Start(to)), endTime)
+
+			if to > from && next-from > delta {
+				break
+			}
+
+			to = next
+		}
+
+		if to-from > delta {
+			to = from + delta
+		}
+
+		intervals = append(intervals, [2]int64{from, to})
+		from = to
+	}
+
+	return intervals
+}
+
+// bucketAggregators feeds the entries of [start, end) to one aggregator per bucket.
+// APIs returning both ends of their range would otherwise count the boundary entries
+// in two sub-intervals.
+type bucketAggregators struct {
+	processor  Processor
+	bucketing  Bucketing
+	start, end int64
+	byStart    map[int64]Aggregator
+}
+
+func newBucketAggregators(processor Processor, b Bucketing, start int64, end int64) *bucketAggregators {
+	return &bucketAggregators{processor: processor, bucketing: b, start: start, end: end, byStart: map[int64]Aggregator{}}
+}
+
+// Add reports whether the entry is inside the window
+func (buckets *bucketAggregators) Add(entry json.RawMessage) bool {
+	ts, ok := entryTimestamp(entry)
+	if !ok || ts < buckets.start || ts >= buckets.end {
+		return false
+	}
+
+	start := buckets.bucketing.Start(ts)
+
+	aggregator, ok := buckets.byStart[start]
+	if !ok {
+		aggregator = buckets.processor.NewAggregator()
+		buckets.byStart[start] = aggregator
+	}
+
+	aggregator.Add(entry)
+
+	return true
+}
+
+// Results has every bucket holding at least one entry. Invalid entries are left to the
+// validation of the whole window.
+func (buckets *bucketAggregators) Results() []BucketResult {
+	results := []BucketResult{}
+
+	for start, aggregator := range buckets.byStart {
+		part, _ := partOf(aggregator)
+		results = append(results, BucketResult{Start: start, End: buckets.bucketing.End(start), ProcessedData: part.Metrics, Partial: part.Partial})
+	}
+
+	sort.Slice(results, func(i, j int) bool { return results[i].Start < results[j].Start })
+
+	return results
+}
+
+func (sys *System) seriesRecords(results []ApiResponse, mode string, format string, b Bucketing) [][]string {
+	processor, err := sys.processor(mode)
+	if err != nil {
+		fmt.Println("Invalid mode")
+		return nil
+	}
+
+	header := []string{"PI ID", "POP", "Bucket Start"}
+
+	if format == SERIES_FORMAT_WIDE {
+		for _, column := range processor.Columns() {
+			header = append(header, column.Header)
+		}
+	} else {
+		header = append(header, "Metric", "Value")
+	}
+
+	records := [][]string{header}
+
+	for _, result := range results {
+		for _, bucket := range result.Buckets {
+			row := []string{
+				fmt.Sprintf("%d", result.PID),
+				result.POP,
+				time.Unix(bucket.Start, 0).In(b.location()).Format(time.RFC3339),
+			}
+
+			if format == SERIES_FORMAT_WIDE {
+				for _, column := range processor.Columns() {
+					row = append(row, metricCell(bucket.ProcessedData, column.Key))
+				}
+				records = append(records, row)
+				continue
+			}
+
+			for _, column := range processor.Columns() {
+				if _, ok := bucket.ProcessedData[column.Key]; ok {
+					records = append(records, append(row[:3:3], column.Key, metricCell(bucket.ProcessedData, column.Key)))
+				}
+			}
+		}
+	}
+
+	return records
+}
+
+// CollectBucketedResults crawls one mode in windows cut on bucket boundaries and returns
+// one result per pi holding its per-bucket metrics.
+func CollectBucketedResults(ctx context.Context, sys *System, sel Selection, startTime int64, endTime int64, rateLimit int, delaySeconds int, mode string, b Bucketing) []ApiResponse {
+	endpoints := sys.getEndpoints(startTime, endTime, sel, mode)
+
+	fmt.Printf("Found %d Endpoints\n", len(endpoints))
+
+	fmt.Println("Starting API calls...")
+
+	results := sys.fetchAll(ctx, endpoints, mode, rateLimit, delaySeconds, b)
+
+	sort.Slice(results, func(i, j int) bool { return results[i].PID < results[j].PID })
+
+	return results
+}
+
+// RunBucketedPipeline writes per-bucket metrics of every selected pi in the long or wide format.
+func RunBucketedPipeline(ctx context.Context, sys *System, sel Selection, startTime int64, endTime int64, rateLimit int, delaySeconds int, outputFile string, mode string, b Bucketing, format string) []ApiResponse {
+	results := CollectBucketedResults(ctx, sys, sel, startTime, endTime, rateLimit, delaySeconds, mode, b)
+
+	sys.writeSeries(results, mode, startTime, endTime, outputFile, b, format)
+
+	return results
+}
+
+// writeSeries writes the series and failure report of a bucketed run
+func (sys *System) writeSeries(results []ApiResponse, mode string, startTime int64, endTime int64, outputFile string, b Bucketing, format string) {
+	sys.writeCsvRecords(sys.seriesRecords(results, mode, format, b), outputFile)
+
+	fmt.Printf("Series have been written to %s\n", outputFile)
+
+	// The series can not be patched row by row
+	report := newFailureReport(sys.Name, mode, startTime, endTime, outputFile, results)
+	report.Bucketed = true
+
+	writeFailureReport(report)
+}
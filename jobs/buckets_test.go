@@ -0,0 +1,133 @@
+package jobs
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBucketingAlignsOnTheClock(t *testing.T) {
+	hanoi := time.FixedZone("ICT", 7*3600)
+
+	hourly, err := ParseBucketing("1h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hourly.Location = hanoi
+
+	ts := time.Date(2025, 4, 8, 10, 42, 0, 0, hanoi).Unix()
+	if got, want := hourly.Start(ts), time.Date(2025, 4, 8, 10, 0, 0, 0, hanoi).Unix(); got != want {
+		t.Errorf("1h Start = %d; want %d", got, want)
+	}
+
+	daily := Bucketing{Size: 24 * 3600, Location: hanoi}
+	if got, want := daily.Start(ts), time.Date(2025, 4, 8, 0, 0, 0, 0, hanoi).Unix(); got != want {
+		t.Errorf("1d Start = %d; want local midnight %d", got, want)
+	}
+
+	monthly := Bucketing{Calendar: BUCKET_MONTH, Location: hanoi}
+	start := monthly.Start(ts)
+	if start != time.Date(2025, 4, 1, 0, 0, 0, 0, hanoi).Unix() || monthly.End(start) != time.Date(2025, 5, 1, 0, 0, 0, 0, hanoi).Unix() {
+		t.Errorf("month bucket = [%d, %d)", start, monthly.End(start))
+	}
+
+	weekly := Bucketing{Calendar: BUCKET_WEEK, Location: hanoi}
+	if got, want := weekly.Start(ts), time.Date(2025, 4, 7, 0, 0, 0, 0, hanoi).Unix(); got != want {
+		t.Errorf("week Start = %d; want Monday %d", got, want)
+	}
+
+	for _, spec := range []string{"10s", "xd", "fortnight"} {
+		if _, err := ParseBucketing(spec); err == nil {
+			t.Errorf("ParseBucketing(%q) should fail", spec)
+		}
+	}
+}
+
+func TestSplitBucketedRangeCutsOnBoundaries(t *testing.T) {
+	b := Bucketing{Size: 3 * 3600, Location: time.UTC}
+
+	// 8h sub-intervals end on the last 3h boundary that fits
+	got := splitBucketedRange(3600, 13*3600, 8*3600, b)
+	want := [][2]int64{{3600, 9 * 3600}, {9 * 3600, 13 * 3600}}
+
+	if len(got) != len(want) {
+		t.Fatalf("intervals = %v; want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("intervals = %v; want %v", got, want)
+			break
+		}
+	}
+
+	// Buckets longer than delta are split by delta
+	daily := Bucketing{Calendar: BUCKET_DAY, Location: time.UTC}
+	if got := splitBucketedRange(0, 86400, 8*3600, daily); len(got) != 3 || got[2] != [2]int64{16 * 3600, 86400} {
+		t.Errorf("daily intervals = %v; want three 8h intervals", got)
+	}
+}
+
+func TestBucketedRunCountsBoundaryEntriesOnce(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/pis":
+			w.Write([]byte(`{"data": [{"id": 1, "name": "HNI0001"}]}`))
+		case "/logs/1":
+			// Both sub-intervals get the entry at their shared 8h boundary
+			w.Write([]byte(`{"data": {"success": true, "data": [
+				{"timestamp": 0, "temperature_0": 20},
+				{"timestamp": 3600, "temperature_0": 22},
+				{"timestamp": 28800, "temperature_0": 40},
+				{"timestamp": 32400, "temperature_0": 25}
+			]}}`))
+		}
+	}))
+	defer server.Close()
+
+	sys := &System{
+		Name:        "bucketed",
+		BaseURL:     server.URL,
+		PiListRoute: "/pis?folderId=%s",
+		LogRoutes:   map[string]string{"TEMP": "/logs/%d?from=%d&to=%d"},
+		Processors:  map[string]string{"TEMP": "opms-temp"},
+		Envelope:    Envelope{EntriesPath: "data.data", SuccessPath: "data.success"},
+	}
+
+	b := Bucketing{Size: 8 * 3600, Location: time.UTC}
+
+	results := CollectBucketedResults(context.Background(), sys, Selection{}, 0, 16*3600, 10, 0, "TEMP", b)
+
+	if len(results) != 1 || results[0].Windows != 2 {
+		t.Fatalf("results = %+v; want 1 pi fetched in 2 windows", results)
+	}
+
+	buckets := results[0].Buckets
+	if len(buckets) != 2 {
+		t.Fatalf("buckets = %+v; want 2", buckets)
+	}
+
+	if buckets[0].ProcessedData["t1Max"] != 22 || buckets[1].ProcessedData["t1Min"] != 25 || buckets[1].ProcessedData["t1Max"] != 40 {
+		t.Errorf("buckets = %+v; want the 8h entry only in the second bucket", buckets)
+	}
+
+	outputFile := filepath.Join(t.TempDir(), "series.csv")
+	sys.writeCsvRecords(sys.seriesRecords(results, "TEMP", SERIES_FORMAT_LONG, b), outputFile)
+
+	records, err := readCsvRecords(outputFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// header + 2 buckets * (10 T1 metrics + the zero counts of T2 to T4)
+	if len(records) != 27 || records[1][2] != "1970-01-01T00:00:00Z" || records[1][3] != "t1Min" || records[1][4] != "20.00" {
+		t.Errorf("long records = %v", records[:2])
+	}
+
+	wide := sys.seriesRecords(results, "TEMP", SERIES_FORMAT_WIDE, b)
+	if len(wide) != 3 || len(wide[0]) != 43 || wide[1][13] != "" {
+		t.Errorf("wide records = %v; want a header and one row per bucket", wide)
+	}
+}
@@ -0,0 +1,255 @@
+package jobs
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	DIFF_STATUS  = "status"  // success in one run, an error in the other
+	DIFF_MISSING = "missing" // pi only in the before run
+	DIFF_NEW     = "new"     // pi only in the after run
+	DIFF_CHANGED = "changed" // a metric moved past the thresholds
+
+	DIFF_MIN_PERCENT_DEFAULT = 10.0
+
+	DIFF_FORMAT_TABLE    = "table"
+	DIFF_FORMAT_CSV      = "csv"
+	DIFF_FORMAT_MARKDOWN = "markdown"
+)
+
+// DiffThresholds are how far a metric must move to be reported, both must be reached.
+type DiffThresholds struct {
+	MinAbsolute float64
+	MinPercent  float64
+}
+
+// DiffResult is one pi of a run output, Metrics keyed by the CSV header.
+type DiffResult struct {
+	PiId    int
+	POP     string
+	Status  string
+	Metrics map[string]float64
+}
+
+// DiffRow is one change between two runs. Percent is infinite for a metric moving off 0.
+type DiffRow struct {
+	PiId     int
+	POP      string
+	Change   string
+	Metric   string
+	Before   string
+	After    string
+	Absolute float64
+	Percent  float64
+}
+
+// ReadDiffResults reads the CSV output of a run, not a bucketed series.
+func ReadDiffResults(inputFile string) ([]DiffResult, []string, error) {
+	records, err := readCsvRecords(inputFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(records) == 0 || len(records[0]) < 3 || records[0][0] != "PI ID" || records[0][2] != "Status" {
+		return nil, nil, fmt.Errorf("%s is not the output of a run", inputFile)
+	}
+
+	metrics := records[0][3:]
+	results := []DiffResult{}
+
+	for line, record := range records[1:] {
+		if len(record) < 3 {
+			continue
+		}
+
+		piId, err := strconv.Atoi(record[0])
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s line %d: invalid pi id %q", inputFile, line+2, record[0])
+		}
+
+		result := DiffResult{PiId: piId, POP: record[1], Status: record[2], Metrics: map[string]float64{}}
+
+		if result.Status == "success" {
+			for i, metric := range metrics {
+				// Blank cells had no data
+				if i+3 >= len(record) || record[i+3] == "" {
+					continue
+				}
+
+				if value, err := strconv.ParseFloat(record[i+3], 64); err == nil {
+					result.Metrics[metric] = value
+				}
+			}
+		}
+
+		results = append(results, result)
+	}
+
+	return results, metrics, nil
+}
+
+// DiffResults joins two runs by pi id. It reports the pis new or missing in after, the
+// status changes and the metrics of both runs moving past the thresholds, ranked by kind
+// then by the size of the change.
+func DiffResults(before []DiffResult, after []DiffResult, metrics []string, thresholds DiffThresholds) []DiffRow {
+	beforeByPi := map[int]DiffResult{}
+	for _, result := range before {
+		beforeByPi[result.PiId] = result
+	}
+
+	afterByPi := map[int]DiffResult{}
+	for _, result := range after {
+		afterByPi[result.PiId] = result
+	}
+
+	rows := []DiffRow{}
+
+	for _, old := range before {
+		if _, ok := afterByPi[old.PiId]; !ok {
+			rows = append(rows, DiffRow{PiId: old.PiId, POP: old.POP, Change: DIFF_MISSING, Before: old.Status})
+		}
+	}
+
+	for _, current := range after {
+		old, ok := beforeByPi[current.PiId]
+		if !ok {
+			rows = append(rows, DiffRow{PiId: current.PiId, POP: current.POP, Change: DIFF_NEW, After: current.Status})
+			continue
+		}
+
+		if (old.Status == "success") != (current.Status == "success") {
+			rows = append(rows, DiffRow{PiId: current.PiId, POP: current.POP, Change: DIFF_STATUS, Before: old.Status, After: current.Status})
+			continue
+		}
+
+		for _, metric := range metrics {
+			oldValue, okBefore := old.Metrics[metric]
+			value, okAfter := current.Metrics[metric]
+			if !okBefore || !okAfter {
+				continue
+			}
+
+			absolute := value - oldValue
+
+			percent := math.Inf(1)
+			if oldValue != 0 {
+				percent = absolute / math.Abs(oldValue) * 100
+			} else if absolute < 0 {
+				percent = math.Inf(-1)
+			}
+
+			if absolute == 0 || math.Abs(absolute) < thresholds.MinAbsolute || math.Abs(percent) < thresholds.MinPercent {
+				continue
+			}
+
+			rows = append(rows, DiffRow{
+				PiId:     current.PiId,
+				POP:      current.POP,
+				Change:   DIFF_CHANGED,
+				Metric:   metric,
+				Before:   formatDiffValue(oldValue),
+				After:    formatDiffValue(value),
+				Absolute: absolute,
+				Percent:  percent,
+			})
+		}
+	}
+
+	rank := map[string]int{DIFF_STATUS: 0, DIFF_MISSING: 1, DIFF_NEW: 2, DIFF_CHANGED: 3}
+
+	sort.SliceStable(rows, func(i, j int) bool {
+		a, b := rows[i], rows[j]
+
+		if rank[a.Change] != rank[b.Change] {
+			return rank[a.Change] < rank[b.Change]
+		}
+		if math.Abs(a.Percent) != math.Abs(b.Percent) {
+			return math.Abs(a.Percent) > math.Abs(b.Percent)
+		}
+		if math.Abs(a.Absolute) != math.Abs(b.Absolute) {
+			return math.Abs(a.Absolute) > math.Abs(b.Absolute)
+		}
+		return a.PiId < b.PiId
+	})
+
+	return rows
+}
+
+// DiffFiles diffs the CSV outputs of two runs on the metrics they both have.
+func DiffFiles(beforeFile string, afterFile string, thresholds DiffThresholds) ([]DiffRow, error) {
+	before, beforeMetrics, err := ReadDiffResults(beforeFile)
+	if err != nil {
+		return nil, err
+	}
+
+	after, afterMetrics, err := ReadDiffResults(afterFile)
+	if err != nil {
+		return nil, err
+	}
+
+	metrics := []string{}
+	for _, metric := range afterMetrics {
+		if slices.Contains(beforeMetrics, metric) {
+			metrics = append(metrics, metric)
+		}
+	}
+
+	if len(metrics) == 0 && len(afterMetrics) > 0 {
+		return nil, fmt.Errorf("%s and %s have no metric in common, are they of the same mode?", beforeFile, afterFile)
+	}
+
+	return DiffResults(before, after, metrics, thresholds), nil
+}
+
+func formatDiffValue(value float64) string {
+	return fmt.Sprintf("%.2f", value)
+}
+
+// DiffRecords is a diff as a table, the changes of metrics signed
+func DiffRecords(rows []DiffRow) [][]string {
+	records := [][]string{{"PI ID", "POP", "Change", "Metric", "Before", "After", "Absolute", "Percent"}}
+
+	for _, row := range rows {
+		absolute, percent := "", ""
+
+		if row.Change == DIFF_CHANGED {
+			absolute = fmt.Sprintf("%+.2f", row.Absolute)
+
+			if math.IsInf(row.Percent, 0) {
+				percent = "n/a"
+			} else {
+				percent = fmt.Sprintf("%+.1f%%", row.Percent)
+			}
+		}
+
+		records = append(records, []string{fmt.Sprintf("%d", row.PiId), row.POP, row.Change, row.Metric, row.Before, row.After, absolute, percent})
+	}
+
+	return records
+}
+
+// MarkdownTable renders records with a header row as a GitHub flavored table.
+func MarkdownTable(records [][]string) string {
+	var table strings.Builder
+
+	escape := func(cell string) string { return strings.ReplaceAll(cell, "|", "\\|") }
+
+	for i, record := range records {
+		cells := []string{}
+		for _, cell := range record {
+			cells = append(cells, escape(cell))
+		}
+		table.WriteString("| " + strings.Join(cells, " | ") + " |\n")
+
+		if i == 0 {
+			table.WriteString("|" + strings.Repeat(" --- |", len(record)) + "\n")
+		}
+	}
+
+	return table.String()
+}
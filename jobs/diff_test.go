@@ -0,0 +1,70 @@
+package jobs
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDiffFiles(t *testing.T) {
+	dir := t.TempDir()
+
+	beforeFile := filepath.Join(dir, "before.csv")
+	os.WriteFile(beforeFile, []byte(strings.Join([]string{
+		"PI ID,POP,Status,T1 Avg,T1 Max",
+		"1,HNI001,success,20.00,30.00",
+		"2,HNI002,success,25.00,40.00",
+		"3,HNI003,success,0.00,10.00",
+		"4,HNI004,success,22.00,28.00",
+		"5,HNI005,success,22.00,28.00",
+	}, "\n")), 0644)
+
+	afterFile := filepath.Join(dir, "after.csv")
+	os.WriteFile(afterFile, []byte(strings.Join([]string{
+		"PI ID,POP,Status,T1 Avg,T1 Max,T2 Avg",
+		"1,HNI001,success,21.00,45.00,1.00",
+		"2,HNI002,success,20.00,40.50,",
+		"3,HNI003,success,5.00,10.00,",
+		"4,HNI004,error,,timeout",
+		"6,HNI006,success,22.00,28.00,",
+	}, "\n")), 0644)
+
+	rows, err := DiffFiles(beforeFile, afterFile, DiffThresholds{MinAbsolute: 1, MinPercent: DIFF_MIN_PERCENT_DEFAULT})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := []string{}
+	for _, row := range rows {
+		got = append(got, row.Change+" "+row.POP+" "+row.Metric)
+	}
+
+	// T1 Avg of pi 1 moved 5% and T1 Max of pi 2 by 0.5, both under the thresholds
+	want := []string{
+		"status HNI004 ",
+		"missing HNI005 ",
+		"new HNI006 ",
+		"changed HNI003 T1 Avg",
+		"changed HNI001 T1 Max",
+		"changed HNI002 T1 Avg",
+	}
+
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Fatalf("rows = %q; want %q", got, want)
+	}
+
+	if !math.IsInf(rows[3].Percent, 1) || rows[4].Percent != 50 || rows[5].Absolute != -5 {
+		t.Errorf("changes = %+v", rows[3:])
+	}
+
+	records := DiffRecords(rows)
+	if strings.Join(records[6], ",") != "2,HNI002,changed,T1 Avg,25.00,20.00,-5.00,-20.0%" {
+		t.Errorf("record = %v", records[6])
+	}
+
+	if table := MarkdownTable(records[:2]); !strings.HasPrefix(table, "| PI ID | POP |") || !strings.Contains(table, "| --- |") {
+		t.Errorf("markdown = %q", table)
+	}
+}
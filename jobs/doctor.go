@@ -0,0 +1,133 @@
+package jobs
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	CHECK_PASS = "pass"
+	CHECK_FAIL = "fail"
+	CHECK_SKIP = "skip"
+)
+
+// Check is the outcome of one doctor check.
+type Check struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+func (c Check) String() string {
+	icon := map[string]string{CHECK_PASS: "✅", CHECK_FAIL: "❌", CHECK_SKIP: "⚠️"}[c.Status]
+
+	if c.Detail == "" {
+		return fmt.Sprintf("%s %s", icon, c.Name)
+	}
+
+	return fmt.Sprintf("%s %s: %s", icon, c.Name, c.Detail)
+}
+
+func CheckResult(name string, err error, detail string) Check {
+	if err != nil {
+		return Check{name, CHECK_FAIL, err.Error()}
+	}
+
+	return Check{name, CHECK_PASS, detail}
+}
+
+// DiagnoseSystem checks that the pi list host of sys resolves, accepts connections and,
+// over https, completes a TLS handshake. It then calls the pi list and the log route
+// of every mode for the last hour of the first pi.
+func DiagnoseSystem(sys *System, timeout time.Duration) []Check {
+	prefix := sys.Name + " "
+
+	listURL, err := url.Parse(sys.url(fmt.Sprintf(sys.PiListRoute, "")))
+	if err == nil && listURL.Host == "" {
+		err = fmt.Errorf("%s has no base URL, set %s_BASE_URL", sys.Name, strings.ToUpper(sys.Name))
+	}
+	if err != nil {
+		return []Check{CheckResult(prefix+"base URL", err, "")}
+	}
+
+	checks := []Check{}
+	reachable := true
+
+	add := func(check Check) {
+		checks = append(checks, check)
+		reachable = reachable && check.Status != CHECK_FAIL
+	}
+
+	host, port := listURL.Hostname(), listURL.Port()
+	if port == "" {
+		port = map[string]string{"https": "443"}[listURL.Scheme]
+		if port == "" {
+			port = "80"
+		}
+	}
+
+	addrs, err := net.LookupHost(host)
+	add(CheckResult(prefix+"DNS "+host, err, fmt.Sprintf("%v", addrs)))
+
+	if reachable {
+		start := time.Now()
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, port), timeout)
+		if err == nil {
+			conn.Close()
+		}
+		add(CheckResult(prefix+"TCP "+net.JoinHostPort(host, port), err, time.Since(start).Round(time.Millisecond).String()))
+	}
+
+	if reachable && listURL.Scheme == "https" {
+		conn, err := tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", net.JoinHostPort(host, port), &tls.Config{ServerName: host})
+		detail := ""
+		if err == nil {
+			state := conn.ConnectionState()
+			detail = fmt.Sprintf("%s, certificate valid until %s", tls.VersionName(state.Version), state.PeerCertificates[0].NotAfter.Format("2006-01-02"))
+			conn.Close()
+		}
+		add(CheckResult(prefix+"TLS", err, detail))
+	}
+
+	if !reachable {
+		return append(checks, Check{prefix + "API calls", CHECK_SKIP, "the host is not reachable"})
+	}
+
+	pis, err := sys.fetchPiList("")
+	add(CheckResult(prefix+"pi list", err, fmt.Sprintf("%d pis", len(pis))))
+
+	if err != nil || len(pis) == 0 {
+		return append(checks, Check{prefix + "log calls", CHECK_SKIP, "no pi to ask for logs"})
+	}
+
+	client := &http.Client{Timeout: timeout}
+	end := time.Now().Unix()
+	start := end - 3600
+
+	for _, mode := range sys.Modes() {
+		name := fmt.Sprintf("%s%s log of pi %d", prefix, mode, pis[0].Id)
+
+		processor, err := sys.processor(mode)
+		if err != nil {
+			add(CheckResult(name, err, ""))
+			continue
+		}
+
+		endpoint := Endpoint{piId: pis[0].Id, pop: pis[0].Name, start: start, end: end}
+
+		window := sys.fetchWindow(context.Background(), client, processor, endpoint, mode, start, end, Bucketing{})
+		if window.failure.Status == "error" {
+			err = fmt.Errorf("%s: %s", window.failure.ErrorClass, window.failure.Error)
+		}
+
+		add(CheckResult(name, err, fmt.Sprintf("%d entries in the last hour", window.entries)))
+	}
+
+	return checks
+}
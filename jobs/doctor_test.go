@@ -0,0 +1,58 @@
+package jobs
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDiagnoseSystem(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/pis":
+			w.Write([]byte(`{"data": [{"id": 7, "name": "HNI0007"}]}`))
+		case "/temp/7":
+			w.Write([]byte(`{"data": {"success": true, "data": [{"timestamp": 0, "temperature_0": 20}]}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	sys := &System{
+		Name:        "doctored",
+		BaseURL:     server.URL,
+		PiListRoute: "/pis?folderId=%s",
+		LogRoutes:   map[string]string{"TEMP": "/temp/%d?from=%d&to=%d", "FAN": "/fan/%d?from=%d&to=%d"},
+		Processors:  map[string]string{"TEMP": "opms-temp", "FAN": "fan"},
+		Envelope:    Envelope{EntriesPath: "data.data", SuccessPath: "data.success"},
+	}
+
+	statuses := map[string]string{}
+	for _, check := range DiagnoseSystem(sys, time.Second) {
+		statuses[check.Name] = check.Status
+	}
+
+	want := map[string]string{
+		"doctored DNS 127.0.0.1":                          CHECK_PASS,
+		"doctored pi list":                                CHECK_PASS,
+		"doctored TEMP log of pi 7":                       CHECK_PASS,
+		"doctored FAN log of pi 7":                        CHECK_FAIL,
+		"doctored TCP " + server.Listener.Addr().String(): CHECK_PASS,
+	}
+
+	for name, status := range want {
+		if statuses[name] != status {
+			t.Errorf("%s = %q; want %q (checks %v)", name, statuses[name], status, statuses)
+		}
+	}
+
+	server.Close()
+
+	for _, check := range DiagnoseSystem(sys, time.Second) {
+		if check.Name == "doctored API calls" && check.Status != CHECK_SKIP {
+			t.Errorf("API calls = %+v; want skipped once the server is down", check)
+		}
+	}
+}
@@ -0,0 +1,277 @@
+package jobs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Number is a lenient JSON number: it accepts 12.5 and "12.5", and null, "" or a
+// missing key leave it invalid instead of 0.
+type Number struct {
+	Value float64
+	Valid bool
+}
+
+func (n *Number) UnmarshalJSON(data []byte) error {
+	*n = Number{}
+
+	data = bytes.TrimSpace(data)
+
+	if bytes.Equal(data, []byte("null")) {
+		return nil
+	}
+
+	text := string(data)
+
+	if len(data) > 0 && data[0] == '"' {
+		if err := json.Unmarshal(data, &text); err != nil {
+			return err
+		}
+
+		if text = strings.TrimSpace(text); text == "" {
+			return nil
+		}
+	}
+
+	value, err := strconv.ParseFloat(text, 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return fmt.Errorf("%s is not a number", data)
+	}
+
+	*n = Number{Value: value, Valid: true}
+
+	return nil
+}
+
+func (n Number) MarshalJSON() ([]byte, error) {
+	if !n.Valid {
+		return []byte("null"), nil
+	}
+
+	return json.Marshal(n.Value)
+}
+
+// seconds reads a timestamp in seconds, accepting milliseconds too
+func (n Number) seconds() (int64, bool) {
+	if !n.Valid {
+		return 0, false
+	}
+
+	if n.Value > 1e12 {
+		return int64(n.Value / 1000), true
+	}
+
+	return int64(n.Value), true
+}
+
+// ValidationError counts the entries of one pi that could not be decoded.
+type ValidationError struct {
+	Invalid  int
+	Total    int
+	Examples []string
+}
+
+const VALIDATION_EXAMPLES = 3
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("%d of %d entries invalid: %s", e.Invalid, e.Total, strings.Join(e.Examples, "; "))
+}
+
+func (e *ValidationError) add(index int, err error) {
+	e.Invalid++
+
+	if len(e.Examples) < VALIDATION_EXAMPLES {
+		e.Examples = append(e.Examples, fmt.Sprintf("entry %d: %v", index, err))
+	}
+}
+
+// typedAggregator decodes every entry with decode and hands the valid ones to add.
+// Entries that do not decode are counted in a *ValidationError.
+type typedAggregator[T any] struct {
+	decode     func(data []byte) (T, error)
+	add        func(entry T)
+	result     func() map[string]float64
+	partial    func() json.RawMessage // nil when the metrics merge by themselves
+	validation ValidationError
+}
+
+func (a *typedAggregator[T]) Add(raw json.RawMessage) {
+	index := a.validation.Total
+	a.validation.Total++
+
+	entry, err := a.decode(raw)
+	if err != nil {
+		a.validation.add(index, err)
+		return
+	}
+
+	a.add(entry)
+}
+
+func (a *typedAggregator[T]) Result() (map[string]float64, error) {
+	metrics := a.result()
+
+	if a.validation.Invalid > 0 {
+		validation := a.validation
+		return metrics, &validation
+	}
+
+	return metrics, nil
+}
+
+func (a *typedAggregator[T]) Partial() json.RawMessage {
+	if a.partial == nil {
+		return nil
+	}
+
+	return a.partial()
+}
+
+// processEntries feeds decoded entries to a new aggregator of processor
+func processEntries(processor Processor, entries []json.RawMessage) (map[string]float64, error) {
+	aggregator := processor.NewAggregator()
+
+	for _, entry := range entries {
+		aggregator.Add(entry)
+	}
+
+	return aggregator.Result()
+}
+
+func unmarshalEntry[T any](data []byte) (T, error) {
+	var entry T
+
+	err := json.Unmarshal(data, &entry)
+
+	return entry, err
+}
+
+var errMissingTimestamp = fmt.Errorf("missing timestamp")
+
+// FanEntry is one fan-pop log entry of the 4 fans.
+type FanEntry struct {
+	Timestamp Number
+	Rps       [4]Number
+	Control   [4]Number
+}
+
+func (e *FanEntry) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Timestamp Number `json:"timestamp"`
+		Rps0      Number `json:"rps_fan_pop_0"`
+		Rps1      Number `json:"rps_fan_pop_1"`
+		Rps2      Number `json:"rps_fan_pop_2"`
+		Rps3      Number `json:"rps_fan_pop_3"`
+		Control0  Number `json:"control_fan_pop_0"`
+		Control1  Number `json:"control_fan_pop_1"`
+		Control2  Number `json:"control_fan_pop_2"`
+		Control3  Number `json:"control_fan_pop_3"`
+	}
+
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	*e = FanEntry{
+		Timestamp: raw.Timestamp,
+		Rps:       [4]Number{raw.Rps0, raw.Rps1, raw.Rps2, raw.Rps3},
+		Control:   [4]Number{raw.Control0, raw.Control1, raw.Control2, raw.Control3},
+	}
+
+	return nil
+}
+
+// TempEntry is one temperature log entry, OPMS temperature_0..3 or IPMS sensoripmst0.
+type TempEntry struct {
+	Timestamp Number
+	Sensors   []Number
+}
+
+type opmsTempEntry struct {
+	Timestamp    Number `json:"timestamp"`
+	Temperature0 Number `json:"temperature_0"`
+	Temperature1 Number `json:"temperature_1"`
+	Temperature2 Number `json:"temperature_2"`
+	Temperature3 Number `json:"temperature_3"`
+}
+
+func decodeOpmsTemp(data []byte) (TempEntry, error) {
+	var raw opmsTempEntry
+
+	err := json.Unmarshal(data, &raw)
+
+	return TempEntry{raw.Timestamp, []Number{raw.Temperature0, raw.Temperature1, raw.Temperature2, raw.Temperature3}}, err
+}
+
+type ipmsSensorEntry struct {
+	Timestamp Number `json:"timestamp"`
+	Sensor0   Number `json:"sensoripmst0"`
+}
+
+func decodeIpmsSensor(data []byte) (TempEntry, error) {
+	var raw ipmsSensorEntry
+
+	err := json.Unmarshal(data, &raw)
+
+	return TempEntry{raw.Timestamp, []Number{raw.Sensor0}}, err
+}
+
+// AcEntry is one air conditioner log entry.
+type AcEntry struct {
+	Timestamp Number `json:"timestamp"`
+	ControlAc Number `json:"control_ac"`
+	CurrentAc Number `json:"current_ac"`
+}
+
+// decodeAcEntry rejects entries without a timestamp, the durations need one
+func decodeAcEntry(data []byte) (AcEntry, error) {
+	entry, err := unmarshalEntry[AcEntry](data)
+
+	if err == nil && !entry.Timestamp.Valid {
+		err = errMissingTimestamp
+	}
+
+	return entry, err
+}
+
+// timedEntry only reads the timestamp, for bucketing and the data quality
+type timedEntry struct {
+	Timestamp Number `json:"timestamp"`
+}
+
+func entryTimestamp(raw json.RawMessage) (int64, bool) {
+	var entry timedEntry
+
+	if err := json.Unmarshal(raw, &entry); err != nil {
+		return 0, false
+	}
+
+	return entry.Timestamp.seconds()
+}
+
+// envelopeValue walks a dotted path of a response, a missing key or null gives nil
+func envelopeValue(response json.RawMessage, path string) (json.RawMessage, error) {
+	current := response
+
+	for _, key := range strings.Split(path, ".") {
+		var object map[string]json.RawMessage
+
+		if err := json.Unmarshal(current, &object); err != nil {
+			return nil, fmt.Errorf("%s is not an object", path)
+		}
+
+		if current = object[key]; current == nil {
+			return nil, nil
+		}
+	}
+
+	if bytes.Equal(bytes.TrimSpace(current), []byte("null")) {
+		return nil, nil
+	}
+
+	return current, nil
+}
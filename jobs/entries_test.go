@@ -0,0 +1,153 @@
+package jobs
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func rawEntries(t testing.TB, entries []map[string]any) []json.RawMessage {
+	t.Helper()
+
+	raws := []json.RawMessage{}
+
+	for _, entry := range entries {
+		raw, err := json.Marshal(entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		raws = append(raws, raw)
+	}
+
+	return raws
+}
+
+// processPart feeds entries to a new aggregator of the processor
+func processPart(t testing.TB, processor Processor, entries []map[string]any) Part {
+	t.Helper()
+
+	aggregator := processor.NewAggregator()
+	for _, entry := range rawEntries(t, entries) {
+		aggregator.Add(entry)
+	}
+
+	part, _ := partOf(aggregator)
+
+	return part
+}
+
+func TestNumberIsLenient(t *testing.T) {
+	tests := map[string]Number{
+		`12.5`:     {12.5, true},
+		`"12.5"`:   {12.5, true},
+		`" -3 "`:   {-3, true},
+		`null`:     {},
+		`""`:       {},
+		`"1e400"`:  {},
+		`"abc"`:    {},
+		`true`:     {},
+		`{"a": 1}`: {},
+	}
+
+	for input, want := range tests {
+		var got Number
+		err := json.Unmarshal([]byte(input), &got)
+
+		if got != want {
+			t.Errorf("Number(%s) = %+v; want %+v", input, got, want)
+		}
+
+		if fails := !want.Valid && input != "null" && input != `""`; fails != (err != nil) {
+			t.Errorf("Number(%s) error = %v", input, err)
+		}
+	}
+}
+
+func TestProcessorsReportInvalidEntries(t *testing.T) {
+	processor, _ := GetProcessor("ac")
+
+	entries := []json.RawMessage{
+		json.RawMessage(`{"timestamp": 0, "control_ac": 1, "current_ac": "5.5"}`),
+		json.RawMessage(`{"timestamp": "oops", "control_ac": 1, "current_ac": 5}`),
+		json.RawMessage(`{"control_ac": 1, "current_ac": 5}`),
+		json.RawMessage(`{"timestamp": 60, "control_ac": null, "current_ac": 0}`),
+		json.RawMessage(`"not an entry"`),
+	}
+
+	metrics, err := processEntries(processor, entries)
+
+	validation, ok := err.(*ValidationError)
+	if !ok || validation.Invalid != 3 || validation.Total != 5 || !strings.Contains(err.Error(), "missing timestamp") {
+		t.Fatalf("err = %v; want 3 of 5 entries invalid", err)
+	}
+
+	if metrics["acDurationOnByCurrent"] != 1 || metrics["acDurationOnByControl"] != 1 {
+		t.Errorf("metrics = %v; want the minute between the two valid entries", metrics)
+	}
+}
+
+// FuzzDecodeEntries feeds arbitrary responses through the envelope and every processor,
+// none of them may panic.
+func FuzzDecodeEntries(f *testing.F) {
+	f.Add(`{"data": {"success": true, "data": [{"timestamp": 0, "temperature_0": 20}]}}`)
+	f.Add(`{"data": {"success": true, "data": [{"timestamp": "60", "rps_fan_pop_0": "40", "control_fan_pop_0": 100}, null, 3]}}`)
+	f.Add(`{"data": {"success": true, "data": [{"timestamp": 1e300, "current_ac": [], "control_ac": {}}]}}`)
+	f.Add(`{"data": {"success": true, "data": {"timestamp": 1}}}`)
+	f.Add(`{"data": null}`)
+
+	names := []string{"fan", "fan-health", "opms-temp", "ipms-temp", "ac"}
+
+	f.Fuzz(func(t *testing.T, body string) {
+		entries := []json.RawMessage{}
+
+		err := OPMS.streamEntries(strings.NewReader(body), func(entry json.RawMessage) {
+			entries = append(entries, entry)
+		})
+		if err != nil {
+			return
+		}
+
+		for _, name := range names {
+			processor, _ := GetProcessor(name)
+
+			aggregator := processor.NewAggregator()
+			for _, entry := range entries {
+				aggregator.Add(entry)
+			}
+
+			part, err := partOf(aggregator)
+			if err != nil {
+				if _, ok := err.(*ValidationError); !ok {
+					t.Errorf("%s returned %T, want a *ValidationError", name, err)
+				}
+			}
+
+			processor.Merge([]Part{part, part})
+		}
+
+		measureQuality(entries, 0, 3600, 60, []string{"timestamp"})
+	})
+}
+
+func FuzzNumber(f *testing.F) {
+	for _, seed := range []string{`1`, `"2.5"`, `null`, `""`, `"x"`, `-0`, `1e999`} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, input string) {
+		var n Number
+		if err := json.Unmarshal([]byte(input), &n); err != nil || !n.Valid {
+			return
+		}
+
+		data, err := json.Marshal(n)
+		if err != nil {
+			t.Fatalf("Marshal(%+v) error = %v", n, err)
+		}
+
+		var back Number
+		if err := json.Unmarshal(data, &back); err != nil || back != n {
+			t.Errorf("%s round trips to %+v; want %+v", input, back, n)
+		}
+	})
+}
@@ -0,0 +1,230 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"project/redact"
+	"project/utils"
+	"strings"
+	"time"
+)
+
+const (
+	ERR_CLASS_REQUEST    = "request"
+	ERR_CLASS_TIMEOUT    = "timeout"
+	ERR_CLASS_NETWORK    = "network"
+	ERR_CLASS_AUTH       = "auth"
+	ERR_CLASS_CLIENT     = "http_4xx"
+	ERR_CLASS_SERVER     = "http_5xx"
+	ERR_CLASS_DECODE     = "decode"
+	ERR_CLASS_VALIDATION = "validation" // not a single entry could be read
+	ERR_CLASS_API        = "api"
+	ERR_CLASS_CANCELED   = "canceled"
+)
+
+type Failure struct {
+	PiId       int    `json:"piId"`
+	POP        string `json:"pop"`
+	Endpoint   string `json:"endpoint"`
+	HTTPStatus int    `json:"httpStatus,omitempty"`
+	ErrorClass string `json:"errorClass"`
+	Attempts   int    `json:"attempts"`
+	Error      string `json:"error,omitempty"`
+}
+
+type FailureReport struct {
+	System      string    `json:"system"`
+	Mode        string    `json:"mode"`
+	StartTime   int64     `json:"startTime"`
+	EndTime     int64     `json:"endTime"`
+	OutputFile  string    `json:"outputFile"`
+	Bucketed    bool      `json:"bucketed,omitempty"`
+	GeneratedAt string    `json:"generatedAt"`
+	Total       int       `json:"total"`
+	Failures    []Failure `json:"failures"`
+}
+
+func classifyRequestError(err error) string {
+	var netErr net.Error
+
+	if errors.Is(err, utils.ErrLoginFailed) {
+		return ERR_CLASS_AUTH
+	}
+
+	if errors.Is(err, context.Canceled) {
+		return ERR_CLASS_CANCELED
+	}
+
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return ERR_CLASS_TIMEOUT
+	}
+
+	return ERR_CLASS_NETWORK
+}
+
+func classifyStatus(status int) string {
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return ERR_CLASS_AUTH
+	case status >= 500:
+		return ERR_CLASS_SERVER
+	default:
+		return ERR_CLASS_CLIENT
+	}
+}
+
+func newFailureReport(system string, mode string, startTime int64, endTime int64, outputFile string, results []ApiResponse) FailureReport {
+	report := FailureReport{
+		System:      system,
+		Mode:        mode,
+		StartTime:   startTime,
+		EndTime:     endTime,
+		OutputFile:  outputFile,
+		GeneratedAt: time.Now().Format(time.RFC3339),
+		Total:       len(results),
+		Failures:    []Failure{},
+	}
+
+	for _, result := range results {
+		if result.Status == "success" {
+			continue
+		}
+
+		report.Failures = append(report.Failures, Failure{
+			PiId:       result.PID,
+			POP:        result.POP,
+			Endpoint:   redact.String(result.URL),
+			HTTPStatus: result.HTTPStatus,
+			ErrorClass: result.ErrorClass,
+			Attempts:   result.Attempts,
+			Error:      redact.String(result.Error),
+		})
+	}
+
+	return report
+}
+
+// failureReportPath maps "ipms.csv" to "ipms.failures.json"
+func failureReportPath(outputFile string) string {
+	return strings.TrimSuffix(outputFile, filepath.Ext(outputFile)) + ".failures.json"
+}
+
+func writeFailureReport(report FailureReport) {
+	reportFile := failureReportPath(report.OutputFile)
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		fmt.Println("Error encoding failure report:", err)
+		return
+	}
+
+	if err := os.WriteFile(reportFile, data, 0644); err != nil {
+		fmt.Println("Error writing failure report:", err)
+		return
+	}
+
+	fmt.Printf("%d/%d failed, failure report has been written to %s\n", len(report.Failures), report.Total, reportFile)
+}
+
+func readFailureReport(reportFile string) (FailureReport, error) {
+	var report FailureReport
+
+	data, err := os.ReadFile(reportFile)
+	if err != nil {
+		return report, err
+	}
+
+	err = json.Unmarshal(data, &report)
+
+	return report, err
+}
+
+// mergeCsvRecords replaces the rows of existing that have the same PI ID as a fresh row
+// and appends the fresh rows that were not there before.
+func mergeCsvRecords(existing [][]string, fresh [][]string) [][]string {
+	rowByPiId := map[string]int{}
+
+	for i, row := range existing {
+		if i == 0 || len(row) == 0 {
+			continue
+		}
+		rowByPiId[row[0]] = i
+	}
+
+	for _, row := range fresh {
+		if i, ok := rowByPiId[row[0]]; ok {
+			existing[i] = row
+		} else {
+			existing = append(existing, row)
+		}
+	}
+
+	return existing
+}
+
+// RerunFailed refetches the pis listed in a failure report, merges the fresh rows into
+// the original output file and rewrites the report with whatever is still failing.
+func RerunFailed(reportFile string, rateLimit int, delaySeconds int) error {
+	report, err := readFailureReport(reportFile)
+	if err != nil {
+		return fmt.Errorf("reading failure report: %w", err)
+	}
+
+	if len(report.Failures) == 0 {
+		fmt.Println("Nothing to re-run, the report has no failures")
+		return nil
+	}
+
+	if report.Bucketed {
+		return fmt.Errorf("%s is the report of a bucketed run, run it again with --bucket instead", reportFile)
+	}
+
+	sys, ok := GetSystem(report.System)
+	if !ok {
+		return fmt.Errorf("unknown system %q in failure report", report.System)
+	}
+
+	previousAttempts := map[int]int{}
+	endpoints := []Endpoint{}
+
+	for _, failure := range report.Failures {
+		previousAttempts[failure.PiId] = failure.Attempts
+		endpoints = append(endpoints, Endpoint{piId: failure.PiId, endpoint: failure.Endpoint, pop: failure.POP, start: report.StartTime, end: report.EndTime})
+	}
+
+	fmt.Printf("Re-running %d failed pis from %s\n", len(endpoints), reportFile)
+
+	results := sys.fetchAll(context.Background(), endpoints, report.Mode, rateLimit, delaySeconds, Bucketing{})
+
+	for i := range results {
+		results[i].Attempts += previousAttempts[results[i].PID]
+	}
+
+	existing, err := readCsvRecords(report.OutputFile)
+	if err != nil {
+		return fmt.Errorf("reading original output: %w", err)
+	}
+
+	fresh := [][]string{}
+
+	for _, result := range results {
+		fresh = append(fresh, sys.csvRecord(result, report.Mode))
+	}
+
+	sys.writeCsvRecords(mergeCsvRecords(existing, fresh), report.OutputFile)
+
+	fmt.Printf("Results have been merged into %s\n", report.OutputFile)
+
+	rerunReport := newFailureReport(sys.Name, report.Mode, report.StartTime, report.EndTime, report.OutputFile, results)
+	rerunReport.Total = report.Total
+
+	writeFailureReport(rerunReport)
+
+	return nil
+}
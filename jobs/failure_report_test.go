@@ -0,0 +1,44 @@
+package jobs
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestMergeCsvRecordsUTF16(t *testing.T) {
+	outputFile := filepath.Join(t.TempDir(), "ipms.csv")
+
+	IPMS.writeCsvFile([]ApiResponse{
+		{PID: 1, POP: "HNI0001", Status: "success", ProcessedData: map[string]float64{"t1Min": 20, "t1Max": 30, "t1Avg": 25}},
+		{PID: 2, POP: "HNI0002", Status: "error", Error: "Bad Gateway"},
+	}, outputFile, "TEMP")
+
+	existing, err := readCsvRecords(outputFile)
+	if err != nil {
+		t.Fatalf("readCsvRecords() error = %v", err)
+	}
+
+	fresh := [][]string{
+		IPMS.csvRecord(ApiResponse{PID: 2, POP: "HNI0002", Status: "success", ProcessedData: map[string]float64{"t1Min": 21, "t1Max": 31, "t1Avg": 26}}, "TEMP"),
+	}
+
+	merged := mergeCsvRecords(existing, fresh)
+
+	if len(merged) != 3 {
+		t.Fatalf("len(merged) = %d; want 3", len(merged))
+	}
+
+	if merged[0][0] != "PI ID" {
+		t.Errorf("header = %v; want the BOM stripped", merged[0])
+	}
+
+	if merged[2][2] != "success" || merged[2][5] != "26.00" {
+		t.Errorf("merged[2] = %v; want the fresh success row", merged[2])
+	}
+}
+
+func TestFailureReportPath(t *testing.T) {
+	if got := failureReportPath("out/ipms.csv"); got != "out/ipms.failures.json" {
+		t.Errorf("failureReportPath() = %s; want out/ipms.failures.json", got)
+	}
+}
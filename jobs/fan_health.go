@@ -0,0 +1,479 @@
+package jobs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	FAN_CONTROL_STEP = 20  // control levels are rounded to 20, 40, ... 100
+	FAN_STALL_RPS    = 1.0 // below this a commanded fan is stalled
+	// A fan below this % of the fleet median at the same control level is flagged
+	FAN_LOW_FLEET_PCT = 60.0
+	// Runs kept in the history file and used for the trend
+	FAN_TREND_RUNS = 8
+	// A fan losing more than this % of RPS per run is degrading
+	FAN_DEGRADING_PCT = 2.0
+)
+
+var fanLevels = []int{20, 40, 60, 80, 100}
+
+// FleetProcessor is a Processor with a second pass over the whole fleet once every pi
+// has been processed. historyFile keeps whatever it needs from previous runs.
+type FleetProcessor interface {
+	Processor
+	Fleet(results []ApiResponse, historyFile string, endTime int64) error
+}
+
+// fanHealthProcessor reads the 4 OPMS fans into RPS averages per control level
+// (f1Rps20 ... f1Rps100), minutes stalled, then compares every fan with the fleet
+// and with its own previous runs.
+type fanHealthProcessor struct{}
+
+func fanKey(fan int, metric string) string {
+	return fmt.Sprintf("f%d%s", fan, metric)
+}
+
+func (fanHealthProcessor) Columns() []Column {
+	columns := []Column{}
+
+	for fan := 1; fan <= 4; fan++ {
+		for _, level := range fanLevels {
+			columns = append(columns, Column{fanKey(fan, fmt.Sprintf("Rps%d", level)), fmt.Sprintf("F%d RPS @%d%%", fan, level)})
+		}
+
+		columns = append(columns,
+			Column{fanKey(fan, "StalledMinutes"), fmt.Sprintf("F%d Stalled Minutes", fan)},
+			Column{fanKey(fan, "FleetPct"), fmt.Sprintf("F%d %% Of Fleet", fan)},
+			Column{fanKey(fan, "BelowFleet"), fmt.Sprintf("F%d Below Fleet", fan)},
+			Column{fanKey(fan, "TrendPct"), fmt.Sprintf("F%d Trend %% Per Run", fan)},
+			Column{fanKey(fan, "Degrading"), fmt.Sprintf("F%d Degrading", fan)},
+		)
+	}
+
+	return columns
+}
+
+func (fanHealthProcessor) Keys() []string {
+	return fanKeys()
+}
+
+func fanLevel(control float64) int {
+	return int(math.Round(control/FAN_CONTROL_STEP)) * FAN_CONTROL_STEP
+}
+
+func (fanHealthProcessor) NewAggregator() Aggregator {
+	var sums, counts [4]map[int]float64
+	var stalled [4]float64
+	var seen [4]bool
+
+	for i := range sums {
+		sums[i], counts[i] = map[int]float64{}, map[int]float64{}
+	}
+
+	// The previous timed entry, a stalled fan stays stalled until the next one
+	var previous FanEntry
+	hasPrevious := false
+	var first *float64
+
+	add := func(entry FanEntry) {
+		if entry.Timestamp.Valid && hasPrevious && entry.Timestamp.Value >= previous.Timestamp.Value {
+			for i, isStalled := range fanStalled(previous) {
+				if isStalled {
+					stalled[i] += math.Min(entry.Timestamp.Value-previous.Timestamp.Value, MAX_SAMPLE_SECONDS)
+				}
+			}
+		}
+
+		if entry.Timestamp.Valid && first == nil {
+			ts := entry.Timestamp.Value
+			first = &ts
+		}
+
+		for i := 0; i < 4; i++ {
+			rps, control := entry.Rps[i], entry.Control[i]
+
+			if !rps.Valid || !control.Valid || control.Value <= 0 {
+				continue
+			}
+
+			seen[i] = true
+
+			if level := fanLevel(control.Value); level > 0 {
+				sums[i][level] += rps.Value
+				counts[i][level]++
+			}
+		}
+
+		if entry.Timestamp.Valid && (!hasPrevious || entry.Timestamp.Value >= previous.Timestamp.Value) {
+			previous, hasPrevious = entry, true
+		}
+	}
+
+	result := func() map[string]float64 {
+		metrics := map[string]float64{}
+
+		for i := 0; i < 4; i++ {
+			fan := i + 1
+
+			if !seen[i] {
+				continue
+			}
+
+			for level, count := range counts[i] {
+				metrics[fanKey(fan, fmt.Sprintf("Rps%d", level))] = sums[i][level] / count
+				// Only needed to merge the averages
+				metrics[fanKey(fan, fmt.Sprintf("Count%d", level))] = count
+			}
+
+			metrics[fanKey(fan, "StalledMinutes")] = stalled[i] / 60
+		}
+
+		return metrics
+	}
+
+	partial := func() json.RawMessage {
+		state := fanHealthPartial{First: first}
+
+		if hasPrevious {
+			ts := previous.Timestamp.Value
+			state.Last, state.Stalled = &ts, fanStalled(previous)
+		}
+
+		data, _ := json.Marshal(state)
+		return data
+	}
+
+	return &typedAggregator[FanEntry]{decode: unmarshalEntry[FanEntry], add: add, result: result, partial: partial}
+}
+
+// fanStalled tells which fans of entry are commanded but below FAN_STALL_RPS
+func fanStalled(entry FanEntry) [4]bool {
+	var stalled [4]bool
+
+	for i := 0; i < 4; i++ {
+		rps, control := entry.Rps[i], entry.Control[i]
+		stalled[i] = rps.Valid && control.Valid && control.Value > 0 && rps.Value < FAN_STALL_RPS
+	}
+
+	return stalled
+}
+
+// fanHealthPartial is the first timestamp of a part and its last timed entry, whose
+// stalled fans stay stalled until the first timestamp of the next part.
+type fanHealthPartial struct {
+	First   *float64 `json:"first,omitempty"`
+	Last    *float64 `json:"last,omitempty"`
+	Stalled [4]bool  `json:"stalled"`
+}
+
+// fanHealthPartials reads the partial of every part, nil when a part has none
+func fanHealthPartials(parts []Part) []fanHealthPartial {
+	partials := []fanHealthPartial{}
+
+	for _, part := range parts {
+		var partial fanHealthPartial
+
+		if part.Partial == nil || json.Unmarshal(part.Partial, &partial) != nil {
+			return nil
+		}
+
+		partials = append(partials, partial)
+	}
+
+	return partials
+}
+
+// Merge pools the RPS and adds up the stalled minutes of the parts. With the partials
+// a fan stalled at the end of a part also counts until the first sample of the next.
+func (fanHealthProcessor) Merge(parts []Part) Part {
+	merged := poolFanHealth(parts)
+	partials := fanHealthPartials(parts)
+
+	if partials == nil {
+		return Part{Metrics: merged}
+	}
+
+	var joined fanHealthPartial
+	for _, partial := range partials {
+		if joined.Last != nil && partial.First != nil && *partial.First >= *joined.Last {
+			for i, isStalled := range joined.Stalled {
+				if isStalled {
+					merged[fanKey(i+1, "StalledMinutes")] += math.Min(*partial.First-*joined.Last, MAX_SAMPLE_SECONDS) / 60
+				}
+			}
+		}
+
+		if joined.First == nil {
+			joined.First = partial.First
+		}
+		if partial.Last != nil {
+			joined.Last, joined.Stalled = partial.Last, partial.Stalled
+		}
+	}
+
+	data, _ := json.Marshal(joined)
+	return Part{Metrics: merged, Partial: data}
+}
+
+// poolFanHealth pools the RPS per control level and adds up the stalled minutes of parts
+func poolFanHealth(parts []Part) map[string]float64 {
+	merged := map[string]float64{}
+
+	for fan := 1; fan <= 4; fan++ {
+		for _, level := range fanLevels {
+			rpsKey, countKey := fanKey(fan, fmt.Sprintf("Rps%d", level)), fanKey(fan, fmt.Sprintf("Count%d", level))
+
+			sum, count := 0.0, 0.0
+			for _, part := range parts {
+				sum += part.Metrics[rpsKey] * part.Metrics[countKey]
+				count += part.Metrics[countKey]
+			}
+
+			if count > 0 {
+				merged[rpsKey] = sum / count
+				merged[countKey] = count
+			}
+		}
+
+		for _, part := range parts {
+			if stalled, ok := part.Metrics[fanKey(fan, "StalledMinutes")]; ok {
+				merged[fanKey(fan, "StalledMinutes")] += stalled
+			}
+		}
+	}
+
+	return merged
+}
+
+// Rollup pools the RPS and stalled minutes of the pis, averages their fleet and
+// trend % and counts the fans below the fleet or degrading.
+func (fanHealthProcessor) Rollup(parts []Part) map[string]float64 {
+	merged := poolFanHealth(parts)
+
+	for fan := 1; fan <= 4; fan++ {
+		for key, value := range meanOf(partMetrics(parts), []Column{{Key: fanKey(fan, "FleetPct")}, {Key: fanKey(fan, "TrendPct")}}) {
+			merged[key] = value
+		}
+
+		for _, flag := range []string{"BelowFleet", "Degrading"} {
+			for _, part := range parts {
+				if value, ok := part.Metrics[fanKey(fan, flag)]; ok {
+					merged[fanKey(fan, flag)] += value
+				}
+			}
+		}
+	}
+
+	return merged
+}
+
+// Fleet adds how every fan compares with the fleet median at the same control levels,
+// then appends the run to the history file and adds the RPS trend of every fan.
+func (fanHealthProcessor) Fleet(results []ApiResponse, historyFile string, endTime int64) error {
+	medians := map[int]float64{}
+
+	for _, level := range fanLevels {
+		values := []float64{}
+
+		for _, result := range results {
+			for fan := 1; fan <= 4; fan++ {
+				if rps, ok := result.ProcessedData[fanKey(fan, fmt.Sprintf("Rps%d", level))]; ok {
+					values = append(values, rps)
+				}
+			}
+		}
+
+		if len(values) > 0 {
+			sort.Float64s(values)
+			medians[level] = percentile(values, 50)
+		}
+	}
+
+	for _, result := range results {
+		for fan := 1; fan <= 4; fan++ {
+			total, levels := 0.0, 0
+
+			for level, median := range medians {
+				if rps, ok := result.ProcessedData[fanKey(fan, fmt.Sprintf("Rps%d", level))]; ok && median > 0 {
+					total += rps / median * 100
+					levels++
+				}
+			}
+
+			if levels > 0 {
+				pct := total / float64(levels)
+
+				result.ProcessedData[fanKey(fan, "FleetPct")] = pct
+				result.ProcessedData[fanKey(fan, "BelowFleet")] = 0
+				if pct < FAN_LOW_FLEET_PCT {
+					result.ProcessedData[fanKey(fan, "BelowFleet")] = 1
+				}
+			}
+		}
+	}
+
+	history, err := readFanHistory(historyFile)
+	if err != nil {
+		return err
+	}
+
+	history = history.add(results, endTime)
+
+	for _, result := range results {
+		history.trend(result)
+	}
+
+	return writeFanHistory(historyFile, history)
+}
+
+// fanHistory holds the RPS averages per control level of the last FAN_TREND_RUNS runs
+type fanHistory struct {
+	Runs []fanHistoryRun `json:"runs"`
+}
+
+type fanHistoryRun struct {
+	EndTime int64 `json:"endTime"`
+	// pi id -> "f1Rps100" -> RPS
+	Rps map[string]map[string]float64 `json:"rps"`
+}
+
+// historyPath maps "opms.csv" to "opms.history.json"
+func historyPath(outputFile string) string {
+	return strings.TrimSuffix(outputFile, filepath.Ext(outputFile)) + ".history.json"
+}
+
+func readFanHistory(historyFile string) (fanHistory, error) {
+	var history fanHistory
+
+	data, err := os.ReadFile(historyFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return history, nil
+	}
+	if err != nil {
+		return history, err
+	}
+
+	if err := json.Unmarshal(data, &history); err != nil {
+		return history, fmt.Errorf("reading fan history %s: %w", historyFile, err)
+	}
+
+	return history, nil
+}
+
+func writeFanHistory(historyFile string, history fanHistory) error {
+	data, err := json.MarshalIndent(history, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(historyFile, data, 0644)
+}
+
+// add records this run, replacing a previous run of the same window
+func (history fanHistory) add(results []ApiResponse, endTime int64) fanHistory {
+	run := fanHistoryRun{EndTime: endTime, Rps: map[string]map[string]float64{}}
+
+	for _, result := range results {
+		if result.Status != "success" {
+			continue
+		}
+
+		rps := map[string]float64{}
+		for key, value := range result.ProcessedData {
+			if strings.Contains(key, "Rps") {
+				rps[key] = value
+			}
+		}
+
+		run.Rps[strconv.Itoa(result.PID)] = rps
+	}
+
+	runs := []fanHistoryRun{}
+	for _, previous := range history.Runs {
+		if previous.EndTime != endTime {
+			runs = append(runs, previous)
+		}
+	}
+
+	runs = append(runs, run)
+	sort.Slice(runs, func(i, j int) bool { return runs[i].EndTime < runs[j].EndTime })
+
+	if len(runs) > FAN_TREND_RUNS {
+		runs = runs[len(runs)-FAN_TREND_RUNS:]
+	}
+
+	return fanHistory{Runs: runs}
+}
+
+// trend fits a line through the RPS of every control level across the runs and adds
+// the mean slope as a % of the level's mean RPS per run.
+func (history fanHistory) trend(result ApiResponse) {
+	if result.Status != "success" {
+		return
+	}
+
+	piId := strconv.Itoa(result.PID)
+
+	for fan := 1; fan <= 4; fan++ {
+		total, levels := 0.0, 0
+
+		for _, level := range fanLevels {
+			key := fanKey(fan, fmt.Sprintf("Rps%d", level))
+			xs, ys := []float64{}, []float64{}
+
+			for i, run := range history.Runs {
+				if rps, ok := run.Rps[piId][key]; ok {
+					xs = append(xs, float64(i))
+					ys = append(ys, rps)
+				}
+			}
+
+			if slope, mean, ok := linearFit(xs, ys); ok && mean > 0 {
+				total += slope / mean * 100
+				levels++
+			}
+		}
+
+		if levels > 0 {
+			pct := total / float64(levels)
+
+			result.ProcessedData[fanKey(fan, "TrendPct")] = pct
+			result.ProcessedData[fanKey(fan, "Degrading")] = 0
+			if pct <= -FAN_DEGRADING_PCT {
+				result.ProcessedData[fanKey(fan, "Degrading")] = 1
+			}
+		}
+	}
+}
+
+// linearFit is the least squares slope of ys over xs and the mean of ys
+func linearFit(xs []float64, ys []float64) (float64, float64, bool) {
+	if len(xs) < 2 {
+		return 0, 0, false
+	}
+
+	n := float64(len(xs))
+	var sumX, sumY, sumXY, sumXX float64
+
+	for i := range xs {
+		sumX += xs[i]
+		sumY += ys[i]
+		sumXY += xs[i] * ys[i]
+		sumXX += xs[i] * xs[i]
+	}
+
+	denominator := n*sumXX - sumX*sumX
+	if denominator == 0 {
+		return 0, 0, false
+	}
+
+	return (n*sumXY - sumX*sumY) / denominator, sumY / n, true
+}
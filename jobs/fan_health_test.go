@@ -0,0 +1,91 @@
+package jobs
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func fanEntries(rps float64, control float64) []map[string]any {
+	entries := []map[string]any{}
+
+	for i := 0; i < 3; i++ {
+		entries = append(entries, map[string]any{"timestamp": float64(i * 60), "rps_fan_pop_0": rps, "control_fan_pop_0": control})
+	}
+
+	return entries
+}
+
+func TestFanHealthFleetAndTrend(t *testing.T) {
+	processor, _ := GetProcessor("fan-health")
+	fleet := processor.(FleetProcessor)
+
+	process := func(entries []map[string]any) map[string]float64 {
+		metrics, _ := processEntries(processor, rawEntries(t, entries))
+		return metrics
+	}
+
+	stalled := process(fanEntries(0, 60))
+	if stalled["f1StalledMinutes"] != 2 || stalled["f1Rps60"] != 0 {
+		t.Errorf("stalled fan = %v; want 2 stalled minutes at 60%%", stalled)
+	}
+
+	if _, ok := process(fanEntries(0, 0))["f1StalledMinutes"]; ok {
+		t.Error("a fan commanded off counts as stalled")
+	}
+
+	historyFile := filepath.Join(t.TempDir(), "opms.history.json")
+
+	// pi 3 loses 10% RPS per run while the rest of the fleet holds 50
+	for run, rps := range []float64{50, 45, 40} {
+		results := []ApiResponse{
+			{PID: 1, Status: "success", ProcessedData: process(fanEntries(50, 100))},
+			{PID: 2, Status: "success", ProcessedData: process(fanEntries(52, 100))},
+			{PID: 3, Status: "success", ProcessedData: process(fanEntries(rps, 100))},
+			{PID: 4, Status: "error"},
+		}
+
+		if err := fleet.Fleet(results, historyFile, int64(run)); err != nil {
+			t.Fatal(err)
+		}
+
+		if run < 2 {
+			continue
+		}
+
+		if got := results[2].ProcessedData; got["f1FleetPct"] != 80 || got["f1BelowFleet"] != 0 || got["f1Degrading"] != 1 {
+			t.Errorf("pi 3 = %v; want 80%% of the fleet and degrading", got)
+		}
+
+		if got := results[0].ProcessedData; got["f1TrendPct"] != 0 || got["f1Degrading"] != 0 {
+			t.Errorf("pi 1 = %v; want a flat trend", got)
+		}
+	}
+
+	history, _ := readFanHistory(historyFile)
+	if len(history.Runs) != 3 {
+		t.Errorf("history has %d runs; want 3", len(history.Runs))
+	}
+}
+
+func TestFanHealthMergeCountsStallsAcrossParts(t *testing.T) {
+	entries := []map[string]any{}
+	for i := 0; i < 10; i++ {
+		entries = append(entries, map[string]any{"timestamp": float64(i * 60), "rps_fan_pop_0": 0.0, "control_fan_pop_0": 60.0, "rps_fan_pop_1": 40.0, "control_fan_pop_1": 60.0})
+	}
+
+	processor := fanHealthProcessor{}
+	whole := processPart(t, processor, entries)
+
+	// An empty part in the middle, the stall goes on from the first part to the third
+	parts := []Part{processPart(t, processor, entries[:4]), processPart(t, processor, nil), processPart(t, processor, entries[4:])}
+	merged := processor.Merge(parts)
+
+	if whole.Metrics["f1StalledMinutes"] != 9 || merged.Metrics["f1StalledMinutes"] != 9 || merged.Metrics["f2StalledMinutes"] != 0 {
+		t.Errorf("merged %v, whole %v; want 9 stalled minutes of f1 in both", merged.Metrics, whole.Metrics)
+	}
+
+	// Merged again, the parts keep their ends
+	if got := processor.Merge([]Part{merged, processPart(t, processor, []map[string]any{{"timestamp": 600.0, "rps_fan_pop_0": 30.0, "control_fan_pop_0": 60.0}})}); got.Metrics["f1StalledMinutes"] != 10 {
+		t.Errorf("f1StalledMinutes = %v; want 10 with the next minute", got.Metrics["f1StalledMinutes"])
+	}
+}
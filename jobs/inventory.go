@@ -0,0 +1,60 @@
+package jobs
+
+import (
+	"database/sql"
+	"fmt"
+	"project/database"
+	"project/models"
+	"project/redact"
+	"time"
+)
+
+// inventoryPis keeps what the inventory tracks of every pi, the broker URL without
+// its credentials
+func inventoryPis(system string, pis []Pi) []models.InventoryPi {
+	inventory := []models.InventoryPi{}
+
+	for _, pi := range pis {
+		inventory = append(inventory, models.InventoryPi{
+			System:      system,
+			PiId:        pi.Id,
+			Name:        pi.Name,
+			Ip:          pi.Ip,
+			Address:     pi.Address,
+			BackendPort: pi.BackendPort,
+			BrokerUrl:   redact.URL(pi.BrokerUrl),
+			Role:        pi.Role,
+		})
+	}
+
+	return inventory
+}
+
+// SyncInventory saves the whole pi list of sys in the inventory and returns the changes
+// since the last sync. A list removing most pis is refused unless forced, see
+// database.SyncInventory.
+func SyncInventory(db *sql.DB, sys *System, force bool) ([]models.InventoryChange, error) {
+	pis, err := sys.fetchPiList("")
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Printf("Fetched %d %s pis\n", len(pis), sys.Name)
+
+	return database.SyncInventory(db, sys.Name, inventoryPis(sys.Name, pis), time.Now(), force)
+}
+
+func InventoryChangeRecords(changes []models.InventoryChange) [][]string {
+	records := [][]string{{"System", "PI ID", "Change", "Before", "After"}}
+
+	for _, change := range changes {
+		records = append(records, []string{change.System, fmt.Sprintf("%d", change.PiId), change.Kind, change.Before, change.After})
+	}
+
+	return records
+}
+
+// WriteInventoryChanges writes the changes of a sync as a UTF-8 CSV.
+func WriteInventoryChanges(changes []models.InventoryChange, outputFile string) {
+	writeCsvRecords(InventoryChangeRecords(changes), outputFile, CSV_ENCODING_UTF8)
+}
@@ -0,0 +1,442 @@
+package jobs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"project/database"
+	"project/models"
+	"project/redact"
+	"project/utils"
+	"sync"
+	"time"
+)
+
+const (
+	JOB_QUEUED    = models.JOB_QUEUED
+	JOB_RUNNING   = models.JOB_RUNNING
+	JOB_MERGING   = models.JOB_MERGING // durable queue only
+	JOB_SUCCEEDED = models.JOB_SUCCEEDED
+	JOB_FAILED    = models.JOB_FAILED
+	JOB_CANCELED  = models.JOB_CANCELED
+
+	JOB_SINK_FILE     = "file"
+	JOB_SINK_POSTGRES = "postgres" // the file and the pi_metrics table
+
+	JOB_RESULT_CSV  = "csv"
+	JOB_RESULT_JSON = "json"
+	JOB_RESULT_XLSX = "xlsx"
+
+	// Pi failures listed on a job, the failure report next to the output has them all
+	JOB_ERRORS_MAX = 10
+	// How long finished jobs stay in memory, their files stay on disk
+	JOB_RETENTION_DEFAULT = 24 * time.Hour
+)
+
+var (
+	ErrJobNotFound    = errors.New("job not found")
+	ErrJobFinished    = errors.New("job already finished")
+	ErrJobNotFinished = errors.New("job has no result yet")
+)
+
+// JobSpec is what POST /jobs asks to crawl. Zero rate limit and delay use the run defaults.
+type JobSpec struct {
+	System       string    `json:"system"`
+	Mode         string    `json:"mode"`
+	From         string    `json:"from"` // RFC3339
+	To           string    `json:"to"`
+	Selection    Selection `json:"selection"`
+	Bucket       string    `json:"bucket,omitempty"`
+	SeriesFormat string    `json:"seriesFormat,omitempty"`
+	Sink         string    `json:"sink,omitempty"`
+	RateLimit    int       `json:"rateLimit,omitempty"`
+	DelaySeconds int       `json:"delaySeconds,omitempty"`
+	// Seconds of the units of the durable queue, 0 for one unit per pi
+	UnitSeconds int64 `json:"unitSeconds,omitempty"`
+
+	sys                *System
+	startTime, endTime int64
+	bucketing          Bucketing
+}
+
+// validate fills the defaults and parses the spec, a crawl is never queued for a bad one
+func (spec *JobSpec) validate() error {
+	sys, ok := GetSystem(spec.System)
+	if !ok {
+		return fmt.Errorf("unknown system %q", spec.System)
+	}
+
+	if _, err := sys.processor(spec.Mode); err != nil {
+		return err
+	}
+
+	startTime, endTime := utils.ISOToUnix(spec.From), utils.ISOToUnix(spec.To)
+	if startTime == -1 || endTime == -1 || endTime <= startTime {
+		return fmt.Errorf("from and to must be RFC3339 times with from before to")
+	}
+
+	bucketing, err := ParseBucketing(spec.Bucket)
+	if err != nil {
+		return err
+	}
+
+	if spec.SeriesFormat == "" {
+		spec.SeriesFormat = SERIES_FORMAT_LONG
+	}
+	if spec.SeriesFormat != SERIES_FORMAT_LONG && spec.SeriesFormat != SERIES_FORMAT_WIDE {
+		return fmt.Errorf("seriesFormat must be long or wide")
+	}
+
+	if spec.Sink == "" {
+		spec.Sink = JOB_SINK_FILE
+	}
+	if spec.Sink != JOB_SINK_FILE && spec.Sink != JOB_SINK_POSTGRES {
+		return fmt.Errorf("sink must be file or postgres")
+	}
+
+	if spec.RateLimit == 0 {
+		spec.RateLimit = 50
+	}
+	if spec.DelaySeconds == 0 {
+		spec.DelaySeconds = 25
+	}
+	if spec.RateLimit < 1 || spec.DelaySeconds < 0 || spec.UnitSeconds < 0 {
+		return fmt.Errorf("rateLimit must be at least 1, delaySeconds and unitSeconds not negative")
+	}
+
+	spec.sys, spec.startTime, spec.endTime, spec.bucketing = sys, startTime, endTime, bucketing
+
+	return nil
+}
+
+// manifest starts the run manifest of the job with that id, see NewRunManifest.
+func (spec JobSpec) manifest(id string, outputFile string) *RunManifest {
+	manifest := newRunManifest(id, spec.sys, spec.Mode, spec.startTime, spec.endTime, spec.Selection, spec.RateLimit, spec.DelaySeconds, outputFile)
+	manifest.Sink = spec.Sink
+
+	if spec.bucketing.Enabled() {
+		manifest.Bucket, manifest.SeriesFormat = spec.bucketing.String(), spec.SeriesFormat
+	}
+
+	return manifest
+}
+
+// JobRunner runs the crawls of the /jobs API, JobManager in memory or JobQueue in Postgres.
+type JobRunner interface {
+	Submit(spec JobSpec) (Job, error)
+	Get(id string) (Job, error)
+	Cancel(id string) (Job, error)
+	WriteResult(id string, format string, w io.Writer) error
+	Events(id string, from int) ([]Event, <-chan struct{}, bool, error)
+}
+
+// Job is the state of a crawl started through the API.
+type Job struct {
+	Id         string     `json:"id"`
+	Spec       JobSpec    `json:"spec"`
+	Status     string     `json:"status"`
+	Error      string     `json:"error,omitempty"`
+	Total      int        `json:"total"`
+	Done       int        `json:"done"`
+	Failed     int        `json:"failed"`
+	Errors     []string   `json:"errors,omitempty"`
+	OutputFile string     `json:"outputFile,omitempty"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	StartedAt  *time.Time `json:"startedAt,omitempty"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+}
+
+func (job Job) finished() bool {
+	return job.Status == JOB_SUCCEEDED || job.Status == JOB_FAILED || job.Status == JOB_CANCELED
+}
+
+type jobState struct {
+	job      Job
+	ctx      context.Context
+	cancel   context.CancelFunc
+	progress *Progress
+	results  []ApiResponse
+}
+
+// JobManager runs the submitted jobs one at a time, the thresholds being process wide.
+// Jobs are kept in memory for retention once finished and their files under dir/<id>.
+type JobManager struct {
+	dir       string
+	retention time.Duration
+	mu        sync.Mutex
+	jobs      map[string]*jobState
+	queue     chan *jobState
+}
+
+func NewJobManager(dir string, retention time.Duration) *JobManager {
+	m := &JobManager{dir: dir, retention: retention, jobs: map[string]*jobState{}, queue: make(chan *jobState, 1024)}
+
+	go m.work()
+
+	return m
+}
+
+func newJobId() (string, error) {
+	id := make([]byte, 8)
+
+	if _, err := rand.Read(id); err != nil {
+		return "", fmt.Errorf("generating a job id: %w", err)
+	}
+
+	return hex.EncodeToString(id), nil
+}
+
+// Submit validates spec and queues its crawl.
+func (m *JobManager) Submit(spec JobSpec) (Job, error) {
+	if err := spec.validate(); err != nil {
+		return Job{}, err
+	}
+
+	id, err := newJobId()
+	if err != nil {
+		return Job{}, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	state := &jobState{
+		job:      Job{Id: id, Spec: spec, Status: JOB_QUEUED, CreatedAt: time.Now()},
+		ctx:      ctx,
+		cancel:   cancel,
+		progress: &Progress{},
+	}
+
+	m.mu.Lock()
+	m.evict(state.job.CreatedAt)
+	m.jobs[state.job.Id] = state
+	m.mu.Unlock()
+
+	select {
+	case m.queue <- state:
+	default:
+		cancel()
+		m.finish(state, JOB_FAILED, fmt.Errorf("too many queued jobs"))
+	}
+
+	return m.Get(state.job.Id)
+}
+
+// evict forgets the jobs finished for longer than the retention, m.mu being held
+func (m *JobManager) evict(now time.Time) {
+	for id, state := range m.jobs {
+		if state.job.finished() && now.Sub(*state.job.FinishedAt) > m.retention {
+			delete(m.jobs, id)
+		}
+	}
+}
+
+// Get returns a copy of the job with its current progress.
+func (m *JobManager) Get(id string) (Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	state, ok := m.jobs[id]
+	if !ok {
+		return Job{}, ErrJobNotFound
+	}
+
+	job := state.job
+	job.Total, job.Done, job.Failed = state.progress.Counts()
+	job.Errors = append([]string(nil), state.job.Errors...)
+
+	return job, nil
+}
+
+// Cancel stops a queued or running job, the pis already fetched are kept.
+func (m *JobManager) Cancel(id string) (Job, error) {
+	m.mu.Lock()
+	state, ok := m.jobs[id]
+	if !ok {
+		m.mu.Unlock()
+		return Job{}, ErrJobNotFound
+	}
+
+	if state.job.finished() {
+		m.mu.Unlock()
+		return Job{}, ErrJobFinished
+	}
+
+	// A running job finishes once its requests in flight are back
+	if state.job.Status == JOB_QUEUED {
+		state.setFinished(JOB_CANCELED, nil)
+	}
+	m.mu.Unlock()
+
+	state.cancel()
+
+	return m.Get(id)
+}
+
+func (m *JobManager) work() {
+	for state := range m.queue {
+		m.mu.Lock()
+		if state.job.finished() {
+			m.mu.Unlock()
+			continue
+		}
+
+		started := time.Now()
+		state.job.Status, state.job.StartedAt = JOB_RUNNING, &started
+		m.mu.Unlock()
+
+		results, err := m.run(state)
+
+		m.mu.Lock()
+		state.results = results
+		m.mu.Unlock()
+
+		switch {
+		case err != nil:
+			m.finish(state, JOB_FAILED, err)
+		case state.ctx.Err() != nil:
+			m.finish(state, JOB_CANCELED, nil)
+		default:
+			m.finish(state, JOB_SUCCEEDED, nil)
+		}
+	}
+}
+
+func (m *JobManager) run(state *jobState) ([]ApiResponse, error) {
+	spec := state.job.Spec
+	dir := filepath.Join(m.dir, state.job.Id)
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	outputFile := filepath.Join(dir, spec.sys.Name+".csv")
+
+	m.mu.Lock()
+	state.job.OutputFile = outputFile
+	m.mu.Unlock()
+
+	ctx := WithProgress(state.ctx, state.progress)
+	manifest := spec.manifest(state.job.Id, outputFile)
+
+	var results []ApiResponse
+
+	if spec.bucketing.Enabled() {
+		results = RunBucketedPipeline(ctx, spec.sys, spec.Selection, spec.startTime, spec.endTime, spec.RateLimit, spec.DelaySeconds, outputFile, spec.Mode, spec.bucketing, spec.SeriesFormat)
+	} else {
+		results = RunPipeline(ctx, spec.sys, spec.Selection, spec.startTime, spec.endTime, spec.RateLimit, spec.DelaySeconds, outputFile, spec.Mode)
+	}
+
+	manifest.Finish(results)
+
+	errs := []string{}
+	for _, result := range results {
+		if result.Status != "success" && len(errs) < JOB_ERRORS_MAX {
+			errs = append(errs, redact.String(fmt.Sprintf("pi %d: %s", result.PID, result.Error)))
+		}
+	}
+
+	m.mu.Lock()
+	state.job.Errors = errs
+	m.mu.Unlock()
+
+	if spec.Sink != JOB_SINK_POSTGRES {
+		return results, nil
+	}
+
+	db, err := database.Open()
+	if err != nil {
+		return results, fmt.Errorf("database is not reachable: %w", err)
+	}
+	defer db.Close()
+
+	return results, StoreResults(db, spec.sys, spec.Mode, spec.startTime, spec.endTime, spec.bucketing, results)
+}
+
+func (m *JobManager) finish(state *jobState, status string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	state.setFinished(status, err)
+}
+
+func (state *jobState) setFinished(status string, err error) {
+	finished := time.Now()
+	state.job.Status, state.job.FinishedAt = status, &finished
+
+	if err != nil {
+		state.job.Error = redact.String(err.Error())
+	}
+
+	state.progress.complete(status, state.job.Error)
+}
+
+// Events returns the events of a job from index on, see Progress.Events.
+func (m *JobManager) Events(id string, from int) ([]Event, <-chan struct{}, bool, error) {
+	m.mu.Lock()
+	state, ok := m.jobs[id]
+	m.mu.Unlock()
+
+	if !ok {
+		return nil, nil, false, ErrJobNotFound
+	}
+
+	events, wake, completed := state.progress.Events(from)
+
+	return events, wake, completed, nil
+}
+
+// WriteResult writes the metrics of a finished job as CSV, JSON or XLSX. A job canceled
+// before it started has an empty result.
+func (m *JobManager) WriteResult(id string, format string, w io.Writer) error {
+	m.mu.Lock()
+	state, ok := m.jobs[id]
+	if !ok {
+		m.mu.Unlock()
+		return ErrJobNotFound
+	}
+
+	job, results := state.job, state.results
+	m.mu.Unlock()
+
+	if !job.finished() {
+		return ErrJobNotFinished
+	}
+
+	return writeJobResult(w, format, job.Spec, results)
+}
+
+func writeJobResult(w io.Writer, format string, spec JobSpec, results []ApiResponse) error {
+	if format == JOB_RESULT_JSON {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(publishedResults(results))
+	}
+
+	records := [][]string{spec.sys.csvHeader(spec.Mode)}
+
+	if spec.bucketing.Enabled() {
+		records = spec.sys.seriesRecords(results, spec.Mode, spec.SeriesFormat, spec.bucketing)
+	} else {
+		for _, result := range results {
+			records = append(records, spec.sys.csvRecord(result, spec.Mode))
+		}
+	}
+
+	switch format {
+	case JOB_RESULT_CSV:
+		writer := csv.NewWriter(w)
+		writer.WriteAll(records)
+		return writer.Error()
+	case JOB_RESULT_XLSX:
+		return writeXlsx(w, records)
+	default:
+		return fmt.Errorf("unknown result format %q, expected csv, json or xlsx", format)
+	}
+}
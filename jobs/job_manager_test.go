@@ -0,0 +1,176 @@
+package jobs
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func waitForJob(t *testing.T, m *JobManager, id string, done func(Job) bool) Job {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+
+	for {
+		job, err := m.Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if done(job) {
+			return job
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("job = %+v; timed out", job)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestJobManager(t *testing.T) {
+	// Pi 1 answers right away, pi 2 only once its request is canceled
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/pis":
+			w.Write([]byte(`{"data": [{"id": 1, "name": "HNI0001"}, {"id": 2, "name": "HNI0002"}]}`))
+		case strings.HasPrefix(r.URL.Path, "/logs/2"):
+			<-r.Context().Done()
+		default:
+			fmt.Fprint(w, `{"data": {"success": true, "data": [{"timestamp": 60, "temperature_0": 21}, {"timestamp": 120, "temperature_0": 23}]}}`)
+		}
+	}))
+	defer server.Close()
+
+	RegisterSystem(&System{
+		Name:        "jobtest",
+		BaseURL:     server.URL,
+		PiListRoute: "/pis?folderId=%s",
+		LogRoutes:   map[string]string{"TEMP": "/logs/%d?from=%d&to=%d"},
+		Processors:  map[string]string{"TEMP": "opms-temp"},
+		Envelope:    Envelope{EntriesPath: "data.data", SuccessPath: "data.success"},
+	})
+
+	m := NewJobManager(t.TempDir(), JOB_RETENTION_DEFAULT)
+
+	spec := JobSpec{System: "jobtest", Mode: "TEMP", From: "1970-01-01T00:00:00Z", To: "1970-01-01T01:00:00Z", Selection: Selection{PiIds: []int{1}}}
+
+	if _, err := m.Submit(JobSpec{System: "jobtest", Mode: "FAN", From: spec.From, To: spec.To}); err == nil {
+		t.Error("a mode the system does not have was accepted")
+	}
+
+	job, err := m.Submit(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	job = waitForJob(t, m, job.Id, Job.finished)
+
+	if job.Status != JOB_SUCCEEDED || job.Total != 1 || job.Done != 1 || job.Failed != 0 || job.Spec.RateLimit != 50 {
+		t.Errorf("job = %+v; want one pi done", job)
+	}
+
+	events, _, completed, err := m.Events(job.Id, 0)
+	if err != nil || !completed || len(events) != 2 {
+		t.Fatalf("events = %+v (%v); want the pi and the completion", events, err)
+	}
+
+	if pi, done := events[0], events[1]; pi.Type != EVENT_PI || pi.PiId != 1 || pi.Done != 1 || done.Type != EVENT_COMPLETE || done.Status != JOB_SUCCEEDED {
+		t.Errorf("events = %+v", events)
+	}
+
+	var csvResult, jsonResult, xlsxResult bytes.Buffer
+
+	for format, w := range map[string]io.Writer{JOB_RESULT_CSV: &csvResult, JOB_RESULT_JSON: &jsonResult, JOB_RESULT_XLSX: &xlsxResult} {
+		if err := m.WriteResult(job.Id, format, w); err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+	}
+
+	if lines := strings.Split(strings.TrimSpace(csvResult.String()), "\n"); len(lines) != 2 || !strings.HasPrefix(lines[1], "1,") {
+		t.Errorf("csv = %q; want the header and pi 1", csvResult.String())
+	}
+
+	var results []ApiResponse
+	if err := json.Unmarshal(jsonResult.Bytes(), &results); err != nil || len(results) != 1 || results[0].ProcessedData["t1Max"] != 23 {
+		t.Errorf("json = %s (%v)", jsonResult.String(), err)
+	}
+
+	archive, err := zip.NewReader(bytes.NewReader(xlsxResult.Bytes()), int64(xlsxResult.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, file := range archive.File {
+		if file.Name != "xl/worksheets/sheet1.xml" {
+			continue
+		}
+
+		reader, _ := file.Open()
+		sheet, _ := io.ReadAll(reader)
+
+		if !strings.Contains(string(sheet), `<t xml:space="preserve">PI ID</t>`) || !strings.Contains(string(sheet), `<c t="n"><v>23.00</v></c>`) {
+			t.Errorf("sheet = %s", sheet)
+		}
+	}
+
+	// Cancel a job stuck on pi 2
+	spec.Selection = Selection{PiIds: []int{2}}
+
+	job, err = m.Submit(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitForJob(t, m, job.Id, func(job Job) bool { return job.Status == JOB_RUNNING && job.Total == 1 })
+
+	if err := m.WriteResult(job.Id, JOB_RESULT_CSV, io.Discard); err != ErrJobNotFinished {
+		t.Errorf("result of a running job: %v", err)
+	}
+
+	// A job canceled while queued behind it has an empty result
+	queued, err := m.Submit(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if queued, _ = m.Cancel(queued.Id); queued.Status != JOB_CANCELED {
+		t.Errorf("queued job = %+v; want canceled", queued)
+	}
+
+	var empty bytes.Buffer
+	if err := m.WriteResult(queued.Id, JOB_RESULT_JSON, &empty); err != nil || strings.TrimSpace(empty.String()) != "[]" {
+		t.Errorf("result of a job canceled while queued = %q (%v); want []", empty.String(), err)
+	}
+
+	if _, err := m.Cancel(job.Id); err != nil {
+		t.Fatal(err)
+	}
+
+	job = waitForJob(t, m, job.Id, Job.finished)
+
+	if job.Status != JOB_CANCELED || job.Failed != 1 || len(job.Errors) != 1 {
+		t.Errorf("job = %+v; want canceled with pi 2 failed", job)
+	}
+
+	if _, err := m.Cancel(job.Id); err != ErrJobFinished {
+		t.Errorf("second cancel: %v", err)
+	}
+
+	// Finished jobs are forgotten after the retention
+	m.mu.Lock()
+	m.evict(time.Now().Add(2 * JOB_RETENTION_DEFAULT))
+	m.mu.Unlock()
+
+	if _, err := m.Get(job.Id); err != ErrJobNotFound {
+		t.Errorf("job past the retention: %v", err)
+	}
+}
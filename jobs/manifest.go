@@ -0,0 +1,373 @@
+package jobs
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"project/database"
+	"project/models"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RunManifest records what produced the outputs of a run, written next to them as
+// <base>.manifest.json and to the pipeline_runs table. Args re-runs it.
+type RunManifest struct {
+	Id           string      `json:"id"`
+	System       string      `json:"system"`
+	Mode         string      `json:"mode"`
+	From         string      `json:"from"`
+	To           string      `json:"to"`
+	Selection    Selection   `json:"selection"`
+	RateLimit    int         `json:"rateLimit"`
+	DelaySeconds int         `json:"delaySeconds"`
+	Bucket       string      `json:"bucket,omitempty"`
+	SeriesFormat string      `json:"seriesFormat,omitempty"`
+	Rollups      []string    `json:"rollups,omitempty"`
+	Sink         string      `json:"sink,omitempty"`
+	Thresholds   Thresholds  `json:"thresholds"`
+	ToolVersion  string      `json:"toolVersion"`
+	StartedAt    time.Time   `json:"startedAt"`
+	FinishedAt   time.Time   `json:"finishedAt"`
+	Pis          int         `json:"pis"`
+	Succeeded    int         `json:"succeeded"`
+	Failed       int         `json:"failed"`
+	PiIds        []int       `json:"piIds,omitempty"` // what the selection resolved to
+	OutputFile   string      `json:"outputFile"`
+	Outputs      []RunOutput `json:"outputs"`
+}
+
+// Thresholds are the process wide settings a run's metrics depend on.
+type Thresholds struct {
+	TempWarning         float64 `json:"tempWarning"`
+	TempCritical        float64 `json:"tempCritical"`
+	AcCurrentOn         float64 `json:"acCurrentOn"`
+	AcShortCycleMinutes float64 `json:"acShortCycleMinutes"`
+	AcShortCyclesPerDay float64 `json:"acShortCyclesPerDay,omitempty"`
+	GapMinutes          float64 `json:"gapMinutes"`
+	WindowMaxEntries    int     `json:"windowMaxEntries"`
+}
+
+func currentThresholds() Thresholds {
+	return Thresholds{tempWarning, tempCritical, acCurrentOn, acShortCycleMinutes, acShortCyclesPerDay, qualityGapMinutes, windowMaxEntries}
+}
+
+// RunOutput is one file a run wrote and its SHA-256 when it was done.
+type RunOutput struct {
+	Path   string `json:"path"`
+	Bytes  int64  `json:"bytes"`
+	Sha256 string `json:"sha256"`
+}
+
+// toolVersion is the module version and VCS revision the binary was built from
+func toolVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+
+	version := info.Main.Version
+
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			version += " " + setting.Value
+		case "vcs.modified":
+			if setting.Value == "true" {
+				version += "+dirty"
+			}
+		}
+	}
+
+	return version
+}
+
+// NewRunManifest starts the manifest of a run about to start, with the thresholds set now.
+func NewRunManifest(sys *System, mode string, startTime int64, endTime int64, sel Selection, rateLimit int, delaySeconds int, outputFile string) (*RunManifest, error) {
+	id, err := newJobId()
+	if err != nil {
+		return nil, err
+	}
+
+	return newRunManifest(id, sys, mode, startTime, endTime, sel, rateLimit, delaySeconds, outputFile), nil
+}
+
+// newRunManifest is NewRunManifest for a run that already has an id
+func newRunManifest(id string, sys *System, mode string, startTime int64, endTime int64, sel Selection, rateLimit int, delaySeconds int, outputFile string) *RunManifest {
+	return &RunManifest{
+		Id:           id,
+		System:       sys.Name,
+		Mode:         mode,
+		From:         time.Unix(startTime, 0).UTC().Format(time.RFC3339),
+		To:           time.Unix(endTime, 0).UTC().Format(time.RFC3339),
+		Selection:    sel,
+		RateLimit:    rateLimit,
+		DelaySeconds: delaySeconds,
+		Thresholds:   currentThresholds(),
+		ToolVersion:  toolVersion(),
+		StartedAt:    time.Now(),
+		Sink:         JOB_SINK_FILE,
+		OutputFile:   outputFile,
+	}
+}
+
+// RerunPath maps "ipms.csv" to "ipms.rerun-20240102-150405.csv", the outputs of the run
+// being rerun stay as they were audited
+func RerunPath(outputFile string, now time.Time) string {
+	ext := filepath.Ext(outputFile)
+
+	return strings.TrimSuffix(outputFile, ext) + ".rerun-" + now.Format("20060102-150405") + ext
+}
+
+// manifestPath maps "ipms.csv" to "ipms.manifest.json"
+func manifestPath(outputFile string) string {
+	return strings.TrimSuffix(outputFile, filepath.Ext(outputFile)) + ".manifest.json"
+}
+
+// runOutputPaths are the files a run may write next to outputFile
+func (m *RunManifest) runOutputPaths() []string {
+	paths := []string{
+		m.OutputFile,
+		qualityReportPath(m.OutputFile),
+		schemaPath(m.OutputFile),
+		failureReportPath(m.OutputFile),
+		historyPath(m.OutputFile),
+	}
+
+	for _, level := range m.Rollups {
+		paths = append(paths, rollupPath(m.OutputFile, level))
+	}
+
+	return paths
+}
+
+func checksumFile(path string) (RunOutput, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return RunOutput{}, err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+
+	bytes, err := io.Copy(hash, file)
+	if err != nil {
+		return RunOutput{}, err
+	}
+
+	return RunOutput{Path: path, Bytes: bytes, Sha256: hex.EncodeToString(hash.Sum(nil))}, nil
+}
+
+// Finish counts the results, checksums the outputs and writes the manifest next to
+// them. When Postgres is configured the run is recorded in pipeline_runs too.
+func (m *RunManifest) Finish(results []ApiResponse) {
+	m.FinishedAt = time.Now()
+	m.Pis, m.Succeeded, m.Failed, m.PiIds = len(results), 0, 0, []int{}
+
+	for _, result := range results {
+		m.PiIds = append(m.PiIds, result.PID)
+
+		if result.Status == "success" {
+			m.Succeeded++
+		} else {
+			m.Failed++
+		}
+	}
+	sort.Ints(m.PiIds)
+
+	m.Outputs = []RunOutput{}
+
+	for _, path := range m.runOutputPaths() {
+		output, err := checksumFile(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			fmt.Println("⚠️ Checksum failed:", err)
+			continue
+		}
+
+		m.Outputs = append(m.Outputs, output)
+	}
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		fmt.Println("Error encoding run manifest:", err)
+		return
+	}
+
+	manifestFile := manifestPath(m.OutputFile)
+
+	if err := os.WriteFile(manifestFile, data, 0644); err != nil {
+		fmt.Println("Error writing run manifest:", err)
+		return
+	}
+
+	fmt.Printf("Run %s manifest has been written to %s\n", m.Id, manifestFile)
+
+	if !database.Configured() {
+		return
+	}
+
+	db, err := database.Open()
+	if err != nil {
+		fmt.Println("⚠️ Run history not recorded, database is not reachable:", err)
+		return
+	}
+	defer db.Close()
+
+	if err := database.SaveRun(db, m.run(data)); err != nil {
+		fmt.Println("⚠️ Run history not recorded:", err)
+	}
+}
+
+func (m *RunManifest) run(manifest json.RawMessage) models.PipelineRun {
+	return models.PipelineRun{
+		Id:         m.Id,
+		System:     m.System,
+		Mode:       m.Mode,
+		From:       m.From,
+		To:         m.To,
+		StartedAt:  m.StartedAt,
+		FinishedAt: m.FinishedAt,
+		Pis:        m.Pis,
+		Succeeded:  m.Succeeded,
+		Failed:     m.Failed,
+		OutputFile: m.OutputFile,
+		Manifest:   manifest,
+	}
+}
+
+// ReadRunManifest reads a manifest file, or else the run with that id in pipeline_runs.
+func ReadRunManifest(db *sql.DB, fileOrId string) (*RunManifest, error) {
+	data, err := os.ReadFile(fileOrId)
+
+	if errors.Is(err, os.ErrNotExist) && db != nil {
+		run, err := database.GetRun(db, fileOrId)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("no manifest file or run %s", fileOrId)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		data = run.Manifest
+	} else if err != nil {
+		return nil, err
+	}
+
+	var manifest RunManifest
+
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("reading manifest %s: %w", fileOrId, err)
+	}
+
+	return &manifest, nil
+}
+
+// Verify compares the outputs with their checksums, giving "unchanged", "changed" or
+// "missing" per output.
+func (m *RunManifest) Verify() map[string]string {
+	states := map[string]string{}
+
+	for _, output := range m.Outputs {
+		current, err := checksumFile(output.Path)
+
+		switch {
+		case err != nil:
+			states[output.Path] = "missing"
+		case current.Sha256 != output.Sha256:
+			states[output.Path] = "changed"
+		default:
+			states[output.Path] = "unchanged"
+		}
+	}
+
+	return states
+}
+
+// Args are the run command flags that redo the run into outputFile.
+func (m *RunManifest) Args(outputFile string) []string {
+	flag := func(name string, value string) string { return "--" + name + "=" + value }
+	float := func(value float64) string { return strconv.FormatFloat(value, 'f', -1, 64) }
+
+	args := []string{
+		flag("system", m.System),
+		flag("mode", m.Mode),
+		flag("from", m.From),
+		flag("to", m.To),
+		flag("out", outputFile),
+		flag("rate-limit", strconv.Itoa(m.RateLimit)),
+		flag("delay", strconv.Itoa(m.DelaySeconds)),
+		flag("temp-warning", float(m.Thresholds.TempWarning)),
+		flag("temp-critical", float(m.Thresholds.TempCritical)),
+		flag("ac-current-on", float(m.Thresholds.AcCurrentOn)),
+		flag("ac-short-cycle", float(m.Thresholds.AcShortCycleMinutes)),
+		flag("gap-minutes", float(m.Thresholds.GapMinutes)),
+		flag("window-max-entries", strconv.Itoa(m.Thresholds.WindowMaxEntries)),
+	}
+
+	// Manifests from before the setting ran with the default
+	if m.Thresholds.AcShortCyclesPerDay > 0 {
+		args = append(args, flag("ac-short-cycle-alert", float(m.Thresholds.AcShortCyclesPerDay)))
+	}
+
+	if m.Bucket != "" {
+		args = append(args, flag("bucket", m.Bucket), flag("series-format", m.SeriesFormat))
+	}
+
+	if len(m.Rollups) > 0 {
+		args = append(args, flag("rollup", strings.Join(m.Rollups, ",")))
+	}
+
+	if m.Sink == JOB_SINK_POSTGRES {
+		args = append(args, "--store")
+	}
+
+	ids := func(values []int) string {
+		texts := []string{}
+		for _, value := range values {
+			texts = append(texts, strconv.Itoa(value))
+		}
+		return strings.Join(texts, ",")
+	}
+
+	sel := m.Selection
+
+	// The same pis, whatever the folder, names or sample resolve to now
+	if len(m.PiIds) > 0 {
+		sel = Selection{FolderId: sel.FolderId, PiIds: m.PiIds}
+	}
+
+	for _, selected := range []struct {
+		name  string
+		value string
+		set   bool
+	}{
+		{"folder", sel.FolderId, sel.FolderId != ""},
+		{"ids", ids(sel.PiIds), len(sel.PiIds) > 0},
+		{"exclude-ids", ids(sel.ExcludePiIds), len(sel.ExcludePiIds) > 0},
+		{"name", sel.NameRegex, sel.NameRegex != ""},
+		{"exclude-name", sel.ExcludeNameRegex, sel.ExcludeNameRegex != ""},
+		{"offset", strconv.Itoa(sel.Offset), sel.Offset != 0},
+		{"limit", strconv.Itoa(sel.Limit), sel.Limit > 0},
+		{"sample", strconv.Itoa(sel.Sample), sel.Sample > 0},
+		{"seed", strconv.FormatInt(sel.Seed, 10), sel.Sample > 0},
+		{"shard", fmt.Sprintf("%d/%d", sel.ShardIndex, sel.ShardCount), sel.ShardCount > 0},
+	} {
+		if selected.set {
+			args = append(args, flag(selected.name, selected.value))
+		}
+	}
+
+	return args
+}
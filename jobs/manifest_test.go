@@ -0,0 +1,77 @@
+package jobs
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunManifestArgs(t *testing.T) {
+	sys, _ := GetSystem("opms")
+	sel := Selection{PiIds: []int{3, 7}, NameRegex: "^HNI", Limit: -1, Sample: 5, Seed: 42, ShardIndex: 2, ShardCount: 4}
+
+	manifest, _ := NewRunManifest(sys, "TEMP", 1700000000, 1700086400, sel, 40, 10, "opms.csv")
+	manifest.Rollups = []string{"region", "site"}
+
+	args := strings.Join(manifest.Args("rerun.csv"), " ")
+
+	for _, want := range []string{
+		"--system=opms", "--mode=TEMP", "--from=2023-11-14T22:13:20Z", "--to=2023-11-15T22:13:20Z",
+		"--out=rerun.csv", "--rate-limit=40", "--delay=10", "--rollup=region,site",
+		"--ids=3,7", "--name=^HNI", "--sample=5", "--seed=42", "--shard=2/4", "--ac-short-cycle-alert=3",
+	} {
+		if !strings.Contains(args, want) {
+			t.Errorf("args %q lack %s", args, want)
+		}
+	}
+
+	if strings.Contains(args, "--limit") || strings.Contains(args, "--bucket") || strings.Contains(args, "--store") {
+		t.Errorf("args %q have unset flags", args)
+	}
+
+	// Once finished, the pis it resolved to are rerun into Postgres too
+	manifest.PiIds, manifest.Sink = []int{3, 9}, JOB_SINK_POSTGRES
+	args = strings.Join(manifest.Args("rerun.csv"), " ")
+
+	if !strings.Contains(args, "--ids=3,9") || !strings.Contains(args, "--store") || strings.Contains(args, "--name") || strings.Contains(args, "--sample") {
+		t.Errorf("args %q; want the resolved pis and --store", args)
+	}
+
+	if got := RerunPath("out/opms.csv", time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)); got != "out/opms.rerun-20240102-150405.csv" {
+		t.Errorf("RerunPath = %s", got)
+	}
+}
+
+func TestRunManifestFinish(t *testing.T) {
+	t.Setenv("PG_HOST", "")
+
+	dir := t.TempDir()
+	outputFile := filepath.Join(dir, "opms.csv")
+	os.WriteFile(outputFile, []byte("pi,t1Avg\n1,22.00\n"), 0644)
+
+	sys, _ := GetSystem("opms")
+	manifest, _ := NewRunManifest(sys, "TEMP", 1700000000, 1700086400, Selection{Limit: -1}, 50, 25, outputFile)
+	manifest.Finish([]ApiResponse{{Status: "success", PID: 1}, {Status: "error", PID: 2}})
+
+	read, err := ReadRunManifest(nil, filepath.Join(dir, "opms.manifest.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if read.Id != manifest.Id || read.Pis != 2 || read.Succeeded != 1 || read.Failed != 1 || len(read.Outputs) != 1 || !reflect.DeepEqual(read.PiIds, []int{1, 2}) || read.Sink != JOB_SINK_FILE {
+		t.Fatalf("manifest = %+v", read)
+	}
+
+	if states := read.Verify(); !reflect.DeepEqual(states, map[string]string{outputFile: "unchanged"}) {
+		t.Errorf("states = %v; want unchanged", states)
+	}
+
+	os.WriteFile(outputFile, []byte("pi,t1Avg\n1,23.00\n"), 0644)
+
+	if states := read.Verify(); states[outputFile] != "changed" {
+		t.Errorf("states = %v; want changed", states)
+	}
+}
@@ -0,0 +1,574 @@
+package jobs
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"project/redact"
+	"project/utils"
+	"sync"
+	"time"
+
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+)
+
+type ApiResponse struct {
+	URL           string             `json:"url"`
+	Status        string             `json:"status"`
+	Error         string             `json:"error,omitempty"`
+	ErrorClass    string             `json:"errorClass,omitempty"`
+	HTTPStatus    int                `json:"httpStatus,omitempty"`
+	Attempts      int                `json:"attempts,omitempty"`
+	ProcessedData map[string]float64 `json:"processedData,omitempty"`
+	POP           string             `json:"pop,omitempty"`
+	PID           int                `json:"pid,omitempty"`
+	// Per-bucket metrics of bucketed runs, see Bucketing
+	Buckets []BucketResult `json:"buckets,omitempty"`
+	// Requests the range was fetched in, see fetch
+	Windows int          `json:"windows,omitempty"`
+	Quality *DataQuality `json:"quality,omitempty"`
+	// What merging the result with the next interval of the pi needs, kept for the units
+	// of the durable queue. Never written out, see publishedResults.
+	Partial *ResultPartial `json:"partial,omitempty"`
+}
+
+// ResultPartial is the Part.Partial of the metrics and the state of the data quality.
+type ResultPartial struct {
+	Metrics json.RawMessage `json:"metrics,omitempty"`
+	Quality *qualityState   `json:"quality,omitempty"`
+}
+
+func (result ApiResponse) metricsPartial() json.RawMessage {
+	if result.Partial == nil {
+		return nil
+	}
+
+	return result.Partial.Metrics
+}
+
+// publishedResults are results about to be written out as JSON, without their merge
+// state and with the credentials of their URL and error masked
+func publishedResults(results []ApiResponse) []ApiResponse {
+	plain := []ApiResponse{}
+
+	for _, result := range results {
+		result.Partial = nil
+		result.URL, result.Error = redact.String(result.URL), redact.String(result.Error)
+
+		buckets := []BucketResult{}
+		for _, bucket := range result.Buckets {
+			bucket.Partial = nil
+			buckets = append(buckets, bucket)
+		}
+
+		if result.Buckets != nil {
+			result.Buckets = buckets
+		}
+
+		plain = append(plain, result)
+	}
+
+	return plain
+}
+
+type Pi struct {
+	Id           int    `json:"id"`
+	Name         string `json:"name"`
+	Ip           string `json:"ip"`
+	Address      string `json:"address"`
+	BackendPort  int    `json:"backendPort"`
+	Email        string `json:"email"`
+	Username     string `json:"username"`
+	BrokerUrl    string `json:"brokerUrl"`
+	MqttUser     string `json:"mqttUser"`
+	MqttPassword string `json:"mqttPassword"`
+	Role         string `json:"role"`
+}
+
+// MarshalJSON keeps the MQTT credentials out of every JSON output.
+func (pi Pi) MarshalJSON() ([]byte, error) {
+	type plainPi Pi
+
+	redacted := plainPi(pi)
+	redacted.BrokerUrl = redact.URL(pi.BrokerUrl)
+
+	if redacted.MqttUser != "" {
+		redacted.MqttUser = redact.MASK
+	}
+
+	if redacted.MqttPassword != "" {
+		redacted.MqttPassword = redact.MASK
+	}
+
+	return json.Marshal(redacted)
+}
+
+type PiFolderResponse struct {
+	Data []Pi `json:"data"`
+}
+
+type Endpoint struct {
+	piId     int
+	endpoint string
+	pop      string
+	// Requested window, for bucketing and the data quality
+	start int64
+	end   int64
+}
+
+const DELTA_TIME = int64(8 * 3600) // 8 hours in seconds
+
+func (sys *System) getPis(sel Selection) ([]Pi, error) {
+	all, err := sys.fetchPiList(sel.FolderId)
+	if err != nil {
+		return nil, err
+	}
+
+	return selectPis(sel, all)
+}
+
+// fetchPiList gets every pi of a folder, before any selection
+func (sys *System) fetchPiList(folderId string) ([]Pi, error) {
+	urlGetPis := sys.url(fmt.Sprintf(sys.PiListRoute, url.QueryEscape(folderId)))
+
+	client := &http.Client{Timeout: 20 * time.Second}
+
+	req, err := http.NewRequest("GET", urlGetPis, nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating request: %w", err)
+	}
+
+	resp, _, err := utils.DoIOT(client, req)
+	if err != nil {
+		return nil, fmt.Errorf("sending request: %w", err)
+	}
+
+	defer resp.Body.Close() // Ensure response body is closed
+
+	// Handle non-200 status codes
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("API returned non-OK status: %d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+
+	// Define a structured response
+	var piFolderResponse PiFolderResponse
+
+	if err := json.NewDecoder(resp.Body).Decode(&piFolderResponse); err != nil {
+		return nil, fmt.Errorf("decoding response: %w", err)
+	}
+
+	for _, pi := range piFolderResponse.Data {
+		redact.Register(pi.MqttPassword)
+	}
+
+	return piFolderResponse.Data, nil
+}
+
+func selectPis(sel Selection, all []Pi) ([]Pi, error) {
+	pis, err := sel.Apply(all)
+	if err != nil {
+		return nil, fmt.Errorf("invalid selection: %w", err)
+	}
+
+	fmt.Printf("Selected %d of %d pis\n", len(pis), len(all))
+
+	return pis, nil
+}
+
+func (sys *System) getEndpoints(timeStart int64, timeEnd int64, sel Selection, mode string) []Endpoint {
+	if _, ok := sys.LogRoutes[mode]; !ok {
+		fmt.Println("Invalid mode")
+		return nil
+	}
+
+	pis, err := sys.getPis(sel)
+	if err != nil {
+		fmt.Println("❌", err)
+		return nil
+	}
+
+	var endpoints []Endpoint
+
+	for _, pi := range pis {
+		endpoints = append(endpoints, sys.endpoint(pi.Id, pi.Name, mode, timeStart, timeEnd))
+	}
+
+	return endpoints
+}
+
+func (sys *System) endpoint(piId int, pop string, mode string, timeStart int64, timeEnd int64) Endpoint {
+	url, _ := sys.logURL(mode, piId, timeStart, timeEnd)
+
+	return Endpoint{piId: piId, endpoint: url, pop: pop, start: timeStart, end: timeEnd}
+}
+
+// fetch crawls the range of one endpoint in adaptive windows: a window that times out
+// or returns more than windowMaxEntries is halved and retried, a window returning few
+// entries doubles the next one. The windows are merged into one result per pi.
+func (sys *System) fetch(ctx context.Context, rawEndpoint Endpoint, wg *sync.WaitGroup, results chan<- ApiResponse, mode string, bucketing Bucketing) {
+	defer wg.Done()
+
+	progress := progressFrom(ctx)
+
+	endpoint := rawEndpoint.endpoint
+
+	attempts, windows := 0, 0
+
+	failed := func(failure ApiResponse) {
+		result := ApiResponse{
+			URL:        endpoint,
+			Status:     "error",
+			Error:      failure.Error,
+			ErrorClass: failure.ErrorClass,
+			HTTPStatus: failure.HTTPStatus,
+			Attempts:   attempts,
+			POP:        sys.popName(rawEndpoint.pop),
+			PID:        rawEndpoint.piId,
+			Windows:    windows,
+		}
+		progress.finish(result)
+		results <- result
+	}
+
+	processor, err := sys.processor(mode)
+	if err != nil {
+		failed(ApiResponse{Error: err.Error(), ErrorClass: ERR_CLASS_REQUEST})
+		return
+	}
+
+	client := &http.Client{Timeout: 60 * time.Second}
+
+	quality := newQualityAggregator(rawEndpoint.start, rawEndpoint.end, sys.sampleSeconds(mode), requiredKeys(processor))
+	validation := &ValidationError{}
+	parts := []Part{}
+	bucketParts := []BucketResult{}
+
+	size := sys.windowSeconds(mode)
+
+	for from := rawEndpoint.start; from < rawEndpoint.end || windows == 0; {
+		to := nextWindow(from, rawEndpoint.end, size, bucketing)
+
+		window := sys.fetchWindow(ctx, client, processor, rawEndpoint, mode, from, to, bucketing)
+		attempts += window.failure.Attempts
+		windows++
+
+		if window.failure.Status == "error" {
+			if window.splittable() && to-from > WINDOW_MIN_SECONDS {
+				size = max((to-from)/2, WINDOW_MIN_SECONDS)
+
+				progress.publish(Event{
+					Type:       EVENT_RETRY,
+					PiId:       rawEndpoint.piId,
+					POP:        sys.popName(rawEndpoint.pop),
+					Error:      window.failure.Error,
+					ErrorClass: window.failure.ErrorClass,
+					From:       from,
+					To:         to,
+				})
+				continue
+			}
+
+			if window.failure.ErrorClass == ERR_CLASS_API {
+				fmt.Printf("❌ | %s %d\n", rawEndpoint.pop, rawEndpoint.piId)
+			}
+			failed(window.failure)
+			return
+		}
+
+		quality.absorb(window.quality)
+		parts = append(parts, window.part)
+		bucketParts = append(bucketParts, window.buckets...)
+
+		validation.combine(window.validation)
+
+		if window.entries < windowMaxEntries/WINDOW_WIDEN_RATIO {
+			size = min(size*2, WINDOW_MAX_SECONDS)
+		}
+
+		from = to
+	}
+
+	merged := parts[0]
+	if len(parts) > 1 {
+		merged = processor.Merge(parts)
+	}
+
+	dataQuality := quality.Result()
+
+	if validation.Invalid > 0 {
+		if validation.Invalid == validation.Total {
+			failed(ApiResponse{Error: validation.Error(), ErrorClass: ERR_CLASS_VALIDATION, HTTPStatus: http.StatusOK})
+			return
+		}
+
+		fmt.Printf("⚠️ %s for id: %d\n", validation, rawEndpoint.piId)
+
+		dataQuality.InvalidEntries = validation.Invalid
+		dataQuality.Validation = validation.Error()
+	}
+
+	var buckets []BucketResult
+	if bucketing.Enabled() {
+		buckets = mergeBuckets(processor, bucketParts)
+	}
+
+	// Send results
+	result := ApiResponse{
+		URL:           endpoint,
+		Status:        "success",
+		HTTPStatus:    http.StatusOK,
+		Attempts:      attempts,
+		ProcessedData: merged.Metrics,
+		POP:           sys.popName(rawEndpoint.pop),
+		PID:           rawEndpoint.piId,
+		Windows:       windows,
+		Buckets:       buckets,
+		Quality:       dataQuality,
+		Partial:       &ResultPartial{Metrics: merged.Partial, Quality: &quality.state},
+	}
+	progress.finish(result)
+	results <- result
+}
+
+var errApiCallFailed = fmt.Errorf("API call failed")
+
+// fetchAll fetches the endpoints rateLimit at a time. Once ctx is canceled it stops
+// starting new ones, they are returned as canceled failures.
+func (sys *System) fetchAll(ctx context.Context, endpoints []Endpoint, mode string, rateLimit int, delaySeconds int, bucketing Bucketing) []ApiResponse {
+	var wg sync.WaitGroup
+	results := make(chan ApiResponse, len(endpoints))
+
+	// Runs without a Progress of their own only report to the console
+	progress := progressFrom(ctx)
+	if progress == nil {
+		progress = &Progress{}
+		ctx = WithProgress(ctx, progress)
+	}
+
+	progress.add(len(endpoints))
+
+	stop := progress.report(os.Stdout)
+	defer stop()
+
+	var countBatch int
+
+	for i, endpoint := range endpoints {
+		if ctx.Err() != nil {
+			result := ApiResponse{URL: endpoint.endpoint, Status: "error", Error: ctx.Err().Error(), ErrorClass: ERR_CLASS_CANCELED, POP: sys.popName(endpoint.pop), PID: endpoint.piId}
+			progress.finish(result)
+			results <- result
+			continue
+		}
+
+		wg.Add(1)
+		go sys.fetch(ctx, endpoint, &wg, results, mode, bucketing)
+
+		// Introduce a delay based on the rate limit
+		if (i+1)%rateLimit == 0 {
+			countBatch += rateLimit
+
+			progress.publish(Event{Type: EVENT_COOLDOWN, Started: countBatch, Seconds: delaySeconds})
+
+			select {
+			case <-time.After(time.Duration(delaySeconds) * time.Second):
+			case <-ctx.Done():
+			}
+		}
+	}
+
+	wg.Wait()
+
+	close(results)
+
+	fResults := []ApiResponse{}
+
+	for result := range results {
+		fResults = append(fResults, result)
+	}
+
+	return fResults
+}
+
+// CollectResults fetches and processes one mode for the selected pis without writing anything.
+func CollectResults(ctx context.Context, sys *System, sel Selection, startTime int64, endTime int64, rateLimit int, delaySeconds int, mode string) []ApiResponse {
+	endpoints := sys.getEndpoints(startTime, endTime, sel, mode)
+
+	fmt.Printf("Found %d Endpoints\n", len(endpoints))
+
+	fmt.Println("Starting API calls...")
+
+	return sys.fetchAll(ctx, endpoints, mode, rateLimit, delaySeconds, Bucketing{})
+}
+
+// RunPipeline crawls one mode of a system for the selected pis and writes the CSV and failure report.
+func RunPipeline(ctx context.Context, sys *System, sel Selection, startTime int64, endTime int64, rateLimit int, delaySeconds int, outputFile string, mode string) []ApiResponse {
+	fResults := CollectResults(ctx, sys, sel, startTime, endTime, rateLimit, delaySeconds, mode)
+
+	sys.writeRun(fResults, mode, startTime, endTime, outputFile)
+
+	return fResults
+}
+
+// writeRun adds the fleet comparison and writes the CSV, data quality and failure report
+func (sys *System) writeRun(fResults []ApiResponse, mode string, startTime int64, endTime int64, outputFile string) {
+	if processor, err := sys.processor(mode); err == nil {
+		if fleet, ok := processor.(FleetProcessor); ok {
+			if err := fleet.Fleet(fResults, historyPath(outputFile), endTime); err != nil {
+				fmt.Println("⚠️ Fleet comparison failed:", err)
+			}
+		}
+	}
+
+	sys.writeCsvFile(fResults, outputFile, mode)
+
+	sys.writeQualityReport(fResults, outputFile)
+
+	writeFailureReport(newFailureReport(sys.Name, mode, startTime, endTime, outputFile, fResults))
+}
+
+// GetSingleFromLongRange crawls one pi over a long range in adaptive windows and
+// writes the merged metrics as a single row.
+func GetSingleFromLongRange(
+	sys *System,
+	startTime int64,
+	endTime int64,
+	piId int,
+	mode string,
+	rateLimit int,
+	delaySeconds int,
+) {
+	url, err := sys.logURL(mode, piId, startTime, endTime)
+	if err != nil {
+		fmt.Println("Invalid mode")
+		return
+	}
+
+	endpoints := []Endpoint{{piId: piId, endpoint: url, pop: "SINGLE_POP", start: startTime, end: endTime}}
+
+	dateStart := time.Unix(startTime, 0).Format("2006-01-02 15:04:05")
+	dateEnd := time.Unix(endTime, 0).Format("2006-01-02 15:04:05")
+
+	fmt.Printf("📆 %s to %s\n⚡ Fetching %d in windows of %d hours first ⌛", dateStart, dateEnd, piId, sys.windowSeconds(mode)/3600)
+
+	fmt.Println("Starting API calls...")
+
+	resultSingle := sys.fetchAll(context.Background(), endpoints, mode, rateLimit, delaySeconds, Bucketing{})
+
+	for i := range resultSingle {
+		fmt.Printf("%d windows fetched\n", resultSingle[i].Windows)
+		resultSingle[i].URL = "Single"
+	}
+
+	fileName := fmt.Sprintf("%s_%d_%s.csv", sys.Name, piId, mode)
+
+	sys.writeCsvFile(resultSingle, fileName, mode)
+}
+
+func (sys *System) csvHeader(mode string) []string {
+	header := []string{"PI ID", "POP", "Status"}
+
+	processor, err := sys.processor(mode)
+	if err != nil {
+		fmt.Println("Invalid mode")
+		return header
+	}
+
+	for _, column := range processor.Columns() {
+		header = append(header, column.Header)
+	}
+
+	return header
+}
+
+func (sys *System) csvRecord(result ApiResponse, mode string) []string {
+	pId := fmt.Sprintf("%d", result.PID)
+
+	if result.Status != "success" {
+		return []string{pId, result.POP, result.Status, "", redact.String(result.Error)}
+	}
+
+	record := []string{
+		pId, result.POP, result.Status,
+	}
+
+	processor, err := sys.processor(mode)
+	if err != nil {
+		return record
+	}
+
+	for _, column := range processor.Columns() {
+		record = append(record, metricCell(result.ProcessedData, column.Key))
+	}
+
+	return record
+}
+
+// metricCell leaves metrics a processor had no data for blank instead of 0
+func metricCell(data map[string]float64, key string) string {
+	value, ok := data[key]
+	if !ok {
+		return ""
+	}
+
+	return fmt.Sprintf("%.2f", value)
+}
+
+func (sys *System) writeCsvFile(results []ApiResponse, outputFile string, mode string) {
+	records := [][]string{sys.csvHeader(mode)}
+
+	for _, result := range results {
+		records = append(records, sys.csvRecord(result, mode))
+	}
+
+	sys.writeCsvRecords(records, outputFile)
+
+	fmt.Printf("Results have been written to %s\n", outputFile)
+}
+
+func (sys *System) writeCsvRecords(records [][]string, outputFile string) {
+	writeCsvRecords(records, outputFile, sys.CSVEncoding)
+}
+
+func writeCsvRecords(records [][]string, outputFile string, encoding string) {
+	file, err := os.Create(outputFile)
+	if err != nil {
+		fmt.Println("Error creating CSV file:", err)
+		return
+	}
+	defer file.Close()
+
+	var out io.Writer = file
+
+	if encoding == CSV_ENCODING_UTF16LE {
+		// UTF-16 with BOM (Little Endian)
+		utf16Writer := transform.NewWriter(file, unicode.UTF16(unicode.LittleEndian, unicode.UseBOM).NewEncoder())
+		defer utf16Writer.Close()
+
+		out = utf16Writer
+	}
+
+	writer := csv.NewWriter(out)
+	defer writer.Flush()
+
+	writer.WriteAll(records)
+}
+
+// readCsvRecords reads both the UTF-8 OPMS files and the UTF-16 (BOM) IPMS files
+func readCsvRecords(inputFile string) ([][]string, error) {
+	file, err := os.Open(inputFile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(transform.NewReader(file, unicode.BOMOverride(unicode.UTF8.NewDecoder())))
+	reader.FieldsPerRecord = -1
+
+	return reader.ReadAll()
+}
@@ -0,0 +1,63 @@
+package jobs
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPipelineWithConfiguredSystem(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/pis":
+			w.Write([]byte(`{"data": [{"id": 1, "name": "HNI0001-CAB"}, {"id": 2, "name": "HNI0002-CAB"}]}`))
+		case "/v2/pis/1/fans":
+			w.Write([]byte(`{"result": {"ok": true, "rows": [
+				{"timestamp": 0, "rps_fan_pop_0": 40, "control_fan_pop_0": 100},
+				{"timestamp": 60, "rps_fan_pop_0": 50, "control_fan_pop_0": 100},
+				{"timestamp": 120, "rps_fan_pop_0": 10, "control_fan_pop_0": 20}
+			]}}`))
+		default:
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer server.Close()
+
+	config := filepath.Join(t.TempDir(), "systems.json")
+	os.WriteFile(config, []byte(`[{
+		"name": "xpms",
+		"baseUrl": "`+server.URL+`",
+		"piListRoute": "/v2/pis?folder=%s",
+		"logRoutes": {"FAN": "/v2/pis/%d/fans?from=%d&to=%d"},
+		"processors": {"FAN": "fan"},
+		"envelope": {"entriesPath": "result.rows", "successPath": "result.ok"},
+		"popName": "site"
+	}]`), 0644)
+
+	if err := LoadSystems(config); err != nil {
+		t.Fatal(err)
+	}
+
+	sys, ok := GetSystem("XPMS")
+	if !ok {
+		t.Fatal("xpms was not registered")
+	}
+
+	results := CollectResults(context.Background(), sys, Selection{}, 0, 3600, 10, 0, "FAN")
+
+	byPi := map[int]ApiResponse{}
+	for _, result := range results {
+		byPi[result.PID] = result
+	}
+
+	if got := byPi[1]; got.Status != "success" || got.POP != "HNI0001" || got.ProcessedData["f1"] != 45 {
+		t.Errorf("pi 1 = %+v; want success, POP HNI0001 and f1 45", got)
+	}
+
+	if got := byPi[2]; got.Status != "error" || got.HTTPStatus != http.StatusBadGateway || got.ErrorClass != ERR_CLASS_SERVER {
+		t.Errorf("pi 2 = %+v; want a 502 http_5xx error", got)
+	}
+}
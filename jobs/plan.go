@@ -0,0 +1,151 @@
+package jobs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"project/redact"
+	"time"
+)
+
+// Seconds one log request is assumed to take when estimating a plan
+const PLAN_REQUEST_SECONDS_DEFAULT = 2.0
+
+// Plan is what a run would do, without calling any log endpoint. The windows are the
+// first ones fetch would try: busy pis get split further, quiet ones widened.
+type Plan struct {
+	System           string      `json:"system"`
+	Mode             string      `json:"mode"`
+	StartTime        int64       `json:"startTime"`
+	EndTime          int64       `json:"endTime"`
+	RateLimit        int         `json:"rateLimit"`
+	DelaySeconds     int         `json:"delaySeconds"`
+	WindowSeconds    int64       `json:"windowSeconds"`
+	Pis              []PlannedPi `json:"pis"`
+	Requests         int         `json:"requests"`
+	EstimatedSeconds float64     `json:"estimatedSeconds"`
+}
+
+type PlannedPi struct {
+	Id   int      `json:"id"`
+	Name string   `json:"name"`
+	URLs []string `json:"urls"`
+}
+
+// PlanPipeline lists the requests of one mode for pis. Every pi fetches its windows one
+// after the other, rateLimit pis at a time with a cool down of delaySeconds in between.
+func PlanPipeline(sys *System, pis []Pi, startTime int64, endTime int64, rateLimit int, delaySeconds int, mode string, b Bucketing, requestSeconds float64) (Plan, error) {
+	if _, err := sys.processor(mode); err != nil {
+		return Plan{}, err
+	}
+
+	plan := Plan{
+		System:        sys.Name,
+		Mode:          mode,
+		StartTime:     startTime,
+		EndTime:       endTime,
+		RateLimit:     rateLimit,
+		DelaySeconds:  delaySeconds,
+		WindowSeconds: sys.windowSeconds(mode),
+		Pis:           []PlannedPi{},
+	}
+
+	longest := 0
+
+	for _, pi := range pis {
+		planned := PlannedPi{Id: pi.Id, Name: pi.Name, URLs: []string{}}
+
+		for from := startTime; from < endTime; {
+			to := nextWindow(from, endTime, plan.WindowSeconds, b)
+
+			url, err := sys.logURL(mode, pi.Id, from, to)
+			if err != nil {
+				return plan, err
+			}
+
+			planned.URLs = append(planned.URLs, redact.URL(url))
+			from = to
+		}
+
+		plan.Requests += len(planned.URLs)
+		longest = max(longest, len(planned.URLs))
+		plan.Pis = append(plan.Pis, planned)
+	}
+
+	// fetchAll cools down after every rateLimit pis, the last ones run while the rest finishes
+	cooldowns := 0
+	if rateLimit > 0 {
+		cooldowns = len(pis) / rateLimit
+	}
+
+	plan.EstimatedSeconds = float64(cooldowns*delaySeconds) + float64(longest)*requestSeconds
+
+	return plan, nil
+}
+
+// GetPis fetches the pi list of a system and applies the selection.
+func GetPis(sys *System, sel Selection) ([]Pi, error) {
+	return sys.getPis(sel)
+}
+
+// piListCache is the pi list of a folder of a system saved by an earlier plan
+type piListCache struct {
+	System    string `json:"system"`
+	FolderId  string `json:"folderId"`
+	FetchedAt int64  `json:"fetchedAt"`
+	Pis       []Pi   `json:"pis"`
+}
+
+// CachedPis selects from the pi list in cacheFile, fetching and saving it first when
+// the file is missing or holds another system or folder. MQTT credentials are never saved.
+func CachedPis(sys *System, sel Selection, cacheFile string) ([]Pi, error) {
+	var cache piListCache
+
+	data, err := os.ReadFile(cacheFile)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	if err == nil {
+		if err := json.Unmarshal(data, &cache); err != nil {
+			return nil, fmt.Errorf("reading pi list cache %s: %w", cacheFile, err)
+		}
+	}
+
+	if err != nil || cache.System != sys.Name || cache.FolderId != sel.FolderId {
+		all, err := sys.fetchPiList(sel.FolderId)
+		if err != nil {
+			return nil, err
+		}
+
+		cache = piListCache{System: sys.Name, FolderId: sel.FolderId, FetchedAt: time.Now().Unix(), Pis: all}
+
+		if data, err = json.MarshalIndent(cache, "", "  "); err != nil {
+			return nil, err
+		}
+
+		if err := os.WriteFile(cacheFile, data, 0600); err != nil {
+			return nil, err
+		}
+	} else {
+		fmt.Printf("Using the pi list cached at %s\n", time.Unix(cache.FetchedAt, 0).Format("2006-01-02 15:04:05"))
+	}
+
+	return selectPis(sel, cache.Pis)
+}
+
+// PlanRecords is a plan as a table, one row per request
+func PlanRecords(plans []Plan) [][]string {
+	records := [][]string{{"System", "Mode", "PI ID", "Pi Name", "URL"}}
+
+	for _, plan := range plans {
+		for _, pi := range plan.Pis {
+			for _, url := range pi.URLs {
+				records = append(records, []string{plan.System, plan.Mode, fmt.Sprintf("%d", pi.Id), pi.Name, url})
+			}
+		}
+	}
+
+	return records
+}
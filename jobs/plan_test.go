@@ -0,0 +1,58 @@
+package jobs
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestPlanOnlyFetchesThePiListOnce(t *testing.T) {
+	calls := map[string]int{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls[r.URL.Path]++
+		w.Write([]byte(`{"data": [{"id": 1, "name": "HNI0001"}, {"id": 2, "name": "HNI0002"}, {"id": 3, "name": "HCM0001"}]}`))
+	}))
+	defer server.Close()
+
+	sys := &System{
+		Name:          "planned",
+		BaseURL:       server.URL,
+		PiListRoute:   "/pis?folderId=%s",
+		LogRoutes:     map[string]string{"TEMP": "/logs/%d?from=%d&to=%d"},
+		Processors:    map[string]string{"TEMP": "opms-temp"},
+		WindowSeconds: map[string]int64{"TEMP": 3600},
+	}
+
+	cacheFile := filepath.Join(t.TempDir(), "pis.json")
+
+	for i := 0; i < 2; i++ {
+		pis, err := CachedPis(sys, Selection{NameRegex: "^HNI", Limit: -1}, cacheFile)
+		if err != nil || len(pis) != 2 {
+			t.Fatalf("pis = %v, err = %v; want the 2 HNI pis", pis, err)
+		}
+
+		plan, err := PlanPipeline(sys, pis, 0, 3*3600+60, 1, 10, "TEMP", Bucketing{}, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// 4 windows each, 2 cool downs after every pi
+		if plan.Requests != 8 || plan.EstimatedSeconds != 2*10+4*2 || plan.Pis[0].URLs[3] != server.URL+"/logs/1?from=10800&to=10860" {
+			t.Errorf("plan = %+v", plan)
+		}
+	}
+
+	if len(calls) != 1 || calls["/pis"] != 1 {
+		t.Errorf("calls = %v; want the pi list only, once", calls)
+	}
+
+	// Another system does not read the list of the first one
+	other := *sys
+	other.Name = "other"
+
+	if _, err := CachedPis(&other, Selection{Limit: -1}, cacheFile); err != nil || calls["/pis"] != 2 {
+		t.Errorf("calls = %v (%v); want the pi list of the other system fetched", calls, err)
+	}
+}
@@ -0,0 +1,149 @@
+package jobs
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// PopInfo is what the naming rules pull out of a pi name.
+type PopInfo struct {
+	Raw      string `json:"raw"`
+	Region   string `json:"region,omitempty"`
+	Province string `json:"province,omitempty"`
+	Site     string `json:"site"`
+}
+
+// PopRule is a regex with named groups "region", "province" and "site".
+// Groups that are absent or empty are left blank, except that the region can
+// be looked up from the province with Regions.
+type PopRule struct {
+	Pattern string            `json:"pattern"`
+	Regions map[string]string `json:"regions,omitempty"`
+
+	re *regexp.Regexp
+}
+
+// DEFAULT_POP_RULE matches names such as "HNI0001..." where the first three letters
+// are the province code and the first seven characters are the site code.
+const DEFAULT_POP_RULE = `^(?P<site>(?P<province>[A-Za-z]{3})[A-Za-z0-9]{4})`
+
+var popRules = []*PopRule{}
+
+func init() {
+	if err := SetPopRules([]*PopRule{{Pattern: DEFAULT_POP_RULE}}); err != nil {
+		panic(err)
+	}
+}
+
+// SetPopRules replaces the naming rules, they are tried in order.
+func SetPopRules(rules []*PopRule) error {
+	for _, rule := range rules {
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return fmt.Errorf("invalid POP rule %q: %w", rule.Pattern, err)
+		}
+		rule.re = re
+	}
+
+	popRules = rules
+
+	return nil
+}
+
+// LoadPopRules reads a JSON array of PopRule, e.g.
+//
+//	[{"pattern": "^(?P<province>[A-Z]{3})-(?P<site>\\w+)", "regions": {"HNI": "North"}}]
+func LoadPopRules(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var rules []*PopRule
+
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return fmt.Errorf("reading POP rules from %s: %w", path, err)
+	}
+
+	return SetPopRules(rules)
+}
+
+// ParsePopName applies the first matching rule, first to the name as is and then to
+// its upper case alphanumerics ("hni-0001 cab" is tried as "HNI0001CAB"). Names no
+// rule matches keep their alphanumerics as the site code.
+func ParsePopName(name string) PopInfo {
+	normalized := normalizeAlphanumeric(name)
+
+	for _, candidate := range []string{name, normalized} {
+		if info, ok := applyPopRules(candidate); ok {
+			info.Raw = name
+			return info
+		}
+	}
+
+	return PopInfo{Raw: name, Site: normalized}
+}
+
+func applyPopRules(name string) (PopInfo, bool) {
+	for _, rule := range popRules {
+		match := rule.re.FindStringSubmatch(name)
+		if match == nil {
+			continue
+		}
+
+		info := PopInfo{}
+
+		for i, group := range rule.re.SubexpNames() {
+			value := strings.ToUpper(strings.TrimSpace(match[i]))
+
+			switch group {
+			case "region":
+				info.Region = value
+			case "province":
+				info.Province = value
+			case "site":
+				info.Site = value
+			}
+		}
+
+		if info.Region == "" && info.Province != "" {
+			info.Region = rule.Regions[info.Province]
+		}
+
+		if info.Site == "" {
+			info.Site = normalizeAlphanumeric(name)
+		}
+
+		return info, true
+	}
+
+	return PopInfo{}, false
+}
+
+func normalizeAlphanumeric(name string) string {
+	var code strings.Builder
+
+	for _, r := range strings.ToUpper(name) {
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			code.WriteRune(r)
+		}
+	}
+
+	return code.String()
+}
+
+func (info PopInfo) Level(level string) string {
+	switch level {
+	case "region":
+		return info.Region
+	case "province":
+		return info.Province
+	case "site":
+		return info.Site
+	default:
+		return info.Raw
+	}
+}
@@ -0,0 +1,82 @@
+package jobs
+
+import (
+	"math"
+	"testing"
+)
+
+func TestParsePopName(t *testing.T) {
+	defer SetPopRules([]*PopRule{{Pattern: DEFAULT_POP_RULE}})
+
+	tests := map[string]PopInfo{
+		"HNI0001_OPMS":  {Province: "HNI", Site: "HNI0001"},
+		"hni-0002 ipms": {Province: "HNI", Site: "HNI0002"},
+		"HN1":           {Site: "HN1"},
+		"":              {Site: ""},
+	}
+
+	for name, want := range tests {
+		got := ParsePopName(name)
+		if got.Province != want.Province || got.Site != want.Site {
+			t.Errorf("ParsePopName(%q) = %+v; want %+v", name, got, want)
+		}
+	}
+
+	err := SetPopRules([]*PopRule{{
+		Pattern: `^(?P<region>[A-Z])-(?P<province>[A-Z]{3})-(?P<site>\d+)`,
+	}, {
+		Pattern: DEFAULT_POP_RULE,
+		Regions: map[string]string{"DNG": "CENTRAL"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := ParsePopName("N-HNI-17"); got.Region != "N" || got.Province != "HNI" || got.Site != "17" {
+		t.Errorf("ParsePopName(N-HNI-17) = %+v", got)
+	}
+
+	if got := ParsePopName("DNG0003"); got.Region != "CENTRAL" {
+		t.Errorf("ParsePopName(DNG0003).Region = %q; want CENTRAL from the province", got.Region)
+	}
+}
+
+func TestRollupByProvince(t *testing.T) {
+	processor, _ := GetProcessor("ipms-temp")
+
+	readings := func(values ...float64) ApiResponse {
+		entries := []map[string]any{}
+		for i, value := range values {
+			entries = append(entries, map[string]any{"timestamp": float64(i * 60), "sensoripmst0": value})
+		}
+
+		part := processPart(t, processor, entries)
+
+		return ApiResponse{Status: "success", ProcessedData: part.Metrics, Partial: &ResultPartial{Metrics: part.Partial}}
+	}
+
+	results := []ApiResponse{readings(20, 24, 30), readings(22, 38, 38, 38, 35), {Status: "error"}, readings(20)}
+	for i, pop := range []string{"HNI0001", "HNI0002", "HNI0003", "X"} {
+		results[i].PID, results[i].POP = i+1, pop
+	}
+
+	rows := Rollup(processor, results, "province")
+
+	if len(rows) != 2 || rows[0].Key != "HNI" || rows[1].Key != "UNKNOWN" {
+		t.Fatalf("rows = %+v; want HNI and UNKNOWN", rows)
+	}
+
+	// The readings of both pis pooled, the minutes added up
+	hni := rows[0]
+	want := map[string]float64{"t1Count": 8, "t1Min": 20, "t1Max": 38, "t1Avg": 30.625, "t1P50": 32.5, "t1MinutesWarning": 4, "t1MinutesCritical": 0}
+
+	if hni.Pis != 3 || hni.Successful != 2 {
+		t.Errorf("HNI = %+v", hni)
+	}
+
+	for key, value := range want {
+		if got, ok := hni.Metrics[key]; !ok || math.Abs(got-value) > 1e-9 {
+			t.Errorf("HNI %s = %v; want %v", key, got, value)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package jobs
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+)
+
+// Column is one metric of a processor and its CSV header.
+type Column struct {
+	Key    string
+	Header string
+}
+
+// Aggregator folds the log entries of one pi into metrics, one entry at a time and in
+// the order the API sent them, so that a response never has to be held in memory.
+type Aggregator interface {
+	Add(entry json.RawMessage)
+	// Result gives the metrics, with a *ValidationError when entries were skipped
+	Result() (map[string]float64, error)
+	// Partial is what Merge needs beyond the metrics, nil when they are enough
+	Partial() json.RawMessage
+}
+
+// Part is the metrics of one sub-interval of a pi and the Partial of their aggregator.
+type Part struct {
+	Metrics map[string]float64
+	Partial json.RawMessage
+}
+
+// Processor turns the log entries of one pi into metrics.
+type Processor interface {
+	Columns() []Column
+	NewAggregator() Aggregator
+	// Merge combines the parts of consecutive sub-intervals of the same pi, in time
+	// order. It is exact when every part has its Partial.
+	Merge(parts []Part) Part
+	// Rollup combines the parts of different pis over the same range into the metrics
+	// of the group.
+	Rollup(parts []Part) map[string]float64
+}
+
+// partOf is the Part of a finished aggregator
+func partOf(aggregator Aggregator) (Part, error) {
+	metrics, err := aggregator.Result()
+
+	return Part{Metrics: metrics, Partial: aggregator.Partial()}, err
+}
+
+// partMetrics are the metrics of every part
+func partMetrics(parts []Part) []map[string]float64 {
+	metrics := []map[string]float64{}
+	for _, part := range parts {
+		metrics = append(metrics, part.Metrics)
+	}
+
+	return metrics
+}
+
+// Longest time a log sample is assumed to last, longer gaps are outages
+const MAX_SAMPLE_SECONDS = 600.0
+
+var processors = map[string]Processor{}
+
+func RegisterProcessor(name string, processor Processor) {
+	processors[name] = processor
+}
+
+func GetProcessor(name string) (Processor, bool) {
+	processor, ok := processors[name]
+	return processor, ok
+}
+
+func init() {
+	RegisterProcessor("fan", fanProcessor{})
+	RegisterProcessor("fan-health", fanHealthProcessor{})
+	RegisterProcessor("opms-temp", tempProcessor{keyPrefix: "temperature_", sensors: 4, decode: decodeOpmsTemp})
+	RegisterProcessor("ipms-temp", tempProcessor{keyPrefix: "sensoripmst", sensors: 1, decode: decodeIpmsSensor})
+	RegisterProcessor("ac", acProcessor{})
+	RegisterProcessor("current", currentProcessor{})
+}
+
+type fanProcessor struct{}
+
+func (fanProcessor) Columns() []Column {
+	return []Column{{"f1", "F1"}, {"f2", "F2"}, {"f3", "F3"}, {"f4", "F4"}}
+}
+
+func (fanProcessor) Keys() []string {
+	return fanKeys()
+}
+
+// fanKeys are the RPS and control keys of the 4 fans
+func fanKeys() []string {
+	keys := []string{}
+	for i := 0; i < 4; i++ {
+		keys = append(keys, fmt.Sprintf("rps_fan_pop_%d", i), fmt.Sprintf("control_fan_pop_%d", i))
+	}
+
+	return keys
+}
+
+// fanPartial is the RPS sum and the count of the samples at control 100 of every fan
+type fanPartial struct {
+	Rps   [4]float64
+	Count [4]int
+}
+
+// metrics floors the average RPS of every fan, 0 when it has no sample
+func (p fanPartial) metrics() map[string]float64 {
+	metrics := map[string]float64{}
+
+	for i := 0; i < 4; i++ {
+		metrics[fmt.Sprintf("f%d", i+1)] = 0
+
+		if p.Count[i] > 0 {
+			metrics[fmt.Sprintf("f%d", i+1)] = math.Floor(p.Rps[i] / float64(p.Count[i]))
+		}
+	}
+
+	return metrics
+}
+
+func (fanProcessor) NewAggregator() Aggregator {
+	state := fanPartial{}
+
+	add := func(fan FanEntry) {
+		for i := 0; i < 4; i++ {
+			if fan.Rps[i].Valid && fan.Control[i].Valid && fan.Control[i].Value == 100 {
+				state.Rps[i] += fan.Rps[i].Value
+				state.Count[i]++
+			}
+		}
+	}
+
+	result := func() map[string]float64 {
+		return state.metrics()
+	}
+
+	partial := func() json.RawMessage {
+		data, _ := json.Marshal(state)
+		return data
+	}
+
+	return &typedAggregator[FanEntry]{decode: unmarshalEntry[FanEntry], add: add, result: result, partial: partial}
+}
+
+// Merge pools the RPS sums and counts of the parts. Without the partials it falls back
+// to the mean of the averages of the parts.
+func (fanProcessor) Merge(parts []Part) Part {
+	var pooled fanPartial
+
+	for _, part := range parts {
+		var partial fanPartial
+
+		if part.Partial == nil || json.Unmarshal(part.Partial, &partial) != nil {
+			return fanMeanOfParts(parts)
+		}
+
+		for i := 0; i < 4; i++ {
+			pooled.Rps[i] += partial.Rps[i]
+			pooled.Count[i] += partial.Count[i]
+		}
+	}
+
+	data, _ := json.Marshal(pooled)
+	return Part{Metrics: pooled.metrics(), Partial: data}
+}
+
+func fanMeanOfParts(parts []Part) Part {
+	merged := map[string]float64{}
+
+	for _, part := range parts {
+		for key, value := range part.Metrics {
+			merged[key] += value
+		}
+	}
+
+	for key, value := range merged {
+		merged[key] = math.Floor(value / float64(len(parts)))
+	}
+
+	return Part{Metrics: merged}
+}
+
+// Rollup averages the RPS of the pis
+func (fanProcessor) Rollup(parts []Part) map[string]float64 {
+	return meanOf(partMetrics(parts), fanProcessor{}.Columns())
+}
+
+// meanOf averages the columns over the parts that have them
+func meanOf(parts []map[string]float64, columns []Column) map[string]float64 {
+	mean := map[string]float64{}
+
+	for _, column := range columns {
+		sum, count := 0.0, 0.0
+
+		for _, part := range parts {
+			if value, ok := part[column.Key]; ok {
+				sum += value
+				count++
+			}
+		}
+
+		if count > 0 {
+			mean[column.Key] = sum / count
+		}
+	}
+
+	return mean
+}
+
+type currentProcessor struct{}
+
+func (currentProcessor) Columns() []Column {
+	return nil
+}
+
+func (currentProcessor) NewAggregator() Aggregator {
+	return &typedAggregator[json.RawMessage]{
+		decode: unmarshalEntry[json.RawMessage],
+		add:    func(json.RawMessage) {},
+		result: func() map[string]float64 {
+			fmt.Println("To be implemented")
+			return nil
+		},
+	}
+}
+
+func (currentProcessor) Merge(parts []Part) Part {
+	return Part{}
+}
+
+func (currentProcessor) Rollup(parts []Part) map[string]float64 {
+	return nil
+}
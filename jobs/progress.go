@@ -0,0 +1,207 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"project/redact"
+	"sync"
+	"time"
+)
+
+const (
+	EVENT_PI       = "pi"       // one pi succeeded or failed
+	EVENT_COOLDOWN = "cooldown" // the rate limit was reached
+	EVENT_RETRY    = "retry"    // a window failed and is retried in halves
+	EVENT_COMPLETE = "complete" // the job finished, Status is its status
+
+	SPINNER_INTERVAL = 100 * time.Millisecond
+)
+
+// Event is one step of a run. Total, Done and Failed are the counts once it happened.
+type Event struct {
+	Type       string    `json:"type"`
+	Time       time.Time `json:"time"`
+	PiId       int       `json:"piId,omitempty"`
+	POP        string    `json:"pop,omitempty"`
+	Status     string    `json:"status,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	ErrorClass string    `json:"errorClass,omitempty"`
+	Attempts   int       `json:"attempts,omitempty"`
+	Windows    int       `json:"windows,omitempty"`
+	// The window of a retry
+	From int64 `json:"from,omitempty"`
+	To   int64 `json:"to,omitempty"`
+	// Pis started and seconds to wait of a cooldown
+	Started int `json:"started,omitempty"`
+	Seconds int `json:"seconds,omitempty"`
+
+	Total  int `json:"total"`
+	Done   int `json:"done"`
+	Failed int `json:"failed"`
+}
+
+// Progress keeps the events of the runs of a context, see WithProgress. The console
+// reporter and the job events stream both read them. A nil Progress records nothing.
+type Progress struct {
+	mu                  sync.Mutex
+	total, done, failed int
+	events              []Event
+	wake                chan struct{} // closed on every event
+	completed           bool
+}
+
+type progressKey struct{}
+
+// WithProgress makes every run started with ctx record its events in p.
+func WithProgress(ctx context.Context, p *Progress) context.Context {
+	return context.WithValue(ctx, progressKey{}, p)
+}
+
+func progressFrom(ctx context.Context) *Progress {
+	p, _ := ctx.Value(progressKey{}).(*Progress)
+	return p
+}
+
+// Counts returns the pis to fetch, those done and those of them that failed.
+func (p *Progress) Counts() (total int, done int, failed int) {
+	if p == nil {
+		return 0, 0, 0
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.total, p.done, p.failed
+}
+
+// Events returns the events from index on, a channel closed on the next event and
+// whether the complete event was recorded.
+func (p *Progress) Events(from int) ([]Event, <-chan struct{}, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.wake == nil {
+		p.wake = make(chan struct{})
+	}
+
+	from = min(max(from, 0), len(p.events))
+
+	return append([]Event(nil), p.events[from:]...), p.wake, p.completed
+}
+
+func (p *Progress) publish(event Event) {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	switch event.Type {
+	case EVENT_PI:
+		p.done++
+		if event.Status != "success" {
+			p.failed++
+		}
+	case EVENT_COMPLETE:
+		p.completed = true
+	}
+
+	event.Time = time.Now()
+	event.Error = redact.String(event.Error)
+	event.Total, event.Done, event.Failed = p.total, p.done, p.failed
+
+	p.events = append(p.events, event)
+
+	if p.wake != nil {
+		close(p.wake)
+	}
+	p.wake = make(chan struct{})
+}
+
+func (p *Progress) add(pis int) {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	p.total += pis
+	p.mu.Unlock()
+}
+
+func (p *Progress) finish(result ApiResponse) {
+	p.publish(Event{
+		Type:       EVENT_PI,
+		PiId:       result.PID,
+		POP:        result.POP,
+		Status:     result.Status,
+		Error:      result.Error,
+		ErrorClass: result.ErrorClass,
+		Attempts:   result.Attempts,
+		Windows:    result.Windows,
+	})
+}
+
+func (p *Progress) complete(status string, err string) {
+	p.publish(Event{Type: EVENT_COMPLETE, Status: status, Error: err})
+}
+
+// report prints the events from now on to out, with a spinner while waiting for the
+// next one. stop prints the events left and returns.
+func (p *Progress) report(out io.Writer) (stop func()) {
+	p.mu.Lock()
+	next := len(p.events)
+	p.mu.Unlock()
+
+	stopped, exited := make(chan struct{}), make(chan struct{})
+
+	go func() {
+		defer close(exited)
+
+		spinners := []string{"-", "\\", "|", "/"}
+		ticker := time.NewTicker(SPINNER_INTERVAL)
+		defer ticker.Stop()
+
+		for i := 0; ; i++ {
+			events, wake, _ := p.Events(next)
+			next += len(events)
+
+			for _, event := range events {
+				printEvent(out, event)
+			}
+
+			select {
+			case <-wake:
+			case <-ticker.C:
+				fmt.Fprintf(out, "\r %s", spinners[i%len(spinners)])
+			case <-stopped:
+				events, _, _ := p.Events(next)
+				for _, event := range events {
+					printEvent(out, event)
+				}
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(stopped)
+		<-exited
+	}
+}
+
+func printEvent(out io.Writer, event Event) {
+	switch event.Type {
+	case EVENT_PI:
+		mark := "✅"
+		if event.Status != "success" {
+			mark = "❌"
+		}
+		fmt.Fprintf(out, "\r %d/%d | %s %s \n", event.Done, event.Total, event.POP, mark)
+	case EVENT_COOLDOWN:
+		fmt.Fprintf(out, "\nProcessing %d/%d ⚡ Rate limit reached, cooling down for %d seconds...\n", event.Started, event.Total, event.Seconds)
+	case EVENT_RETRY:
+		fmt.Fprintf(out, "\r ⚠️ %s: %s, retrying in smaller windows\n", event.POP, event.Error)
+	}
+}
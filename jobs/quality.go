@@ -0,0 +1,489 @@
+package jobs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"project/redact"
+	"sort"
+	"strings"
+)
+
+const (
+	// Expected seconds between two samples when the system does not say
+	DEFAULT_SAMPLE_SECONDS      = 60
+	QUALITY_GAP_MINUTES_DEFAULT = 10.0
+)
+
+var qualityGapMinutes = QUALITY_GAP_MINUTES_DEFAULT
+
+// SetQualityGapMinutes sets how long samples can be apart before it counts as a gap.
+func SetQualityGapMinutes(minutes float64) error {
+	if minutes <= 0 {
+		return fmt.Errorf("the gap threshold must be positive")
+	}
+
+	qualityGapMinutes = minutes
+
+	return nil
+}
+
+// KeyedProcessor is a Processor that says which entry keys it reads, so that the data
+// quality report can tell when they are missing.
+type KeyedProcessor interface {
+	Processor
+	Keys() []string
+}
+
+// DataQuality describes the log entries of one pi over the requested window.
+type DataQuality struct {
+	Samples              int     `json:"samples"`
+	ExpectedIntervalSecs float64 `json:"expectedIntervalSecs"`
+	MedianIntervalSecs   float64 `json:"medianIntervalSecs"`
+	Gaps                 int     `json:"gaps"`
+	LongestGapMinutes    float64 `json:"longestGapMinutes"`
+	CoveragePct          float64 `json:"coveragePct"`
+	OutOfOrder           int     `json:"outOfOrder"`
+	DuplicateTimestamps  int     `json:"duplicateTimestamps"`
+	// Entries missing each key the processor reads
+	MissingKeys map[string]int `json:"missingKeys,omitempty"`
+	Keys        []string       `json:"keys,omitempty"`
+	// Keys never seen by earlier runs into the same output, see writeQualityReport
+	NewKeys []string `json:"newKeys,omitempty"`
+	// Entries the processor skipped, see ValidationError
+	InvalidEntries int    `json:"invalidEntries,omitempty"`
+	Validation     string `json:"validation,omitempty"`
+}
+
+func (sys *System) sampleSeconds(mode string) float64 {
+	if seconds := sys.SampleSeconds[mode]; seconds > 0 {
+		return float64(seconds)
+	}
+
+	return DEFAULT_SAMPLE_SECONDS
+}
+
+// qualityAggregator looks at the entries of [start, end) as they stream in, in the order
+// the API sent them. It keeps the last timestamp and a histogram of the intervals rather
+// than the timestamps, so that its memory does not grow with the samples.
+type qualityAggregator struct {
+	expectedSecs float64
+	requiredKeys []string
+	state        qualityState
+}
+
+// qualityState is what the quality of an interval is derived from. Samples older than the
+// last one are out of order and left out of the intervals and gaps, samples at the same
+// timestamp as the last one are duplicates.
+type qualityState struct {
+	Start   int64 `json:"start"`
+	End     int64 `json:"end"`
+	Samples int   `json:"samples"`
+	First   int64 `json:"first"`
+	Last    int64 `json:"last"`
+	// Intervals between in order samples, see intervalBin
+	Intervals map[int64]int `json:"intervals"`
+	// Gaps between samples, those at the edges of [Start, End) are added by Result
+	Gaps        int64           `json:"gaps"`
+	GapSeconds  int64           `json:"gapSeconds"`
+	LongestGap  int64           `json:"longestGap"`
+	OutOfOrder  int             `json:"outOfOrder"`
+	Duplicates  int             `json:"duplicates"`
+	MissingKeys map[string]int  `json:"missingKeys"`
+	Keys        map[string]bool `json:"keys"`
+}
+
+func newQualityAggregator(start int64, end int64, expectedSecs float64, requiredKeys []string) *qualityAggregator {
+	return &qualityAggregator{
+		expectedSecs: expectedSecs,
+		requiredKeys: requiredKeys,
+		state:        qualityState{Start: start, End: end, Intervals: map[int64]int{}, MissingKeys: map[string]int{}, Keys: map[string]bool{}},
+	}
+}
+
+// intervalBin rounds an interval to 3 significant digits: exact under 1000 s, within
+// 0.5% above, so that the histogram stays small whatever the intervals.
+func intervalBin(seconds int64) int64 {
+	step := int64(1)
+	for seconds/step >= 1000 {
+		step *= 10
+	}
+
+	return (seconds + step/2) / step * step
+}
+
+func (q *qualityAggregator) Add(raw json.RawMessage) {
+	var entry map[string]json.RawMessage
+
+	// Entries that are not objects are reported by the processor's validation
+	json.Unmarshal(raw, &entry)
+
+	for key := range entry {
+		q.state.Keys[key] = true
+	}
+
+	// An explicit null is as good as missing
+	for _, key := range q.requiredKeys {
+		if value, ok := entry[key]; !ok || string(value) == "null" {
+			q.state.MissingKeys[key]++
+		}
+	}
+
+	ts, ok := entryTimestamp(raw)
+	if !ok {
+		return
+	}
+
+	q.state.sample(ts)
+}
+
+// sample adds a sample at ts
+func (s *qualityState) sample(ts int64) {
+	switch {
+	case s.Samples == 0:
+		s.First, s.Last = ts, ts
+	case ts == s.Last:
+		s.Duplicates++
+		return
+	case ts < s.Last:
+		s.OutOfOrder++
+	default:
+		s.step(ts - s.Last)
+		s.Last = ts
+	}
+
+	s.Samples++
+}
+
+// step records the interval between two in order samples
+func (s *qualityState) step(seconds int64) {
+	s.Intervals[intervalBin(seconds)]++
+
+	if float64(seconds) > qualityGapMinutes*60 {
+		s.Gaps++
+		s.GapSeconds += seconds
+		s.LongestGap = max(s.LongestGap, seconds)
+	}
+}
+
+// absorb adds the entries of the next window of the same pi
+func (q *qualityAggregator) absorb(next *qualityAggregator) {
+	q.state.absorb(next.state)
+}
+
+// absorb adds the state of the interval following s, as if its samples had followed
+func (s *qualityState) absorb(next qualityState) {
+	switch {
+	case next.Samples == 0:
+	case s.Samples == 0:
+		s.First, s.Last = next.First, next.Last
+	case next.First == s.Last:
+		s.Duplicates++
+		next.Samples--
+		s.Last = max(s.Last, next.Last)
+	case next.First < s.Last:
+		s.OutOfOrder++
+		s.Last = max(s.Last, next.Last)
+	default:
+		s.step(next.First - s.Last)
+		s.Last = next.Last
+	}
+
+	s.Samples += next.Samples
+	s.End = next.End
+
+	for interval, count := range next.Intervals {
+		s.Intervals[interval] += count
+	}
+
+	s.Gaps += next.Gaps
+	s.GapSeconds += next.GapSeconds
+	s.LongestGap = max(s.LongestGap, next.LongestGap)
+	s.OutOfOrder += next.OutOfOrder
+	s.Duplicates += next.Duplicates
+
+	for key, count := range next.MissingKeys {
+		s.MissingKeys[key] += count
+	}
+
+	for key := range next.Keys {
+		s.Keys[key] = true
+	}
+}
+
+func (q *qualityAggregator) Result() *DataQuality {
+	s := q.state
+
+	quality := &DataQuality{
+		Samples:              s.Samples,
+		ExpectedIntervalSecs: q.expectedSecs,
+		OutOfOrder:           s.OutOfOrder,
+		DuplicateTimestamps:  s.Duplicates,
+	}
+
+	for key := range s.Keys {
+		quality.Keys = append(quality.Keys, key)
+	}
+	sort.Strings(quality.Keys)
+
+	if len(s.MissingKeys) > 0 {
+		quality.MissingKeys = map[string]int{}
+		for key, count := range s.MissingKeys {
+			quality.MissingKeys[key] = count
+		}
+	}
+
+	if len(s.Intervals) > 0 {
+		intervals := map[float64]int{}
+		for interval, count := range s.Intervals {
+			intervals[float64(interval)] = count
+		}
+
+		quality.MedianIntervalSecs = countedPercentile(intervals, 50)
+	}
+
+	if s.End <= s.Start {
+		return quality
+	}
+
+	if s.Samples == 0 {
+		quality.Gaps = 1
+		quality.LongestGapMinutes = float64(s.End-s.Start) / 60
+		return quality
+	}
+
+	gaps, missing, longest := s.Gaps, s.GapSeconds, s.LongestGap
+
+	// Gaps at both ends of the window
+	for _, edge := range []int64{s.First - s.Start, s.End - s.Last} {
+		if float64(edge) > qualityGapMinutes*60 {
+			gaps++
+			missing += edge
+			longest = max(longest, edge)
+		}
+	}
+
+	quality.Gaps = int(gaps)
+	quality.LongestGapMinutes = float64(longest) / 60
+	quality.CoveragePct = max(0, 100-float64(missing)/float64(s.End-s.Start)*100)
+
+	return quality
+}
+
+// measureQuality is the data quality of entries already in memory
+func measureQuality(entries []json.RawMessage, start int64, end int64, expectedSecs float64, requiredKeys []string) *DataQuality {
+	q := newQualityAggregator(start, end, expectedSecs, requiredKeys)
+
+	for _, entry := range entries {
+		q.Add(entry)
+	}
+
+	return q.Result()
+}
+
+// mergeQuality combines the quality of consecutive intervals of one pi without their
+// states, seconds being their lengths. A gap across two intervals counts in both and the
+// median interval is averaged by samples, the rest adds up exactly.
+func mergeQuality(parts []*DataQuality, seconds []int64) *DataQuality {
+	merged := &DataQuality{MissingKeys: map[string]int{}}
+	keys := map[string]bool{}
+	covered, total, intervals := 0.0, 0.0, 0.0
+	validation := []string{}
+
+	for i, part := range parts {
+		if part == nil {
+			continue
+		}
+
+		merged.ExpectedIntervalSecs = part.ExpectedIntervalSecs
+		merged.Samples += part.Samples
+		merged.Gaps += part.Gaps
+		merged.LongestGapMinutes = max(merged.LongestGapMinutes, part.LongestGapMinutes)
+		merged.OutOfOrder += part.OutOfOrder
+		merged.DuplicateTimestamps += part.DuplicateTimestamps
+		merged.InvalidEntries += part.InvalidEntries
+
+		for key, count := range part.MissingKeys {
+			merged.MissingKeys[key] += count
+		}
+
+		for _, key := range part.Keys {
+			keys[key] = true
+		}
+
+		if part.Validation != "" {
+			validation = append(validation, part.Validation)
+		}
+
+		covered += part.CoveragePct * float64(seconds[i])
+		total += float64(seconds[i])
+
+		merged.MedianIntervalSecs += part.MedianIntervalSecs * float64(part.Samples)
+		intervals += float64(part.Samples)
+	}
+
+	if total > 0 {
+		merged.CoveragePct = covered / total
+	}
+
+	if intervals > 0 {
+		merged.MedianIntervalSecs /= intervals
+	}
+
+	for key := range keys {
+		merged.Keys = append(merged.Keys, key)
+	}
+	sort.Strings(merged.Keys)
+
+	if len(merged.MissingKeys) == 0 {
+		merged.MissingKeys = nil
+	}
+
+	merged.Validation = strings.Join(validation, "; ")
+
+	return merged
+}
+
+func requiredKeys(processor Processor) []string {
+	keys := []string{"timestamp"}
+
+	if keyed, ok := processor.(KeyedProcessor); ok {
+		keys = append(keys, keyed.Keys()...)
+	}
+
+	return keys
+}
+
+// qualityReportPath maps "ipms.csv" to "ipms.quality.csv"
+func qualityReportPath(outputFile string) string {
+	ext := filepath.Ext(outputFile)
+
+	return strings.TrimSuffix(outputFile, ext) + ".quality" + ext
+}
+
+// schemaPath maps "ipms.csv" to "ipms.schema.json"
+func schemaPath(outputFile string) string {
+	return strings.TrimSuffix(outputFile, filepath.Ext(outputFile)) + ".schema.json"
+}
+
+type entrySchema struct {
+	Keys []string `json:"keys"`
+}
+
+// markNewKeys fills NewKeys with the keys missing from the schema file of earlier runs,
+// then adds them to it. The first run only records the schema.
+func markNewKeys(results []ApiResponse, schemaFile string) error {
+	var schema entrySchema
+
+	data, err := os.ReadFile(schemaFile)
+	firstRun := errors.Is(err, os.ErrNotExist)
+
+	if err != nil && !firstRun {
+		return err
+	}
+
+	if !firstRun {
+		if err := json.Unmarshal(data, &schema); err != nil {
+			return fmt.Errorf("reading schema %s: %w", schemaFile, err)
+		}
+	}
+
+	known := toStringSet(schema.Keys)
+	added := map[string]bool{}
+
+	for _, result := range results {
+		if result.Quality == nil {
+			continue
+		}
+
+		for _, key := range result.Quality.Keys {
+			if known[key] {
+				continue
+			}
+
+			added[key] = true
+
+			if !firstRun {
+				result.Quality.NewKeys = append(result.Quality.NewKeys, key)
+			}
+		}
+	}
+
+	if len(added) == 0 && !firstRun {
+		return nil
+	}
+
+	for key := range added {
+		schema.Keys = append(schema.Keys, key)
+	}
+	sort.Strings(schema.Keys)
+
+	if data, err = json.MarshalIndent(schema, "", "  "); err != nil {
+		return err
+	}
+
+	return os.WriteFile(schemaFile, data, 0644)
+}
+
+func toStringSet(values []string) map[string]bool {
+	set := map[string]bool{}
+	for _, value := range values {
+		set[value] = true
+	}
+
+	return set
+}
+
+func qualityRecords(results []ApiResponse) [][]string {
+	records := [][]string{{
+		"PI ID", "POP", "Status", "Samples", "Expected Interval (s)", "Median Interval (s)",
+		"Gaps", "Longest Gap (min)", "Coverage %", "Out Of Order", "Duplicate Timestamps",
+		"Missing Keys", "New Keys", "Invalid Entries", "Validation",
+	}}
+
+	for _, result := range results {
+		record := []string{fmt.Sprintf("%d", result.PID), result.POP, result.Status}
+
+		if quality := result.Quality; quality != nil {
+			missing := []string{}
+			for key, count := range quality.MissingKeys {
+				missing = append(missing, fmt.Sprintf("%s:%d", key, count))
+			}
+			sort.Strings(missing)
+
+			record = append(record,
+				fmt.Sprintf("%d", quality.Samples),
+				fmt.Sprintf("%.0f", quality.ExpectedIntervalSecs),
+				fmt.Sprintf("%.0f", quality.MedianIntervalSecs),
+				fmt.Sprintf("%d", quality.Gaps),
+				fmt.Sprintf("%.2f", quality.LongestGapMinutes),
+				fmt.Sprintf("%.2f", quality.CoveragePct),
+				fmt.Sprintf("%d", quality.OutOfOrder),
+				fmt.Sprintf("%d", quality.DuplicateTimestamps),
+				strings.Join(missing, " "),
+				strings.Join(quality.NewKeys, " "),
+				fmt.Sprintf("%d", quality.InvalidEntries),
+				redact.String(quality.Validation),
+			)
+		}
+
+		records = append(records, record)
+	}
+
+	return records
+}
+
+// writeQualityReport writes the data quality of every pi next to outputFile.
+func (sys *System) writeQualityReport(results []ApiResponse, outputFile string) {
+	if err := markNewKeys(results, schemaPath(outputFile)); err != nil {
+		fmt.Println("⚠️ Schema drift check failed:", err)
+	}
+
+	qualityFile := qualityReportPath(outputFile)
+
+	sys.writeCsvRecords(qualityRecords(results), qualityFile)
+
+	fmt.Printf("Data quality has been written to %s\n", qualityFile)
+}
@@ -0,0 +1,102 @@
+package jobs
+
+import (
+	"math"
+	"path/filepath"
+	"testing"
+)
+
+func TestMeasureQuality(t *testing.T) {
+	entries := []map[string]any{
+		{"timestamp": 0.0, "temperature_0": 20.0},
+		{"timestamp": 60.0, "temperature_0": 21.0},
+		{"timestamp": 60.0, "temperature_0": 21.0},
+		{"timestamp": 30.0},
+		{"timestamp": 900.0, "temperature_0": 22.0},
+	}
+
+	quality := measureQuality(rawEntries(t, entries), 0, 1800, 60, []string{"timestamp", "temperature_0"})
+
+	if quality.Samples != 4 || quality.DuplicateTimestamps != 1 || quality.OutOfOrder != 1 {
+		t.Errorf("quality = %+v; want 4 samples, 1 duplicate and 1 out of order", quality)
+	}
+
+	// 60 -> 900 and 900 -> the end of the window
+	if quality.Gaps != 2 || quality.LongestGapMinutes != 15 || math.Abs(quality.CoveragePct-100.0/30) > 1e-9 {
+		t.Errorf("quality = %+v; want 2 gaps, the longest 15 minutes and 3.33%% coverage", quality)
+	}
+
+	// 60 s and 840 s, the sample at 30 being out of order
+	if quality.MedianIntervalSecs != 450 || quality.MissingKeys["temperature_0"] != 1 {
+		t.Errorf("quality = %+v; want a 450s median interval and temperature_0 missing once", quality)
+	}
+
+	if empty := measureQuality(nil, 0, 600, 60, nil); empty.Samples != 0 || empty.CoveragePct != 0 {
+		t.Errorf("no entries = %+v; want 0%% coverage", empty)
+	}
+}
+
+func TestQualityAbsorbsWindows(t *testing.T) {
+	entries := []map[string]any{}
+	for ts := 0; ts < 7200; ts += 60 {
+		// An hour of outage in the middle, across the windows
+		if ts < 3000 || ts >= 4800 {
+			entries = append(entries, map[string]any{"timestamp": float64(ts)})
+		}
+	}
+	entries = append(entries, map[string]any{"timestamp": 7140.0})
+
+	raw := rawEntries(t, entries)
+	whole := measureQuality(raw, 0, 7200, 60, nil)
+
+	merged := newQualityAggregator(0, 7200, 60, nil)
+	for _, window := range [][2]int64{{0, 3600}, {3600, 5400}, {5400, 7200}} {
+		part := newQualityAggregator(window[0], window[1], 60, nil)
+		for _, entry := range raw {
+			if ts, _ := entryTimestamp(entry); ts >= window[0] && ts < window[1] {
+				part.Add(entry)
+			}
+		}
+		merged.absorb(part)
+	}
+
+	if got := merged.Result(); got.Samples != whole.Samples || got.Gaps != 1 || got.LongestGapMinutes != 31 || got.CoveragePct != whole.CoveragePct ||
+		got.MedianIntervalSecs != 60 || got.DuplicateTimestamps != 1 {
+		t.Errorf("merged = %+v; want %+v", got, whole)
+	}
+
+	// A day of 1 s samples keeps a single interval
+	day := newQualityAggregator(0, 86400, 1, nil)
+	for ts := int64(0); ts < 86400; ts++ {
+		day.state.sample(ts)
+	}
+
+	if len(day.state.Intervals) != 1 || day.Result().Samples != 86400 {
+		t.Errorf("day = %d intervals, %+v", len(day.state.Intervals), day.Result())
+	}
+}
+
+func TestMarkNewKeys(t *testing.T) {
+	schemaFile := filepath.Join(t.TempDir(), "opms.schema.json")
+
+	first := []ApiResponse{{PID: 1, Quality: &DataQuality{Keys: []string{"temperature_0", "timestamp"}}}}
+	if err := markNewKeys(first, schemaFile); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(first[0].Quality.NewKeys) != 0 {
+		t.Errorf("first run new keys = %v; want none", first[0].Quality.NewKeys)
+	}
+
+	second := []ApiResponse{
+		{PID: 1, Quality: &DataQuality{Keys: []string{"humidity", "temperature_0", "timestamp"}}},
+		{PID: 2, Status: "error"},
+	}
+	if err := markNewKeys(second, schemaFile); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := second[0].Quality.NewKeys; len(got) != 1 || got[0] != "humidity" {
+		t.Errorf("second run new keys = %v; want [humidity]", got)
+	}
+}
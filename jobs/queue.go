@@ -0,0 +1,608 @@
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"project/database"
+	"project/models"
+	"project/redact"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	QUEUE_VISIBILITY_DEFAULT = 2 * time.Minute
+	QUEUE_POLL_DEFAULT       = 5 * time.Second
+	// Claims of a unit whose worker stopped heartbeating before it fails
+	QUEUE_MAX_ATTEMPTS = 3
+)
+
+// JobQueue is the JobRunner of the durable queue: jobs and their units live in
+// Postgres and any number of workers, see Worker, crawl them.
+type JobQueue struct {
+	db *sql.DB
+	// How often Events looks for newly finished units
+	poll time.Duration
+}
+
+func NewJobQueue(db *sql.DB) *JobQueue {
+	return &JobQueue{db: db, poll: time.Second}
+}
+
+// unitIntervals cuts [start, end) in units of unitSeconds, on bucket boundaries when
+// bucketing is on. A unit is one request range of fetch, each window merged anyway.
+func unitIntervals(startTime int64, endTime int64, unitSeconds int64, b Bucketing) [][2]int64 {
+	if unitSeconds <= 0 {
+		return [][2]int64{{startTime, endTime}}
+	}
+
+	if b.Enabled() {
+		return splitBucketedRange(startTime, endTime, unitSeconds, b)
+	}
+
+	intervals := [][2]int64{}
+	for from := startTime; from < endTime; from += unitSeconds {
+		intervals = append(intervals, [2]int64{from, min(from+unitSeconds, endTime)})
+	}
+
+	return intervals
+}
+
+// Submit validates spec, selects its pis and queues one unit per pi and interval.
+func (q *JobQueue) Submit(spec JobSpec) (Job, error) {
+	if err := spec.validate(); err != nil {
+		return Job{}, err
+	}
+
+	pis, err := spec.sys.getPis(spec.Selection)
+	if err != nil {
+		return Job{}, err
+	}
+
+	units := []models.JobUnit{}
+
+	for _, pi := range pis {
+		for _, interval := range unitIntervals(spec.startTime, spec.endTime, spec.UnitSeconds, spec.bucketing) {
+			units = append(units, models.JobUnit{PiId: pi.Id, Pop: pi.Name, Mode: spec.Mode, Start: interval[0], End: interval[1]})
+		}
+	}
+
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return Job{}, err
+	}
+
+	id, err := newJobId()
+	if err != nil {
+		return Job{}, err
+	}
+
+	if err := database.EnqueueJob(q.db, models.QueuedJob{Id: id, Spec: data, CreatedAt: time.Now()}, units); err != nil {
+		return Job{}, err
+	}
+
+	fmt.Printf("Queued job %s with %d units\n", id, len(units))
+
+	return q.Get(id)
+}
+
+func queuedSpec(job *models.QueuedJob) (JobSpec, error) {
+	var spec JobSpec
+
+	if err := json.Unmarshal(job.Spec, &spec); err != nil {
+		return spec, fmt.Errorf("reading the spec of job %s: %w", job.Id, err)
+	}
+
+	return spec, spec.validate()
+}
+
+func (q *JobQueue) queuedJob(id string) (*models.QueuedJob, error) {
+	job, err := database.GetQueuedJob(q.db, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrJobNotFound
+	}
+
+	return job, err
+}
+
+// Get returns the job with its unit counts as Total, Done and Failed.
+func (q *JobQueue) Get(id string) (Job, error) {
+	queued, err := q.queuedJob(id)
+	if err != nil {
+		return Job{}, err
+	}
+
+	// A spec that no longer validates, a system gone from SYSTEMS_FILE say, is still shown
+	spec, _ := queuedSpec(queued)
+
+	job := Job{
+		Id:         queued.Id,
+		Spec:       spec,
+		Status:     queued.Status,
+		Error:      queued.Error,
+		Total:      queued.Units,
+		Done:       queued.Done,
+		Failed:     queued.Failed,
+		OutputFile: queued.OutputFile,
+		CreatedAt:  queued.CreatedAt,
+		StartedAt:  queued.StartedAt,
+		FinishedAt: queued.FinishedAt,
+	}
+
+	if queued.Failed > 0 {
+		failed, err := database.JobUnits(q.db, id, models.UNIT_FAILED)
+		if err != nil {
+			return job, err
+		}
+
+		for _, unit := range failed[:min(len(failed), JOB_ERRORS_MAX)] {
+			job.Errors = append(job.Errors, redact.String(fmt.Sprintf("pi %d: %s", unit.PiId, unitResult(unit).Error)))
+		}
+	}
+
+	return job, nil
+}
+
+// Cancel stops a queued or running job, the units running stop at their next heartbeat.
+func (q *JobQueue) Cancel(id string) (Job, error) {
+	if _, err := q.queuedJob(id); err != nil {
+		return Job{}, err
+	}
+
+	canceled, err := database.CancelQueuedJob(q.db, id)
+	if err != nil {
+		return Job{}, err
+	}
+
+	if !canceled {
+		return Job{}, ErrJobFinished
+	}
+
+	return q.Get(id)
+}
+
+// WriteResult writes the merged results of a finished job. A canceled job was never
+// merged, its finished units are merged on the fly.
+func (q *JobQueue) WriteResult(id string, format string, w io.Writer) error {
+	queued, err := q.queuedJob(id)
+	if err != nil {
+		return err
+	}
+
+	if !(Job{Status: queued.Status}).finished() {
+		return ErrJobNotFinished
+	}
+
+	spec, err := queuedSpec(queued)
+	if err != nil {
+		return err
+	}
+
+	var results []ApiResponse
+
+	data, err := database.QueuedJobResult(q.db, id)
+	if err != nil {
+		return err
+	}
+
+	if data != nil {
+		err = json.Unmarshal(data, &results)
+	} else {
+		results, err = q.mergeUnits(spec, id)
+	}
+	if err != nil {
+		return err
+	}
+
+	return writeJobResult(w, format, spec, results)
+}
+
+// Events replays the units in the order they were numbered, see NumberJobEvents, then
+// the completion. The returned channel is closed after a poll interval, the queue
+// having no way to say when another worker finished a unit.
+func (q *JobQueue) Events(id string, from int) ([]Event, <-chan struct{}, bool, error) {
+	queued, err := q.queuedJob(id)
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	if err := database.NumberJobEvents(q.db, id); err != nil {
+		return nil, nil, false, err
+	}
+
+	units, err := database.JobUnits(q.db, id, "")
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	events := []Event{}
+	done, failed := 0, 0
+
+	for _, unit := range units {
+		// Finished since it was numbered, it comes on the next poll
+		if unit.Event == 0 {
+			break
+		}
+
+		result := unitResult(unit)
+
+		done++
+		if result.Status != "success" {
+			failed++
+		}
+
+		events = append(events, Event{
+			Type:       EVENT_PI,
+			Time:       *unit.FinishedAt,
+			PiId:       unit.PiId,
+			POP:        unit.Pop,
+			Status:     result.Status,
+			Error:      redact.String(result.Error),
+			ErrorClass: result.ErrorClass,
+			Attempts:   unit.Attempts,
+			Windows:    result.Windows,
+			From:       unit.Start,
+			To:         unit.End,
+			Total:      len(units),
+			Done:       done,
+			Failed:     failed,
+		})
+	}
+
+	completed := (Job{Status: queued.Status}).finished()
+
+	if completed {
+		events = append(events, Event{
+			Type:   EVENT_COMPLETE,
+			Time:   *queued.FinishedAt,
+			Status: queued.Status,
+			Error:  queued.Error,
+			Total:  len(units),
+			Done:   done,
+			Failed: failed,
+		})
+	}
+
+	wake := make(chan struct{})
+	time.AfterFunc(q.poll, func() { close(wake) })
+
+	from = min(max(from, 0), len(events))
+
+	return events[from:], wake, completed, nil
+}
+
+// unitResult is the result of a finished unit, a failure for units that never ran
+func unitResult(unit models.JobUnit) ApiResponse {
+	var result ApiResponse
+
+	if unit.Result != nil && json.Unmarshal(unit.Result, &result) == nil {
+		return result
+	}
+
+	result = ApiResponse{Status: "error", POP: unit.Pop, PID: unit.PiId, Attempts: unit.Attempts}
+
+	switch unit.Status {
+	case models.UNIT_CANCELED:
+		result.Error, result.ErrorClass = "job canceled", ERR_CLASS_CANCELED
+	case models.UNIT_FAILED:
+		result.Error, result.ErrorClass = fmt.Sprintf("abandoned after %d attempts", unit.Attempts), ERR_CLASS_REQUEST
+	default:
+		result.Error, result.ErrorClass = "not finished", ERR_CLASS_CANCELED
+	}
+
+	return result
+}
+
+func (q *JobQueue) mergeUnits(spec JobSpec, id string) ([]ApiResponse, error) {
+	units, err := database.JobUnits(q.db, id, "")
+	if err != nil {
+		return nil, err
+	}
+
+	processor, err := spec.sys.processor(spec.Mode)
+	if err != nil {
+		return nil, err
+	}
+
+	return mergeUnits(processor, spec.bucketing, units), nil
+}
+
+// mergeUnits merges the units of every pi into one result, as fetch merges windows. A pi
+// with a failed unit fails as a whole, so that rerun-failed crawls its range again.
+func mergeUnits(processor Processor, b Bucketing, units []models.JobUnit) []ApiResponse {
+	byPi := map[int][]models.JobUnit{}
+	for _, unit := range units {
+		byPi[unit.PiId] = append(byPi[unit.PiId], unit)
+	}
+
+	results := []ApiResponse{}
+
+	for _, piUnits := range byPi {
+		sort.Slice(piUnits, func(i, j int) bool { return piUnits[i].Start < piUnits[j].Start })
+
+		parts := []ApiResponse{}
+		for _, unit := range piUnits {
+			parts = append(parts, unitResult(unit))
+		}
+
+		results = append(results, mergeUnitResults(processor, b, piUnits, parts))
+	}
+
+	sort.Slice(results, func(i, j int) bool { return results[i].PID < results[j].PID })
+
+	return results
+}
+
+func mergeUnitResults(processor Processor, b Bucketing, units []models.JobUnit, parts []ApiResponse) ApiResponse {
+	attempts, windows := 0, 0
+	for _, part := range parts {
+		attempts += part.Attempts
+		windows += part.Windows
+	}
+
+	for _, part := range parts {
+		if part.Status != "success" {
+			part.Attempts, part.Windows = attempts, windows
+			return part
+		}
+	}
+
+	if len(parts) == 1 {
+		return parts[0]
+	}
+
+	merged := parts[0]
+	merged.Attempts, merged.Windows = attempts, windows
+
+	data, buckets := []Part{}, []BucketResult{}
+
+	for _, part := range parts {
+		data = append(data, Part{Metrics: part.ProcessedData, Partial: part.metricsPartial()})
+		buckets = append(buckets, part.Buckets...)
+	}
+
+	metrics := processor.Merge(data)
+	quality, state := mergeUnitQuality(units, parts)
+
+	merged.ProcessedData, merged.Quality, merged.Partial = metrics.Metrics, quality, &ResultPartial{Metrics: metrics.Partial, Quality: state}
+	merged.Buckets = nil
+
+	if b.Enabled() {
+		merged.Buckets = mergeBuckets(processor, buckets)
+	}
+
+	return merged
+}
+
+// mergeUnitQuality merges the data quality of the units of a pi from their states, as
+// fetch merges windows. Units without one fall back on mergeQuality.
+func mergeUnitQuality(units []models.JobUnit, parts []ApiResponse) (*DataQuality, *qualityState) {
+	qualities, seconds, exact := []*DataQuality{}, []int64{}, true
+
+	for i, part := range parts {
+		qualities = append(qualities, part.Quality)
+		seconds = append(seconds, units[i].End-units[i].Start)
+		exact = exact && part.Partial != nil && part.Partial.Quality != nil
+	}
+
+	// The validation adds up either way
+	summed := mergeQuality(qualities, seconds)
+	if !exact {
+		return summed, nil
+	}
+
+	merged := newQualityAggregator(units[0].Start, units[len(units)-1].End, summed.ExpectedIntervalSecs, nil)
+	for _, part := range parts {
+		merged.state.absorb(*part.Partial.Quality)
+	}
+
+	quality := merged.Result()
+	quality.InvalidEntries, quality.Validation = summed.InvalidEntries, summed.Validation
+
+	return quality, &merged.state
+}
+
+// Worker claims the units and merges of the durable queue.
+type Worker struct {
+	Name       string
+	Dir        string // the outputs go to Dir/<job id>
+	Visibility time.Duration
+	Poll       time.Duration
+
+	db *sql.DB
+}
+
+func NewWorker(db *sql.DB, name string, dir string) *Worker {
+	return &Worker{Name: name, Dir: dir, Visibility: QUEUE_VISIBILITY_DEFAULT, Poll: QUEUE_POLL_DEFAULT, db: db}
+}
+
+// Run works through the queue with concurrency units at a time until ctx is done. The
+// units running then are put back in the queue.
+func (w *Worker) Run(ctx context.Context, concurrency int) {
+	var wg sync.WaitGroup
+
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for ctx.Err() == nil {
+				worked, err := w.step(ctx)
+				if err != nil {
+					fmt.Println("❌ Worker:", redact.String(err.Error()))
+				}
+
+				if worked && err == nil {
+					continue
+				}
+
+				select {
+				case <-time.After(w.Poll):
+				case <-ctx.Done():
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+}
+
+// step runs one unit or else one merge, it tells whether there was any
+func (w *Worker) step(ctx context.Context) (bool, error) {
+	unit, err := database.ClaimUnit(w.db, w.Name, w.Visibility, QUEUE_MAX_ATTEMPTS)
+	if err != nil {
+		return false, err
+	}
+
+	if unit != nil {
+		return true, w.runUnit(ctx, unit)
+	}
+
+	job, err := database.ClaimMerge(w.db, w.Name, w.Visibility)
+	if err != nil || job == nil {
+		return false, err
+	}
+
+	return true, w.merge(job)
+}
+
+// heartbeat beats every third of the visibility timeout until the returned stop is
+// called, and cancels the returned context once the claim is lost.
+func (w *Worker) heartbeat(ctx context.Context, beat func() error) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	stopped := make(chan struct{})
+
+	go func() {
+		ticker := time.NewTicker(w.Visibility / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := beat(); errors.Is(err, database.ErrUnitLost) {
+					cancel()
+					return
+				} else if err != nil {
+					fmt.Println("⚠️ Heartbeat failed:", redact.String(err.Error()))
+				}
+			case <-stopped:
+				return
+			}
+		}
+	}()
+
+	return ctx, func() {
+		close(stopped)
+		cancel()
+	}
+}
+
+func (w *Worker) runUnit(ctx context.Context, unit *models.JobUnit) error {
+	queued, err := database.GetQueuedJob(w.db, unit.JobId)
+	if err != nil {
+		return err
+	}
+
+	var result ApiResponse
+
+	spec, err := queuedSpec(queued)
+	if err != nil {
+		result = ApiResponse{Status: "error", Error: err.Error(), ErrorClass: ERR_CLASS_REQUEST, POP: unit.Pop, PID: unit.PiId}
+	} else {
+		unitCtx, stop := w.heartbeat(ctx, func() error { return database.HeartbeatUnit(w.db, unit.Id, w.Name) })
+
+		results := make(chan ApiResponse, 1)
+		var wg sync.WaitGroup
+		wg.Add(1)
+
+		spec.sys.fetch(unitCtx, spec.sys.endpoint(unit.PiId, unit.Pop, unit.Mode, unit.Start, unit.End), &wg, results, unit.Mode, spec.bucketing)
+		result = <-results
+
+		stop()
+	}
+
+	// Shutting down, another worker takes the unit over
+	if ctx.Err() != nil {
+		return database.ReleaseUnit(w.db, unit.Id, w.Name)
+	}
+
+	status, mark := models.UNIT_DONE, "✅"
+	if result.Status != "success" {
+		status, mark = models.UNIT_FAILED, "❌"
+	}
+
+	fmt.Printf(" %s | %s %s - %s %s\n", unit.JobId, result.POP,
+		time.Unix(unit.Start, 0).UTC().Format(time.RFC3339), time.Unix(unit.End, 0).UTC().Format(time.RFC3339), mark)
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+
+	return database.FinishUnit(w.db, unit.Id, w.Name, status, data)
+}
+
+// merge writes the outputs of a job whose units are all finished, as a run would.
+func (w *Worker) merge(queued *models.QueuedJob) error {
+	_, stop := w.heartbeat(context.Background(), func() error { return database.HeartbeatJob(w.db, queued.Id, w.Name) })
+	defer stop()
+
+	fail := func(err error) error {
+		return database.FinishJob(w.db, queued.Id, w.Name, JOB_FAILED, redact.String(err.Error()), "", nil)
+	}
+
+	spec, err := queuedSpec(queued)
+	if err != nil {
+		return fail(err)
+	}
+
+	q := &JobQueue{db: w.db}
+
+	results, err := q.mergeUnits(spec, queued.Id)
+	if err != nil {
+		return fail(err)
+	}
+
+	dir := filepath.Join(w.Dir, queued.Id)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fail(err)
+	}
+
+	outputFile := filepath.Join(dir, spec.sys.Name+".csv")
+
+	manifest := spec.manifest(queued.Id, outputFile)
+	if queued.StartedAt != nil {
+		manifest.StartedAt = *queued.StartedAt
+	}
+
+	if spec.bucketing.Enabled() {
+		spec.sys.writeSeries(results, spec.Mode, spec.startTime, spec.endTime, outputFile, spec.bucketing, spec.SeriesFormat)
+	} else {
+		spec.sys.writeRun(results, spec.Mode, spec.startTime, spec.endTime, outputFile)
+	}
+
+	manifest.Finish(results)
+
+	if spec.Sink == JOB_SINK_POSTGRES {
+		if err := StoreResults(w.db, spec.sys, spec.Mode, spec.startTime, spec.endTime, spec.bucketing, results); err != nil {
+			return fail(err)
+		}
+	}
+
+	data, err := json.Marshal(publishedResults(results))
+	if err != nil {
+		return fail(err)
+	}
+
+	fmt.Printf("✅ Job %s merged into %s\n", queued.Id, outputFile)
+
+	return database.FinishJob(w.db, queued.Id, w.Name, JOB_SUCCEEDED, "", outputFile, data)
+}
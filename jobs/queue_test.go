@@ -0,0 +1,72 @@
+package jobs
+
+import (
+	"encoding/json"
+	"project/models"
+	"reflect"
+	"testing"
+)
+
+func TestUnitIntervals(t *testing.T) {
+	if got := unitIntervals(0, 100, 0, Bucketing{}); !reflect.DeepEqual(got, [][2]int64{{0, 100}}) {
+		t.Errorf("whole range = %v", got)
+	}
+
+	if got := unitIntervals(0, 100, 40, Bucketing{}); !reflect.DeepEqual(got, [][2]int64{{0, 40}, {40, 80}, {80, 100}}) {
+		t.Errorf("40s units = %v", got)
+	}
+
+	b, _ := ParseBucketing("1h")
+	if got := unitIntervals(1800, 4*3600, 7200, b); !reflect.DeepEqual(got, [][2]int64{{1800, 7200}, {7200, 14400}}) {
+		t.Errorf("hourly units = %v; want cuts on the hour", got)
+	}
+}
+
+func TestMergeUnits(t *testing.T) {
+	processor, _ := GetProcessor("opms-temp")
+
+	unit := func(piId int, start int64, end int64, status string, result *ApiResponse) models.JobUnit {
+		u := models.JobUnit{PiId: piId, Pop: "HNI000", Start: start, End: end, Status: status, Attempts: 1}
+		if result != nil {
+			u.Result, _ = json.Marshal(result)
+		}
+		return u
+	}
+
+	part := func(min float64, max float64, count float64, coverage float64) *ApiResponse {
+		return &ApiResponse{
+			Status:        "success",
+			PID:           1,
+			Attempts:      1,
+			Windows:       1,
+			ProcessedData: map[string]float64{"t1Min": min, "t1Max": max, "t1Avg": (min + max) / 2, "t1Count": count},
+			Quality:       &DataQuality{Samples: int(count), CoveragePct: coverage, Keys: []string{"timestamp"}},
+		}
+	}
+
+	units := []models.JobUnit{
+		unit(2, 0, 3600, models.UNIT_CANCELED, nil),
+		unit(1, 3600, 10800, models.UNIT_DONE, part(22, 30, 4, 50)),
+		unit(1, 0, 3600, models.UNIT_DONE, part(20, 24, 2, 100)),
+	}
+
+	results := mergeUnits(processor, Bucketing{}, units)
+
+	if len(results) != 2 || results[0].PID != 1 || results[1].PID != 2 {
+		t.Fatalf("results = %+v; want pi 1 then pi 2", results)
+	}
+
+	merged := results[0]
+	if merged.Status != "success" || merged.ProcessedData["t1Min"] != 20 || merged.ProcessedData["t1Max"] != 30 || merged.ProcessedData["t1Count"] != 6 || merged.Windows != 2 {
+		t.Errorf("pi 1 = %+v", merged)
+	}
+
+	// 1h at 100% and 2h at 50%
+	if quality := merged.Quality; quality.Samples != 6 || quality.CoveragePct < 66.6 || quality.CoveragePct > 66.7 {
+		t.Errorf("quality = %+v", quality)
+	}
+
+	if canceled := results[1]; canceled.Status != "error" || canceled.ErrorClass != ERR_CLASS_CANCELED {
+		t.Errorf("pi 2 = %+v; want canceled", canceled)
+	}
+}
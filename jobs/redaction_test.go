@@ -0,0 +1,83 @@
+package jobs
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"project/redact"
+	"project/utils"
+	"strings"
+	"testing"
+)
+
+// TestOutputSinksNeverWriteSecrets pushes a token, a database password and MQTT
+// credentials through every output sink and checks none of them comes out.
+func TestOutputSinksNeverWriteSecrets(t *testing.T) {
+	const token = "eyJhbGciOiJIUzI1NiJ9.crawler-token"
+	const pgPassword = "pg-Sup3rSecret"
+	const mqttUser = "mqtt-crawler"
+	const mqttPassword = "mqtt-Pa55word"
+
+	redact.Register(token, pgPassword, mqttPassword)
+
+	leaks := []string{token, pgPassword, mqttUser, mqttPassword}
+
+	pi := Pi{Id: 7, Name: "HNI0007", BrokerUrl: "mqtt://" + mqttUser + ":" + mqttPassword + "@broker:1883", MqttUser: mqttUser, MqttPassword: mqttPassword}
+
+	piJson, err := json.Marshal(pi)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results := []ApiResponse{
+		{PID: 7, POP: "HNI0007", Status: "error", ErrorClass: ERR_CLASS_AUTH, Error: "login failed with x-access-token: " + token, URL: "https://crawler:" + pgPassword + "@iot/logs/7?token=" + token},
+		{PID: 8, POP: "HNI0008", Status: "error", ErrorClass: ERR_CLASS_NETWORK, Error: "dial postgres://crawler:" + pgPassword + "@db:5432 " + string(piJson)},
+	}
+
+	dir := t.TempDir()
+	outputs := map[string]string{"pi.json": string(piJson)}
+
+	OPMS.writeCsvFile(results, filepath.Join(dir, "opms.csv"), "FAN")
+	IPMS.writeCsvFile(results, filepath.Join(dir, "ipms.csv"), "FAN")
+	writeFailureReport(newFailureReport("opms", "FAN", 0, 1, filepath.Join(dir, "opms.csv"), results))
+
+	for _, file := range []string{"opms.csv", "ipms.csv"} {
+		records, err := readCsvRecords(filepath.Join(dir, file))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var buf bytes.Buffer
+		for _, record := range records {
+			buf.WriteString(strings.Join(record, ",") + "\n")
+		}
+		outputs[file] = buf.String()
+	}
+
+	report, _ := os.ReadFile(filepath.Join(dir, "opms.failures.json"))
+	outputs["opms.failures.json"] = string(report)
+
+	var jobResult bytes.Buffer
+	if err := writeJobResult(&jobResult, JOB_RESULT_JSON, JobSpec{Mode: "FAN", sys: OPMS}, results); err != nil {
+		t.Fatal(err)
+	}
+	outputs["job result"] = jobResult.String()
+
+	var logBuf bytes.Buffer
+	previous := utils.LogOutput
+	utils.LogOutput = &logBuf
+	defer func() { utils.LogOutput = previous }()
+
+	utils.Logln("Connecting to", "host=db port=5432 user=crawler password="+pgPassword+" dbname=crawl")
+	utils.Logf("token %s, pi %+v\n", token, pi)
+	outputs["log"] = logBuf.String()
+
+	for name, output := range outputs {
+		for _, leak := range leaks {
+			if strings.Contains(output, leak) {
+				t.Errorf("%s leaks %q:\n%s", name, leak, output)
+			}
+		}
+	}
+}
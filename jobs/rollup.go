@@ -0,0 +1,96 @@
+package jobs
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+type RollupRow struct {
+	Key        string
+	Pis        int
+	Successful int
+	Metrics    map[string]float64
+}
+
+// Rollup groups the results by a level of their POP name ("region", "province" or
+// "site") and combines the metrics of each group with processor.Rollup. Pis whose
+// name has no value for the level are grouped under "UNKNOWN".
+func Rollup(processor Processor, results []ApiResponse, level string) []RollupRow {
+	groups := map[string]*RollupRow{}
+	parts := map[string][]Part{}
+
+	for _, result := range results {
+		key := ParsePopName(result.POP).Level(level)
+		if key == "" {
+			key = "UNKNOWN"
+		}
+
+		row, ok := groups[key]
+		if !ok {
+			row = &RollupRow{Key: key}
+			groups[key] = row
+		}
+
+		row.Pis++
+
+		if result.Status == "success" {
+			row.Successful++
+			parts[key] = append(parts[key], Part{Metrics: result.ProcessedData, Partial: result.metricsPartial()})
+		}
+	}
+
+	rows := []RollupRow{}
+
+	for key, row := range groups {
+		row.Metrics = processor.Rollup(parts[key])
+		rows = append(rows, *row)
+	}
+
+	sort.Slice(rows, func(i, j int) bool { return rows[i].Key < rows[j].Key })
+
+	return rows
+}
+
+// rollupPath maps ("ipms.csv", "region") to "ipms.rollup_region.csv"
+func rollupPath(outputFile string, level string) string {
+	ext := filepath.Ext(outputFile)
+
+	return strings.TrimSuffix(outputFile, ext) + ".rollup_" + level + ext
+}
+
+// WriteRollups writes one CSV per level next to outputFile.
+func WriteRollups(sys *System, results []ApiResponse, outputFile string, mode string, levels []string) {
+	processor, err := sys.processor(mode)
+	if err != nil {
+		fmt.Println("Invalid mode")
+		return
+	}
+
+	for _, level := range levels {
+		header := []string{strings.ToUpper(level[:1]) + level[1:], "Pis", "Successful"}
+
+		for _, column := range processor.Columns() {
+			header = append(header, column.Header)
+		}
+
+		records := [][]string{header}
+
+		for _, row := range Rollup(processor, results, level) {
+			record := []string{row.Key, fmt.Sprintf("%d", row.Pis), fmt.Sprintf("%d", row.Successful)}
+
+			for _, column := range processor.Columns() {
+				record = append(record, metricCell(row.Metrics, column.Key))
+			}
+
+			records = append(records, record)
+		}
+
+		levelFile := rollupPath(outputFile, level)
+
+		sys.writeCsvRecords(records, levelFile)
+
+		fmt.Printf("Rollup by %s has been written to %s\n", level, levelFile)
+	}
+}
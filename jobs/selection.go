@@ -0,0 +1,174 @@
+package jobs
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Selection narrows the pi list returned by the API before any log is fetched.
+// Filters are applied in order: folder (server side), ids, name pattern, exclusions,
+// shard, sample and finally offset/limit.
+type Selection struct {
+	FolderId         string `json:"folderId,omitempty"`
+	PiIds            []int  `json:"piIds,omitempty"`
+	ExcludePiIds     []int  `json:"excludePiIds,omitempty"`
+	NameRegex        string `json:"nameRegex,omitempty"`
+	ExcludeNameRegex string `json:"excludeNameRegex,omitempty"`
+	Offset           int    `json:"offset,omitempty"`
+	Limit            int    `json:"limit,omitempty"`  // <= 0 selects everything
+	Sample           int    `json:"sample,omitempty"` // pick N pis at random, 0 disables sampling
+	Seed             int64  `json:"seed,omitempty"`
+	ShardIndex       int    `json:"shardIndex,omitempty"` // 1-based, see ParseShard
+	ShardCount       int    `json:"shardCount,omitempty"`
+}
+
+// ParseShard parses "i/n" (1 <= i <= n), used by --shard to split a crawl between machines.
+func ParseShard(value string) (int, int, error) {
+	parts := strings.Split(value, "/")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid shard %q, expected i/n", value)
+	}
+
+	index, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid shard index %q", parts[0])
+	}
+
+	count, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid shard count %q", parts[1])
+	}
+
+	if count < 1 || index < 1 || index > count {
+		return 0, 0, fmt.Errorf("invalid shard %q, expected 1 <= i <= n", value)
+	}
+
+	return index, count, nil
+}
+
+// ParsePiIds parses a list of ids separated by commas, spaces or new lines.
+func ParsePiIds(value string) ([]int, error) {
+	var ids []int
+
+	for _, field := range strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\n' || r == '\r' || r == '\t'
+	}) {
+		id, err := strconv.Atoi(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pi id %q", field)
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+// ReadPiIdsFile reads pi ids from a file, lines starting with # are ignored.
+func ReadPiIdsFile(path string) ([]int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var lines []string
+
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+
+	return ParsePiIds(strings.Join(lines, "\n"))
+}
+
+func (sel Selection) Apply(pis []Pi) ([]Pi, error) {
+	var nameRe, excludeNameRe *regexp.Regexp
+	var err error
+
+	if sel.NameRegex != "" {
+		if nameRe, err = regexp.Compile(sel.NameRegex); err != nil {
+			return nil, fmt.Errorf("invalid name pattern: %w", err)
+		}
+	}
+
+	if sel.ExcludeNameRegex != "" {
+		if excludeNameRe, err = regexp.Compile(sel.ExcludeNameRegex); err != nil {
+			return nil, fmt.Errorf("invalid exclude name pattern: %w", err)
+		}
+	}
+
+	if sel.ShardCount > 0 && (sel.ShardIndex < 1 || sel.ShardIndex > sel.ShardCount) {
+		return nil, fmt.Errorf("invalid shard %d/%d", sel.ShardIndex, sel.ShardCount)
+	}
+
+	if sel.Offset < 0 {
+		return nil, fmt.Errorf("invalid offset %d", sel.Offset)
+	}
+
+	wanted := toSet(sel.PiIds)
+	excluded := toSet(sel.ExcludePiIds)
+
+	selected := []Pi{}
+
+	for _, pi := range pis {
+		if len(wanted) > 0 && !wanted[pi.Id] {
+			continue
+		}
+
+		if excluded[pi.Id] {
+			continue
+		}
+
+		if nameRe != nil && !nameRe.MatchString(pi.Name) {
+			continue
+		}
+
+		if excludeNameRe != nil && excludeNameRe.MatchString(pi.Name) {
+			continue
+		}
+
+		// Shard on the id so every machine agrees regardless of the order the API returns
+		if sel.ShardCount > 1 && pi.Id%sel.ShardCount != sel.ShardIndex-1 {
+			continue
+		}
+
+		selected = append(selected, pi)
+	}
+
+	sort.SliceStable(selected, func(i, j int) bool { return selected[i].Id < selected[j].Id })
+
+	if sel.Sample > 0 && sel.Sample < len(selected) {
+		rng := rand.New(rand.NewSource(sel.Seed))
+		rng.Shuffle(len(selected), func(i, j int) { selected[i], selected[j] = selected[j], selected[i] })
+		selected = selected[:sel.Sample]
+		sort.SliceStable(selected, func(i, j int) bool { return selected[i].Id < selected[j].Id })
+	}
+
+	if sel.Offset >= len(selected) {
+		return []Pi{}, nil
+	}
+
+	selected = selected[sel.Offset:]
+
+	if sel.Limit > 0 && sel.Limit < len(selected) {
+		selected = selected[:sel.Limit]
+	}
+
+	return selected, nil
+}
+
+func toSet(ids []int) map[int]bool {
+	set := map[int]bool{}
+
+	for _, id := range ids {
+		set[id] = true
+	}
+
+	return set
+}
@@ -0,0 +1,79 @@
+package jobs
+
+import "testing"
+
+func testPis(n int) []Pi {
+	pis := []Pi{}
+
+	for i := n; i >= 1; i-- {
+		pis = append(pis, Pi{Id: i, Name: "HNI" + string(rune('A'+i%26))})
+	}
+
+	return pis
+}
+
+func TestSelectionLimitLargerThanFleet(t *testing.T) {
+	selected, err := Selection{Limit: 100}.Apply(testPis(5))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(selected) != 5 {
+		t.Errorf("len(selected) = %d; want 5", len(selected))
+	}
+
+	selected, _ = Selection{Offset: 10}.Apply(testPis(5))
+	if len(selected) != 0 {
+		t.Errorf("len(selected) = %d; want 0", len(selected))
+	}
+}
+
+func TestSelectionShardsCoverFleetOnce(t *testing.T) {
+	seen := map[int]int{}
+
+	for i := 1; i <= 3; i++ {
+		selected, err := Selection{ShardIndex: i, ShardCount: 3}.Apply(testPis(20))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, pi := range selected {
+			seen[pi.Id]++
+		}
+	}
+
+	for id := 1; id <= 20; id++ {
+		if seen[id] != 1 {
+			t.Errorf("pi %d selected %d times; want 1", id, seen[id])
+		}
+	}
+}
+
+func TestSelectionFilters(t *testing.T) {
+	sel := Selection{PiIds: []int{1, 2, 3, 4}, ExcludePiIds: []int{2}, NameRegex: "^HNI", Limit: 2}
+
+	selected, err := sel.Apply(testPis(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(selected) != 2 || selected[0].Id != 1 || selected[1].Id != 3 {
+		t.Errorf("selected = %v; want pis 1 and 3", selected)
+	}
+
+	if _, err := (Selection{NameRegex: "("}).Apply(testPis(1)); err == nil {
+		t.Error("want an error for an invalid name pattern")
+	}
+}
+
+func TestParseShard(t *testing.T) {
+	if i, n, err := ParseShard("2/4"); err != nil || i != 2 || n != 4 {
+		t.Errorf("ParseShard(2/4) = %d, %d, %v", i, n, err)
+	}
+
+	for _, value := range []string{"0/4", "5/4", "1", "a/b"} {
+		if _, _, err := ParseShard(value); err == nil {
+			t.Errorf("ParseShard(%s) want error", value)
+		}
+	}
+}
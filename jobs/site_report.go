@@ -0,0 +1,178 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// NormalizePOPCode turns a pi name of any system into a comparable site code,
+// see ParsePopName ("hni-0001 cab" -> "HNI0001").
+func NormalizePOPCode(name string) string {
+	return ParsePopName(name).Site
+}
+
+// SiteReportSource is one crawled mode of one system feeding the site report.
+type SiteReportSource struct {
+	System  *System
+	Mode    string
+	Results []ApiResponse
+}
+
+type SiteRow struct {
+	Site string
+	// Pi ids per system name
+	PiIds map[string][]int
+	// Metrics per source, keyed "<system> <mode> <metric key>"
+	Metrics map[string]float64
+}
+
+// Presence is "both", "opms only", ... depending on the systems the site was found in.
+func (row SiteRow) Presence(systemNames []string) string {
+	found := []string{}
+
+	for _, name := range systemNames {
+		if len(row.PiIds[name]) > 0 {
+			found = append(found, name)
+		}
+	}
+
+	switch {
+	case len(found) == len(systemNames):
+		return "both"
+	case len(found) == 0:
+		return "none"
+	default:
+		return strings.Join(found, "+") + " only"
+	}
+}
+
+func siteMetricKey(source SiteReportSource, key string) string {
+	return fmt.Sprintf("%s %s %s", source.System.Name, source.Mode, key)
+}
+
+// BuildSiteReport joins the results of several systems by normalised POP code.
+// When a system has several pis on one site, the lowest pi id with data wins.
+func BuildSiteReport(sources []SiteReportSource) []SiteRow {
+	rows := map[string]*SiteRow{}
+
+	for _, source := range sources {
+		results := append([]ApiResponse{}, source.Results...)
+		sort.SliceStable(results, func(i, j int) bool { return results[i].PID < results[j].PID })
+
+		for _, result := range results {
+			site := NormalizePOPCode(result.POP)
+			if site == "" {
+				continue
+			}
+
+			row, ok := rows[site]
+			if !ok {
+				row = &SiteRow{Site: site, PiIds: map[string][]int{}, Metrics: map[string]float64{}}
+				rows[site] = row
+			}
+
+			if !slices.Contains(row.PiIds[source.System.Name], result.PID) {
+				row.PiIds[source.System.Name] = append(row.PiIds[source.System.Name], result.PID)
+			}
+
+			if result.Status != "success" {
+				continue
+			}
+
+			for key, value := range result.ProcessedData {
+				metricKey := siteMetricKey(source, key)
+				if _, taken := row.Metrics[metricKey]; !taken {
+					row.Metrics[metricKey] = value
+				}
+			}
+		}
+	}
+
+	sites := []SiteRow{}
+	for _, row := range rows {
+		sites = append(sites, *row)
+	}
+
+	sort.Slice(sites, func(i, j int) bool { return sites[i].Site < sites[j].Site })
+
+	return sites
+}
+
+func siteReportRecords(sources []SiteReportSource, sites []SiteRow) [][]string {
+	systemNames := []string{}
+	header := []string{"Site", "Found In"}
+
+	for _, source := range sources {
+		if !slices.Contains(systemNames, source.System.Name) {
+			systemNames = append(systemNames, source.System.Name)
+			header = append(header, strings.ToUpper(source.System.Name)+" PI IDs")
+		}
+	}
+
+	for _, source := range sources {
+		processor, err := source.System.processor(source.Mode)
+		if err != nil {
+			continue
+		}
+
+		for _, column := range processor.Columns() {
+			header = append(header, fmt.Sprintf("%s %s", strings.ToUpper(source.System.Name), column.Header))
+		}
+	}
+
+	records := [][]string{header}
+
+	for _, site := range sites {
+		record := []string{site.Site, site.Presence(systemNames)}
+
+		for _, name := range systemNames {
+			ids := []string{}
+			for _, id := range site.PiIds[name] {
+				ids = append(ids, strconv.Itoa(id))
+			}
+			record = append(record, strings.Join(ids, " "))
+		}
+
+		for _, source := range sources {
+			processor, err := source.System.processor(source.Mode)
+			if err != nil {
+				continue
+			}
+
+			for _, column := range processor.Columns() {
+				record = append(record, metricCell(site.Metrics, siteMetricKey(source, column.Key)))
+			}
+		}
+
+		records = append(records, record)
+	}
+
+	return records
+}
+
+// GetCrossSystemReport crawls OPMS fan and temperature and IPMS sensor and AC logs,
+// then writes one row per site with both systems side by side.
+func GetCrossSystemReport(sel Selection, startTime int64, endTime int64, rateLimit int, delaySeconds int, outputFile string) {
+	sources := []SiteReportSource{
+		{System: OPMS, Mode: "FAN"},
+		{System: OPMS, Mode: "TEMP"},
+		{System: IPMS, Mode: "TEMP"},
+		{System: IPMS, Mode: "AC"},
+	}
+
+	for i, source := range sources {
+		fmt.Printf("\n🔎 %s %s\n", strings.ToUpper(source.System.Name), source.Mode)
+
+		sources[i].Results = CollectResults(context.Background(), source.System, sel, startTime, endTime, rateLimit, delaySeconds, source.Mode)
+	}
+
+	sites := BuildSiteReport(sources)
+
+	writeCsvRecords(siteReportRecords(sources, sites), outputFile, CSV_ENCODING_UTF8)
+
+	fmt.Printf("%d sites have been written to %s\n", len(sites), outputFile)
+}
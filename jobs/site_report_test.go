@@ -0,0 +1,37 @@
+package jobs
+
+import "testing"
+
+func TestBuildSiteReportJoinsSystemsByPOPCode(t *testing.T) {
+	sources := []SiteReportSource{
+		{System: OPMS, Mode: "FAN", Results: []ApiResponse{
+			{PID: 10, POP: "HNI0001", Status: "success", ProcessedData: map[string]float64{"f1": 40}},
+			{PID: 11, POP: "HNI0003", Status: "success", ProcessedData: map[string]float64{"f1": 35}},
+		}},
+		{System: IPMS, Mode: "TEMP", Results: []ApiResponse{
+			{PID: 501, POP: "hni-0001 ipms", Status: "success", ProcessedData: map[string]float64{"t1Avg": 27}},
+			{PID: 502, POP: "DNG0002", Status: "error", Error: "Bad Gateway"},
+		}},
+	}
+
+	sites := BuildSiteReport(sources)
+
+	if len(sites) != 3 {
+		t.Fatalf("len(sites) = %d; want 3", len(sites))
+	}
+
+	systemNames := []string{"opms", "ipms"}
+
+	want := map[string]string{"HNI0001": "both", "DNG0002": "ipms only", "HNI0003": "opms only"}
+
+	for _, site := range sites {
+		if got := site.Presence(systemNames); got != want[site.Site] {
+			t.Errorf("%s presence = %s; want %s", site.Site, got, want[site.Site])
+		}
+	}
+
+	hni := sites[1]
+	if hni.Site != "HNI0001" || hni.Metrics["opms FAN f1"] != 40 || hni.Metrics["ipms TEMP t1Avg"] != 27 {
+		t.Errorf("HNI0001 = %+v; want OPMS f1 next to IPMS t1Avg", hni)
+	}
+}
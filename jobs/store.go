@@ -0,0 +1,66 @@
+package jobs
+
+import (
+	"database/sql"
+	"fmt"
+	"project/database"
+	"project/models"
+	"time"
+)
+
+// metricsRows has one row per successful pi over [startTime, endTime), or one per
+// bucket of bucketed results. The buckets the run only partly covers are clipped to it,
+// so that their rows never replace the ones of a run covering the whole bucket.
+func metricsRows(sys *System, mode string, startTime int64, endTime int64, b Bucketing, results []ApiResponse) []models.MetricsRow {
+	rows := []models.MetricsRow{}
+
+	for _, result := range results {
+		if result.Status != "success" {
+			continue
+		}
+
+		row := models.MetricsRow{System: sys.Name, Mode: mode, PiId: result.PID, Pop: result.POP, Bucket: b.String()}
+
+		if !b.Enabled() {
+			row.Start, row.End, row.Metrics = time.Unix(startTime, 0), time.Unix(endTime, 0), result.ProcessedData
+			rows = append(rows, row)
+			continue
+		}
+
+		for _, bucket := range result.Buckets {
+			row.Start, row.End = time.Unix(max(bucket.Start, startTime), 0), time.Unix(min(bucket.End, endTime), 0)
+			row.Metrics = bucket.ProcessedData
+			rows = append(rows, row)
+		}
+	}
+
+	return rows
+}
+
+// StoreResults saves the metrics of a run in Postgres for the REST API.
+func StoreResults(db *sql.DB, sys *System, mode string, startTime int64, endTime int64, b Bucketing, results []ApiResponse) error {
+	rows := metricsRows(sys, mode, startTime, endTime, b, results)
+
+	if err := database.SaveMetrics(db, rows); err != nil {
+		return err
+	}
+
+	fmt.Printf("%d metric rows have been stored\n", len(rows))
+
+	return nil
+}
+
+// FolderPiIds asks the IoT API which pis are in a folder.
+func FolderPiIds(sys *System, folderId string) (map[int]bool, error) {
+	pis, err := sys.fetchPiList(folderId)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := map[int]bool{}
+	for _, pi := range pis {
+		ids[pi.Id] = true
+	}
+
+	return ids, nil
+}
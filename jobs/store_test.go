@@ -0,0 +1,36 @@
+package jobs
+
+import "testing"
+
+func TestMetricsRows(t *testing.T) {
+	results := []ApiResponse{
+		{Status: "success", PID: 1, POP: "HNI0001", ProcessedData: map[string]float64{"t1Avg": 20}, Buckets: []BucketResult{
+			{Start: 0, End: 3600, ProcessedData: map[string]float64{"t1Avg": 19}},
+			{Start: 3600, End: 7200, ProcessedData: map[string]float64{"t1Avg": 21}},
+		}},
+		{Status: "error", PID: 2},
+	}
+
+	whole := metricsRows(OPMS, "TEMP", 0, 7200, Bucketing{}, results)
+	if len(whole) != 1 || whole[0].Bucket != "" || whole[0].End.Unix() != 7200 || whole[0].Metrics["t1Avg"] != 20 {
+		t.Errorf("rows = %+v; want one row over the run window", whole)
+	}
+
+	b, _ := ParseBucketing("60m")
+	bucketed := metricsRows(OPMS, "TEMP", 0, 7200, b, results)
+	if len(bucketed) != 2 || bucketed[1].Bucket != "1h" || bucketed[1].Start.Unix() != 3600 || bucketed[1].Metrics["t1Avg"] != 21 {
+		t.Errorf("rows = %+v; want one row per bucket", bucketed)
+	}
+
+	// A run from 0:30 to 1:30 only has half of both buckets
+	clipped := metricsRows(OPMS, "TEMP", 1800, 5400, b, results)
+	if len(clipped) != 2 || clipped[0].Start.Unix() != 1800 || clipped[0].End.Unix() != 3600 || clipped[1].Start.Unix() != 3600 || clipped[1].End.Unix() != 5400 {
+		t.Errorf("rows = %+v; want the buckets clipped to the run", clipped)
+	}
+
+	for _, spec := range []string{"5m", "1h", "1d", "90s", "day", "week"} {
+		if parsed, _ := ParseBucketing(spec); parsed.String() != spec {
+			t.Errorf("ParseBucketing(%q).String() = %q", spec, parsed.String())
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package jobs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+)
+
+// streamEntries walks a log response token by token and hands every entry under the
+// entries path to visit as soon as it is read, so that only one entry is in memory at
+// a time. The success flag can come before or after the entries, it is checked once
+// the response has been read: entries of a failed call have then already been visited.
+func (sys *System) streamEntries(body io.Reader, visit func(entry json.RawMessage)) error {
+	walker := envelopeWalker{
+		decoder:     json.NewDecoder(body),
+		entriesPath: strings.Split(sys.Envelope.EntriesPath, "."),
+		visit:       visit,
+	}
+
+	if sys.Envelope.SuccessPath != "" {
+		walker.successPath = strings.Split(sys.Envelope.SuccessPath, ".")
+	}
+
+	if err := walker.walk(nil); err != nil {
+		return err
+	}
+
+	if walker.successPath != nil && !walker.success {
+		return errApiCallFailed
+	}
+
+	if walker.notObject {
+		return fmt.Errorf("%s is not an object", sys.Envelope.EntriesPath)
+	}
+
+	return nil
+}
+
+type envelopeWalker struct {
+	decoder     *json.Decoder
+	entriesPath []string
+	successPath []string
+	visit       func(entry json.RawMessage)
+
+	success bool
+	// A value on the way to the entries was neither an object nor null
+	notObject bool
+}
+
+func hasPrefix(path []string, prefix []string) bool {
+	return len(prefix) <= len(path) && slices.Equal(path[:len(prefix)], prefix)
+}
+
+// walk reads the next value, found at path
+func (w *envelopeWalker) walk(path []string) error {
+	switch {
+	case slices.Equal(path, w.entriesPath):
+		return w.entries()
+
+	case w.successPath != nil && slices.Equal(path, w.successPath):
+		var success bool
+		var raw json.RawMessage
+
+		if err := w.decoder.Decode(&raw); err != nil {
+			return err
+		}
+
+		w.success = json.Unmarshal(raw, &success) == nil && success
+		return nil
+
+	case !hasPrefix(w.entriesPath, path) && (w.successPath == nil || !hasPrefix(w.successPath, path)):
+		var skipped json.RawMessage
+		return w.decoder.Decode(&skipped)
+	}
+
+	token, err := w.decoder.Token()
+	if err != nil {
+		return err
+	}
+
+	if token != json.Delim('{') {
+		if token != nil && hasPrefix(w.entriesPath, path) {
+			w.notObject = true
+		}
+		return w.skipRest(token)
+	}
+
+	for w.decoder.More() {
+		key, err := w.decoder.Token()
+		if err != nil {
+			return err
+		}
+
+		if err := w.walk(append(slices.Clip(path), key.(string))); err != nil {
+			return err
+		}
+	}
+
+	_, err = w.decoder.Token()
+	return err
+}
+
+// entries visits the elements of the entries list, null is an empty list
+func (w *envelopeWalker) entries() error {
+	token, err := w.decoder.Token()
+	if err != nil {
+		return err
+	}
+
+	if token == nil {
+		return nil
+	}
+
+	if token != json.Delim('[') {
+		return fmt.Errorf("%s is not a list", strings.Join(w.entriesPath, "."))
+	}
+
+	for w.decoder.More() {
+		var entry json.RawMessage
+
+		if err := w.decoder.Decode(&entry); err != nil {
+			return err
+		}
+
+		w.visit(entry)
+	}
+
+	_, err = w.decoder.Token()
+	return err
+}
+
+// skipRest skips the rest of a value whose first token has been read
+func (w *envelopeWalker) skipRest(token json.Token) error {
+	if token != json.Delim('[') && token != json.Delim('{') {
+		return nil
+	}
+
+	for w.decoder.More() {
+		var skipped json.RawMessage
+
+		if token == json.Delim('{') {
+			if _, err := w.decoder.Token(); err != nil {
+				return err
+			}
+		}
+
+		if err := w.decoder.Decode(&skipped); err != nil {
+			return err
+		}
+	}
+
+	_, err := w.decoder.Token()
+	return err
+}
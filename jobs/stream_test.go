@@ -0,0 +1,107 @@
+package jobs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestStreamEntriesWalksTheEnvelope(t *testing.T) {
+	tests := []struct {
+		body    string
+		entries int
+		err     string
+	}{
+		{`{"data": {"data": [{"timestamp": 0}, {"timestamp": 60}], "success": true}}`, 2, ""},
+		{`{"extra": [{"data": 1}], "data": {"success": true, "meta": {"data": []}, "data": [1, 2, 3]}}`, 3, ""},
+		{`{"data": {"success": true, "data": null}}`, 0, ""},
+		{`{"data": {"success": false, "data": [{"timestamp": 0}]}}`, 1, errApiCallFailed.Error()},
+		{`{"data": {"success": "true", "data": []}}`, 0, errApiCallFailed.Error()},
+		{`{"data": {"success": true, "data": {"timestamp": 0}}}`, 0, "data.data is not a list"},
+		{`{"data": {"success": true, "data": [{"timestamp": 0}`, 1, "unexpected end"},
+	}
+
+	for _, test := range tests {
+		entries := 0
+
+		err := OPMS.streamEntries(strings.NewReader(test.body), func(json.RawMessage) { entries++ })
+
+		if entries != test.entries || (err == nil) != (test.err == "") || (err != nil && !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%s: %d entries, err = %v; want %d entries, err %q", test.body, entries, err, test.entries, test.err)
+		}
+	}
+}
+
+// A day of 1 s samples, the busiest log a pi sends in one request
+func largeResponse() []byte {
+	var body bytes.Buffer
+
+	body.WriteString(`{"data": {"success": true, "data": [`)
+
+	for i := 0; i < 86400; i++ {
+		if i > 0 {
+			body.WriteString(",")
+		}
+		fmt.Fprintf(&body, `{"timestamp": %d, "temperature_0": %.1f, "temperature_1": "%.1f", "temperature_2": 30, "temperature_3": null}`, i, 20+float64(i%200)/10, 25+float64(i%50)/10)
+	}
+
+	body.WriteString(`]}}`)
+
+	return body.Bytes()
+}
+
+// BenchmarkDecodeBuffered decodes the whole response before processing it, as the
+// pipeline used to.
+func BenchmarkDecodeBuffered(b *testing.B) {
+	body := largeResponse()
+	processor, _ := GetProcessor("opms-temp")
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(body)))
+
+	for i := 0; i < b.N; i++ {
+		var response struct {
+			Data struct {
+				Data []map[string]any `json:"data"`
+			} `json:"data"`
+		}
+
+		if err := json.NewDecoder(bytes.NewReader(body)).Decode(&response); err != nil {
+			b.Fatal(err)
+		}
+
+		aggregator := processor.NewAggregator()
+		for _, entry := range response.Data.Data {
+			raw, _ := json.Marshal(entry)
+			aggregator.Add(raw)
+		}
+		aggregator.Result()
+	}
+}
+
+func BenchmarkDecodeStreaming(b *testing.B) {
+	body := largeResponse()
+	processor, _ := GetProcessor("opms-temp")
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(body)))
+
+	for i := 0; i < b.N; i++ {
+		aggregator := processor.NewAggregator()
+		// As fetchWindow does, so that the allocations include the data quality
+		quality := newQualityAggregator(0, 86400, 1, requiredKeys(processor))
+
+		err := OPMS.streamEntries(bytes.NewReader(body), func(entry json.RawMessage) {
+			quality.Add(entry)
+			aggregator.Add(entry)
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		aggregator.Result()
+		quality.Result()
+	}
+}
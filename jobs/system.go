@@ -0,0 +1,180 @@
+package jobs
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+const (
+	POP_NAME_RAW  = "raw"
+	POP_NAME_SITE = "site"
+)
+
+const (
+	CSV_ENCODING_UTF8    = "utf-8"
+	CSV_ENCODING_UTF16LE = "utf-16le" // with BOM, opens cleanly in Excel
+)
+
+// Envelope locates the entries and the success flag in a log response,
+// as dotted paths such as "data.data" and "data.success".
+type Envelope struct {
+	EntriesPath string `json:"entriesPath"`
+	SuccessPath string `json:"successPath"`
+}
+
+// System describes one IoT product line (OPMS, IPMS, ...) well enough for the
+// generic pipeline to crawl it. New product lines can be added from a JSON file,
+// see LoadSystems.
+type System struct {
+	Name string `json:"name"`
+	// Prefixed to every route, overridden by <NAME>_BASE_URL
+	BaseURL string `json:"baseUrl"`
+	// Pi list route, %s is replaced by the folder id
+	PiListRoute string `json:"piListRoute"`
+	// Log route per mode, with %d for the pi id, start and end time
+	LogRoutes map[string]string `json:"logRoutes"`
+	// Processor name per mode, see RegisterProcessor
+	Processors map[string]string `json:"processors"`
+	Envelope   Envelope          `json:"envelope"`
+	// POP column: POP_NAME_RAW keeps the pi name, POP_NAME_SITE the site code of ParsePopName
+	PopName     string `json:"popName"`
+	CSVEncoding string `json:"csvEncoding"`
+	// Expected seconds between log entries per mode, DEFAULT_SAMPLE_SECONDS otherwise
+	SampleSeconds map[string]int `json:"sampleSeconds,omitempty"`
+	// Seconds of log the first request of every pi asks for per mode, DELTA_TIME
+	// otherwise. Later requests adapt, see fetch.
+	WindowSeconds map[string]int64 `json:"windowSeconds,omitempty"`
+}
+
+var systems = map[string]*System{}
+
+func RegisterSystem(sys *System) {
+	systems[strings.ToLower(sys.Name)] = sys
+}
+
+func GetSystem(name string) (*System, bool) {
+	sys, ok := systems[strings.ToLower(name)]
+	return sys, ok
+}
+
+func SystemNames() []string {
+	names := []string{}
+	for name := range systems {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// LoadSystems registers the systems of a JSON file holding an array of System,
+// replacing built-in ones with the same name.
+func LoadSystems(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var loaded []*System
+
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		return fmt.Errorf("reading systems from %s: %w", path, err)
+	}
+
+	for _, sys := range loaded {
+		if err := sys.validate(); err != nil {
+			return err
+		}
+		RegisterSystem(sys)
+	}
+
+	return nil
+}
+
+func (sys *System) validate() error {
+	if sys.Name == "" || sys.PiListRoute == "" || len(sys.LogRoutes) == 0 {
+		return fmt.Errorf("system %q needs a name, a piListRoute and logRoutes", sys.Name)
+	}
+
+	for mode := range sys.LogRoutes {
+		if _, ok := GetProcessor(sys.Processors[mode]); !ok {
+			return fmt.Errorf("system %s has no known processor for mode %s", sys.Name, mode)
+		}
+	}
+
+	switch sys.PopName {
+	case "", POP_NAME_RAW, POP_NAME_SITE:
+	default:
+		return fmt.Errorf("system %s has an unknown popName %q", sys.Name, sys.PopName)
+	}
+
+	switch sys.CSVEncoding {
+	case "", CSV_ENCODING_UTF8, CSV_ENCODING_UTF16LE:
+	default:
+		return fmt.Errorf("system %s has an unknown CSV encoding %q", sys.Name, sys.CSVEncoding)
+	}
+
+	if sys.Envelope.EntriesPath == "" {
+		sys.Envelope.EntriesPath = "data.data"
+	}
+
+	return nil
+}
+
+func (sys *System) baseURL() string {
+	if baseURL := os.Getenv(strings.ToUpper(sys.Name) + "_BASE_URL"); baseURL != "" {
+		return baseURL
+	}
+
+	return sys.BaseURL
+}
+
+func (sys *System) url(route string) string {
+	baseURL := sys.baseURL()
+
+	if baseURL == "" || strings.HasPrefix(route, "http://") || strings.HasPrefix(route, "https://") {
+		return route
+	}
+
+	return strings.TrimRight(baseURL, "/") + "/" + strings.TrimLeft(route, "/")
+}
+
+// Modes lists the modes of the system, sorted
+func (sys *System) Modes() []string {
+	modes := []string{}
+	for mode := range sys.LogRoutes {
+		modes = append(modes, mode)
+	}
+	sort.Strings(modes)
+
+	return modes
+}
+
+func (sys *System) logURL(mode string, piId int, timeStart int64, timeEnd int64) (string, error) {
+	pattern, ok := sys.LogRoutes[mode]
+	if !ok {
+		return "", fmt.Errorf("invalid mode %s for %s", mode, sys.Name)
+	}
+
+	return sys.url(fmt.Sprintf(pattern, piId, timeStart, timeEnd)), nil
+}
+
+func (sys *System) processor(mode string) (Processor, error) {
+	processor, ok := GetProcessor(sys.Processors[mode])
+	if !ok {
+		return nil, fmt.Errorf("invalid mode %s for %s", mode, sys.Name)
+	}
+
+	return processor, nil
+}
+
+func (sys *System) popName(name string) string {
+	if sys.PopName == POP_NAME_SITE {
+		return ParsePopName(name).Site
+	}
+
+	return name
+}
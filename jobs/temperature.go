@@ -0,0 +1,446 @@
+package jobs
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+)
+
+const (
+	TEMP_WARNING_DEFAULT  = 35.0
+	TEMP_CRITICAL_DEFAULT = 40.0
+)
+
+var tempWarning, tempCritical = TEMP_WARNING_DEFAULT, TEMP_CRITICAL_DEFAULT
+
+// SetTempThresholds sets the degrees above which the TEMP processors count minutes.
+func SetTempThresholds(warning float64, critical float64) error {
+	if warning > critical {
+		return fmt.Errorf("the warning threshold %.1f is above the critical one %.1f", warning, critical)
+	}
+
+	tempWarning, tempCritical = warning, critical
+
+	return nil
+}
+
+// tempProcessor reads sensors keyPrefix0..keyPrefix<sensors-1> into t1..tN statistics.
+// A sensor without readings only gets tNCount = 0, every other metric is left out
+// so that the CSV shows no data instead of 0.
+type tempProcessor struct {
+	keyPrefix string
+	sensors   int
+	decode    func(data []byte) (TempEntry, error)
+}
+
+var tempStats = []Column{
+	{"Min", "Min"},
+	{"Max", "Max"},
+	{"Avg", "Avg"},
+	{"Count", "Count"},
+	{"P50", "P50"},
+	{"P95", "P95"},
+	{"P99", "P99"},
+	{"Std", "Std"},
+	{"MinutesWarning", "Minutes Above Warning"},
+	{"MinutesCritical", "Minutes Above Critical"},
+}
+
+func (p tempProcessor) Columns() []Column {
+	columns := []Column{}
+
+	for i := 1; i <= p.sensors; i++ {
+		for _, stat := range tempStats {
+			columns = append(columns, Column{fmt.Sprintf("t%d%s", i, stat.Key), fmt.Sprintf("T%d %s", i, stat.Header)})
+		}
+	}
+
+	return columns
+}
+
+func (p tempProcessor) Keys() []string {
+	keys := []string{}
+	for i := 0; i < p.sensors; i++ {
+		keys = append(keys, fmt.Sprintf("%s%d", p.keyPrefix, i))
+	}
+
+	return keys
+}
+
+// Readings are kept as counts per value rounded to TEMP_RESOLUTION, so the memory
+// of a sensor is bounded by its range rather than by the number of readings.
+const TEMP_RESOLUTION = 0.01
+
+// tempSensor accumulates the readings of one sensor as they stream in
+type tempSensor struct {
+	count, mean, m2 float64 // Welford
+	min, max        float64
+	values          map[float64]int
+
+	// Time above the thresholds, each reading lasting until the next one
+	hasPrevious       bool
+	firstTime         float64
+	previous          float64
+	previousTime      float64
+	previousDuration  float64
+	warning, critical float64
+}
+
+func (sensor *tempSensor) add(value float64, timestamp Number) {
+	sensor.count++
+	delta := value - sensor.mean
+	sensor.mean += delta / sensor.count
+	sensor.m2 += delta * (value - sensor.mean)
+
+	if sensor.count == 1 || value < sensor.min {
+		sensor.min = value
+	}
+	if sensor.count == 1 || value > sensor.max {
+		sensor.max = value
+	}
+
+	sensor.values[math.Round(value/TEMP_RESOLUTION)*TEMP_RESOLUTION]++
+
+	// Out of order readings count in the statistics but not in the minutes
+	if !timestamp.Valid || (sensor.hasPrevious && timestamp.Value < sensor.previousTime) {
+		return
+	}
+
+	if sensor.hasPrevious {
+		sensor.previousDuration = math.Min(timestamp.Value-sensor.previousTime, MAX_SAMPLE_SECONDS)
+		sensor.warning, sensor.critical = creditTemp(sensor.warning, sensor.critical, sensor.previous, sensor.previousDuration)
+	} else {
+		sensor.firstTime = timestamp.Value
+	}
+
+	sensor.hasPrevious, sensor.previous, sensor.previousTime = true, value, timestamp.Value
+}
+
+// creditTemp adds seconds at value to the seconds above the thresholds
+func creditTemp(warning float64, critical float64, value float64, seconds float64) (float64, float64) {
+	if value >= tempWarning {
+		warning += seconds
+	}
+
+	if value >= tempCritical {
+		critical += seconds
+	}
+
+	return warning, critical
+}
+
+func (sensor *tempSensor) statistics() map[string]float64 {
+	stats := map[string]float64{"Count": sensor.count}
+
+	if sensor.count == 0 {
+		return stats
+	}
+
+	stats["Min"] = sensor.min
+	stats["Max"] = sensor.max
+	stats["Avg"] = sensor.mean
+	stats["P50"] = countedPercentile(sensor.values, 50)
+	stats["P95"] = countedPercentile(sensor.values, 95)
+	stats["P99"] = countedPercentile(sensor.values, 99)
+	stats["Std"] = math.Sqrt(sensor.m2 / sensor.count)
+
+	// The last reading lasts as long as the one before it
+	warning, critical := creditTemp(sensor.warning, sensor.critical, sensor.previous, sensor.previousDuration)
+
+	stats["MinutesWarning"] = warning / 60
+	stats["MinutesCritical"] = critical / 60
+
+	return stats
+}
+
+// tempSensorPartial is what the statistics of a sensor lose: the readings behind the
+// percentiles, and the edges that the minutes of consecutive parts depend on.
+type tempSensorPartial struct {
+	// Value and count pairs, by TEMP_RESOLUTION
+	Values [][2]float64 `json:"values,omitempty"`
+	// Seconds above the thresholds, without the last reading
+	Warning  float64 `json:"warning,omitempty"`
+	Critical float64 `json:"critical,omitempty"`
+	// The first and last timed readings, the last lasting LastSeconds until another one
+	Timed       bool    `json:"timed,omitempty"`
+	FirstTime   float64 `json:"firstTime,omitempty"`
+	Last        float64 `json:"last,omitempty"`
+	LastTime    float64 `json:"lastTime,omitempty"`
+	LastSeconds float64 `json:"lastSeconds,omitempty"`
+}
+
+func (sensor *tempSensor) partial() tempSensorPartial {
+	partial := tempSensorPartial{Warning: sensor.warning, Critical: sensor.critical}
+
+	for value, count := range sensor.values {
+		partial.Values = append(partial.Values, [2]float64{value, float64(count)})
+	}
+	sort.Slice(partial.Values, func(i, j int) bool { return partial.Values[i][0] < partial.Values[j][0] })
+
+	if sensor.hasPrevious {
+		partial.Timed, partial.FirstTime = true, sensor.firstTime
+		partial.Last, partial.LastTime, partial.LastSeconds = sensor.previous, sensor.previousTime, sensor.previousDuration
+	}
+
+	return partial
+}
+
+// minutes above the thresholds, the last reading lasting as long as the one before it
+func (partial tempSensorPartial) minutes() (float64, float64) {
+	warning, critical := creditTemp(partial.Warning, partial.Critical, partial.Last, partial.LastSeconds)
+
+	return warning / 60, critical / 60
+}
+
+// follow adds the readings of the next part, crediting the last reading until the first
+// of next as one aggregator over both parts would have.
+func (partial *tempSensorPartial) follow(next tempSensorPartial) {
+	values := map[float64]float64{}
+	for _, pairs := range [][][2]float64{partial.Values, next.Values} {
+		for _, pair := range pairs {
+			values[pair[0]] += pair[1]
+		}
+	}
+
+	partial.Values = nil
+	for value, count := range values {
+		partial.Values = append(partial.Values, [2]float64{value, count})
+	}
+	sort.Slice(partial.Values, func(i, j int) bool { return partial.Values[i][0] < partial.Values[j][0] })
+
+	partial.Warning += next.Warning
+	partial.Critical += next.Critical
+
+	if !next.Timed {
+		return
+	}
+
+	if !partial.Timed {
+		partial.Timed, partial.FirstTime = true, next.FirstTime
+	} else if next.FirstTime >= partial.LastTime {
+		partial.LastSeconds = math.Min(next.FirstTime-partial.LastTime, MAX_SAMPLE_SECONDS)
+		partial.Warning, partial.Critical = creditTemp(partial.Warning, partial.Critical, partial.Last, partial.LastSeconds)
+	}
+
+	// A part with a single reading keeps the duration before it
+	if next.LastTime > next.FirstTime {
+		partial.LastSeconds = next.LastSeconds
+	}
+
+	partial.Last, partial.LastTime = next.Last, next.LastTime
+}
+
+func (partial tempSensorPartial) counts() map[float64]int {
+	counts := map[float64]int{}
+	for _, pair := range partial.Values {
+		counts[pair[0]] += int(pair[1])
+	}
+
+	return counts
+}
+
+func (p tempProcessor) NewAggregator() Aggregator {
+	sensors := make([]*tempSensor, p.sensors)
+	for i := range sensors {
+		sensors[i] = &tempSensor{values: map[float64]int{}}
+	}
+
+	add := func(temp TempEntry) {
+		for i, sensor := range sensors {
+			if i < len(temp.Sensors) && temp.Sensors[i].Valid {
+				sensor.add(temp.Sensors[i].Value, temp.Timestamp)
+			}
+		}
+	}
+
+	result := func() map[string]float64 {
+		metrics := map[string]float64{}
+
+		for i, sensor := range sensors {
+			for key, value := range sensor.statistics() {
+				metrics[fmt.Sprintf("t%d%s", i+1, key)] = value
+			}
+		}
+
+		return metrics
+	}
+
+	partial := func() json.RawMessage {
+		partials := []tempSensorPartial{}
+		for _, sensor := range sensors {
+			partials = append(partials, sensor.partial())
+		}
+
+		data, _ := json.Marshal(partials)
+		return data
+	}
+
+	return &typedAggregator[TempEntry]{decode: p.decode, add: add, result: result, partial: partial}
+}
+
+// percentile interpolates between the closest ranks of sorted values
+func percentile(sorted []float64, p float64) float64 {
+	rank := p / 100 * float64(len(sorted)-1)
+	lower := int(math.Floor(rank))
+	upper := int(math.Ceil(rank))
+
+	return sorted[lower] + (sorted[upper]-sorted[lower])*(rank-float64(lower))
+}
+
+// countedPercentile is percentile over values given as value -> count
+func countedPercentile(counts map[float64]int, p float64) float64 {
+	values := make([]float64, 0, len(counts))
+	total := 0
+
+	for value, count := range counts {
+		values = append(values, value)
+		total += count
+	}
+
+	sort.Float64s(values)
+
+	// value at a 0-based rank of the expanded sorted list
+	at := func(rank int) float64 {
+		for _, value := range values {
+			if rank -= counts[value]; rank < 0 {
+				return value
+			}
+		}
+		return values[len(values)-1]
+	}
+
+	rank := p / 100 * float64(total-1)
+	lower, upper := at(int(math.Floor(rank))), at(int(math.Ceil(rank)))
+
+	return lower + (upper-lower)*(rank-math.Floor(rank))
+}
+
+// tempPartials reads the partials of the sensors of every part, nil when a part has none
+func (p tempProcessor) tempPartials(parts []Part) [][]tempSensorPartial {
+	partials := [][]tempSensorPartial{}
+
+	for _, part := range parts {
+		var sensors []tempSensorPartial
+
+		if part.Partial == nil || json.Unmarshal(part.Partial, &sensors) != nil || len(sensors) != p.sensors {
+			return nil
+		}
+
+		partials = append(partials, sensors)
+	}
+
+	return partials
+}
+
+// poolTemp pools the count, extremes, mean and deviation of one sensor of the parts into
+// merged and adds up its minutes, returning the count.
+func poolTemp(merged map[string]float64, parts []Part, key func(stat string) string) float64 {
+	var count, sum, squares float64
+	minimum, maximum := math.Inf(1), math.Inf(-1)
+
+	for _, part := range partMetrics(parts) {
+		partCount := part[key("Count")]
+
+		merged[key("MinutesWarning")] += part[key("MinutesWarning")]
+		merged[key("MinutesCritical")] += part[key("MinutesCritical")]
+
+		if partCount == 0 {
+			continue
+		}
+
+		mean, std := part[key("Avg")], part[key("Std")]
+
+		count += partCount
+		sum += mean * partCount
+		squares += (std*std + mean*mean) * partCount
+		minimum = math.Min(minimum, part[key("Min")])
+		maximum = math.Max(maximum, part[key("Max")])
+	}
+
+	merged[key("Count")] = count
+
+	if count == 0 {
+		delete(merged, key("MinutesWarning"))
+		delete(merged, key("MinutesCritical"))
+		return 0
+	}
+
+	mean := sum / count
+
+	merged[key("Min")] = minimum
+	merged[key("Max")] = maximum
+	merged[key("Avg")] = mean
+	merged[key("Std")] = math.Sqrt(math.Max(squares/count-mean*mean, 0))
+
+	return count
+}
+
+func tempPercentiles(merged map[string]float64, counts map[float64]int, key func(stat string) string) {
+	merged[key("P50")] = countedPercentile(counts, 50)
+	merged[key("P95")] = countedPercentile(counts, 95)
+	merged[key("P99")] = countedPercentile(counts, 99)
+}
+
+// Merge pools the count, extremes, mean and deviation of the parts. The percentiles and
+// the minutes come from the partials, the percentiles are left out without them.
+func (p tempProcessor) Merge(parts []Part) Part {
+	merged := map[string]float64{}
+	partials := p.tempPartials(parts)
+	mergedPartials := []tempSensorPartial{}
+
+	for i := 1; i <= p.sensors; i++ {
+		key := func(stat string) string { return fmt.Sprintf("t%d%s", i, stat) }
+
+		count := poolTemp(merged, parts, key)
+
+		if partials == nil {
+			continue
+		}
+
+		var sensor tempSensorPartial
+		for _, part := range partials {
+			sensor.follow(part[i-1])
+		}
+		mergedPartials = append(mergedPartials, sensor)
+
+		if count > 0 {
+			merged[key("MinutesWarning")], merged[key("MinutesCritical")] = sensor.minutes()
+			tempPercentiles(merged, sensor.counts(), key)
+		}
+	}
+
+	if partials == nil {
+		return Part{Metrics: merged}
+	}
+
+	data, _ := json.Marshal(mergedPartials)
+
+	return Part{Metrics: merged, Partial: data}
+}
+
+// Rollup pools the statistics of the pis like Merge and adds up their minutes. The
+// percentiles come from the readings of every pi, they are left out without partials.
+func (p tempProcessor) Rollup(parts []Part) map[string]float64 {
+	merged := map[string]float64{}
+	partials := p.tempPartials(parts)
+
+	for i := 1; i <= p.sensors; i++ {
+		key := func(stat string) string { return fmt.Sprintf("t%d%s", i, stat) }
+
+		if count := poolTemp(merged, parts, key); count == 0 || partials == nil {
+			continue
+		}
+
+		counts := map[float64]int{}
+		for _, part := range partials {
+			for value, count := range part[i-1].counts() {
+				counts[value] += count
+			}
+		}
+
+		tempPercentiles(merged, counts, key)
+	}
+
+	return merged
+}
@@ -0,0 +1,57 @@
+package jobs
+
+import (
+	"math"
+	"testing"
+)
+
+func TestTempProcessorStatistics(t *testing.T) {
+	processor, _ := GetProcessor("ipms-temp")
+
+	entries := []map[string]any{
+		{"timestamp": 0.0, "sensoripmst0": 30.0},
+		{"timestamp": 60.0},
+		{"timestamp": 120.0, "sensoripmst0": 36.0},
+		{"timestamp": 180.0, "sensoripmst0": 42.0},
+		{"timestamp": 240.0, "sensoripmst0": 32.0},
+	}
+
+	got, _ := processEntries(processor, rawEntries(t, entries))
+
+	want := map[string]float64{
+		"t1Count": 4, "t1Min": 30, "t1Max": 42, "t1Avg": 35,
+		"t1P50": 34, "t1Std": math.Sqrt(21),
+		// 36 lasts until 180, 42 until 240
+		"t1MinutesWarning": 2, "t1MinutesCritical": 1,
+	}
+
+	for key, value := range want {
+		if math.Abs(got[key]-value) > 1e-9 {
+			t.Errorf("%s = %v; want %v", key, got[key], value)
+		}
+	}
+
+	empty, _ := processEntries(processor, rawEntries(t, []map[string]any{{"timestamp": 0.0}}))
+
+	if _, ok := empty["t1Avg"]; ok || empty["t1Count"] != 0 {
+		t.Errorf("no readings = %v; want only t1Count = 0", empty)
+	}
+
+	// Split inside the 36 reading, which lasts across both parts
+	parts := []Part{processPart(t, processor, entries[:3]), processPart(t, processor, entries[3:])}
+	merged := processor.Merge(parts).Metrics
+
+	for _, key := range []string{"t1Count", "t1Min", "t1Max", "t1Avg", "t1Std", "t1P50", "t1P95", "t1P99", "t1MinutesWarning", "t1MinutesCritical"} {
+		if math.Abs(merged[key]-got[key]) > 1e-9 {
+			t.Errorf("merged %s = %v; want %v", key, merged[key], got[key])
+		}
+	}
+
+	// Without the partials, the pooled statistics still merge but the percentiles can't
+	parts[0].Partial, parts[1].Partial = nil, nil
+	pooled := processor.Merge(parts).Metrics
+
+	if _, ok := pooled["t1P50"]; ok || pooled["t1Count"] != 4 || pooled["t1Max"] != 42 {
+		t.Errorf("merged without partials = %v", pooled)
+	}
+}
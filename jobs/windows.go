@@ -0,0 +1,211 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"project/utils"
+	"sort"
+)
+
+const (
+	// Windows are never halved below this, a busy pi failing at 5 minutes is down
+	WINDOW_MIN_SECONDS = int64(5 * 60)
+	WINDOW_MAX_SECONDS = int64(7 * 86400)
+	// Entries one request may return before its window is halved
+	WINDOW_MAX_ENTRIES_DEFAULT = 20000
+	// A window returning fewer than max entries / WINDOW_WIDEN_RATIO doubles the next one
+	WINDOW_WIDEN_RATIO = 4
+)
+
+var windowMaxEntries = WINDOW_MAX_ENTRIES_DEFAULT
+
+// SetWindowMaxEntries sets how many entries a request may return before it is split.
+func SetWindowMaxEntries(entries int) error {
+	if entries <= 0 {
+		return fmt.Errorf("the window entry limit must be positive")
+	}
+
+	windowMaxEntries = entries
+
+	return nil
+}
+
+// windowSeconds is the size of the first request of every pi, DELTA_TIME unless the
+// system says otherwise for the mode
+func (sys *System) windowSeconds(mode string) int64 {
+	if seconds := sys.WindowSeconds[mode]; seconds > 0 {
+		return seconds
+	}
+
+	return DELTA_TIME
+}
+
+// nextWindow is the end of the window starting at from, cut on bucket boundaries when
+// bucketing so that most buckets come from a single request
+func nextWindow(from int64, end int64, size int64, b Bucketing) int64 {
+	if b.Enabled() && from < end {
+		return splitBucketedRange(from, end, size, b)[0][1]
+	}
+
+	return min(from+size, end)
+}
+
+// windowResult is what one request of a pi's range gave
+type windowResult struct {
+	failure    ApiResponse // Status "error" when the request failed
+	entries    int
+	tooLarge   bool
+	part       Part
+	validation *ValidationError // never nil once fetched
+	quality    *qualityAggregator
+	buckets    []BucketResult
+}
+
+// splittable failures may pass with a smaller window
+func (w windowResult) splittable() bool {
+	return w.tooLarge || w.failure.ErrorClass == ERR_CLASS_TIMEOUT || w.failure.HTTPStatus == http.StatusGatewayTimeout
+}
+
+// fetchWindow streams the entries of [from, to) of one pi into new aggregators. Entries
+// outside the window are dropped, except before the start or after the end of the
+// whole range: APIs returning both ends would otherwise count boundary entries twice.
+func (sys *System) fetchWindow(ctx context.Context, client *http.Client, processor Processor, rawEndpoint Endpoint, mode string, from int64, to int64, bucketing Bucketing) windowResult {
+	result := windowResult{validation: &ValidationError{}}
+
+	failed := func(class string, httpStatus int, attempts int, message string) windowResult {
+		result.failure = ApiResponse{Status: "error", Error: message, ErrorClass: class, HTTPStatus: httpStatus, Attempts: attempts}
+		return result
+	}
+
+	endpoint, err := sys.logURL(mode, rawEndpoint.piId, from, to)
+	if err != nil {
+		return failed(ERR_CLASS_REQUEST, 0, 0, err.Error())
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
+	if err != nil {
+		return failed(ERR_CLASS_REQUEST, 0, 0, err.Error())
+	}
+
+	// Sends the authentication header, logging in again once on a 401
+	resp, attempts, err := utils.DoIOT(client, req)
+	if err != nil {
+		return failed(classifyRequestError(err), 0, attempts, err.Error())
+	}
+	defer resp.Body.Close()
+
+	// Handle non-200 status codes
+	if resp.StatusCode != http.StatusOK {
+		fmt.Printf("⚠️ API returned non-OK status for: %d %s for id: %d\n", resp.StatusCode, http.StatusText(resp.StatusCode), rawEndpoint.piId)
+		return failed(classifyStatus(resp.StatusCode), resp.StatusCode, attempts, http.StatusText(resp.StatusCode))
+	}
+
+	result.failure = ApiResponse{HTTPStatus: resp.StatusCode, Attempts: attempts}
+	result.quality = newQualityAggregator(from, to, sys.sampleSeconds(mode), requiredKeys(processor))
+	aggregator := processor.NewAggregator()
+
+	var buckets *bucketAggregators
+	if bucketing.Enabled() {
+		buckets = newBucketAggregators(processor, bucketing, rawEndpoint.start, rawEndpoint.end)
+	}
+
+	processed := 0
+
+	err = sys.streamEntries(resp.Body, func(entry json.RawMessage) {
+		if result.tooLarge {
+			return
+		}
+
+		if ts, ok := entryTimestamp(entry); ok && ((from > rawEndpoint.start && ts < from) || (to < rawEndpoint.end && ts >= to)) {
+			return
+		}
+
+		// Stops reading, the window is split anyway
+		if result.entries++; result.entries > windowMaxEntries && to-from > WINDOW_MIN_SECONDS {
+			result.tooLarge = true
+			resp.Body.Close()
+			return
+		}
+
+		result.quality.Add(entry)
+
+		if buckets != nil && !buckets.Add(entry) {
+			return
+		}
+
+		aggregator.Add(entry)
+		processed++
+	})
+
+	if result.tooLarge {
+		return failed(ERR_CLASS_REQUEST, resp.StatusCode, attempts, fmt.Sprintf("more than %d entries", windowMaxEntries))
+	}
+
+	if err != nil {
+		class := ERR_CLASS_DECODE
+		if err == errApiCallFailed {
+			class = ERR_CLASS_API
+		} else if classifyRequestError(err) == ERR_CLASS_TIMEOUT {
+			class = ERR_CLASS_TIMEOUT
+		}
+		return failed(class, resp.StatusCode, attempts, err.Error())
+	}
+
+	result.part, err = partOf(aggregator)
+
+	// Entries processed without error count too, to tell when every entry was invalid
+	if !errors.As(err, &result.validation) {
+		result.validation.Total = processed
+	}
+
+	if buckets != nil {
+		result.buckets = buckets.Results()
+	}
+
+	return result
+}
+
+// combine adds the validation of another window of the same pi
+func (e *ValidationError) combine(other *ValidationError) {
+	e.Invalid += other.Invalid
+	e.Total += other.Total
+
+	for _, example := range other.Examples {
+		if len(e.Examples) < VALIDATION_EXAMPLES {
+			e.Examples = append(e.Examples, example)
+		}
+	}
+}
+
+// mergeBuckets merges the parts of buckets spanning several windows, given in time order
+func mergeBuckets(processor Processor, parts []BucketResult) []BucketResult {
+	byStart := map[int64][]BucketResult{}
+	for _, part := range parts {
+		byStart[part.Start] = append(byStart[part.Start], part)
+	}
+
+	buckets := []BucketResult{}
+
+	for start, bucketParts := range byStart {
+		bucket := bucketParts[0]
+
+		if len(bucketParts) > 1 {
+			data := []Part{}
+			for _, part := range bucketParts {
+				data = append(data, Part{Metrics: part.ProcessedData, Partial: part.Partial})
+			}
+
+			merged := processor.Merge(data)
+			bucket = BucketResult{Start: start, End: bucket.End, ProcessedData: merged.Metrics, Partial: merged.Partial}
+		}
+
+		buckets = append(buckets, bucket)
+	}
+
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].Start < buckets[j].Start })
+
+	return buckets
+}
@@ -0,0 +1,195 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestFetchSplitsLargeWindows(t *testing.T) {
+	requests := []string{}
+
+	// One entry a minute, only the ones of the requested range
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/pis" {
+			w.Write([]byte(`{"data": [{"id": 1, "name": "HNI0001"}]}`))
+			return
+		}
+
+		from, _ := strconv.ParseInt(r.URL.Query().Get("from"), 10, 64)
+		to, _ := strconv.ParseInt(r.URL.Query().Get("to"), 10, 64)
+		requests = append(requests, fmt.Sprintf("%d-%d", from, to))
+
+		entries := []string{}
+		for ts := from - from%60; ts <= to; ts += 60 {
+			entries = append(entries, fmt.Sprintf(`{"timestamp": %d, "temperature_0": %d}`, ts, 20+ts/3600))
+		}
+
+		fmt.Fprintf(w, `{"data": {"success": true, "data": [%s]}}`, strings.Join(entries, ","))
+	}))
+	defer server.Close()
+
+	sys := &System{
+		Name:          "windows",
+		BaseURL:       server.URL,
+		PiListRoute:   "/pis?folderId=%s",
+		LogRoutes:     map[string]string{"TEMP": "/logs/%d?from=%d&to=%d"},
+		Processors:    map[string]string{"TEMP": "opms-temp"},
+		Envelope:      Envelope{EntriesPath: "data.data", SuccessPath: "data.success"},
+		WindowSeconds: map[string]int64{"TEMP": 4 * 3600},
+	}
+
+	SetWindowMaxEntries(90)
+	defer SetWindowMaxEntries(WINDOW_MAX_ENTRIES_DEFAULT)
+
+	progress := &Progress{}
+	results := CollectResults(WithProgress(context.Background(), progress), sys, Selection{}, 0, 4*3600, 10, 0, "TEMP")
+
+	if len(results) != 1 || results[0].Status != "success" {
+		t.Fatalf("results = %+v; want one success", results)
+	}
+
+	events, _, _ := progress.Events(0)
+	if len(events) != 3 || events[0].Type != EVENT_RETRY || events[1].Type != EVENT_RETRY || events[1].To != 7200 || events[2].Type != EVENT_PI {
+		t.Errorf("events = %+v; want two retries then the pi", events)
+	}
+
+	// 4h > 2h > 1h fits, the remaining 3h go in 1h windows since 60 entries are not few
+	if got := strings.Join(requests, " "); got != "0-14400 0-7200 0-3600 3600-7200 7200-10800 10800-14400" {
+		t.Errorf("requests = %s", got)
+	}
+
+	data, quality := results[0].ProcessedData, results[0].Quality
+	if data["t1Count"] != 241 || data["t1Min"] != 20 || data["t1Max"] != 24 || quality.Samples != 241 || quality.DuplicateTimestamps != 0 {
+		t.Errorf("got %v, quality %+v; want every minute counted once", data, quality)
+	}
+}
+
+func TestFetchWindowsMergeLikeOneWindow(t *testing.T) {
+	// Temperatures around the thresholds, in no order
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/pis" {
+			w.Write([]byte(`{"data": [{"id": 1, "name": "HNI0001"}]}`))
+			return
+		}
+
+		from, _ := strconv.ParseInt(r.URL.Query().Get("from"), 10, 64)
+		to, _ := strconv.ParseInt(r.URL.Query().Get("to"), 10, 64)
+
+		entries := []string{}
+		for ts := from - from%60; ts <= to; ts += 60 {
+			entries = append(entries, fmt.Sprintf(`{"timestamp": %d, "temperature_0": %d.5}`, ts, 30+(ts/60*7)%13))
+		}
+
+		fmt.Fprintf(w, `{"data": {"success": true, "data": [%s]}}`, strings.Join(entries, ","))
+	}))
+	defer server.Close()
+
+	sys := &System{
+		Name:          "windows",
+		BaseURL:       server.URL,
+		PiListRoute:   "/pis?folderId=%s",
+		LogRoutes:     map[string]string{"TEMP": "/logs/%d?from=%d&to=%d"},
+		Processors:    map[string]string{"TEMP": "opms-temp"},
+		Envelope:      Envelope{EntriesPath: "data.data", SuccessPath: "data.success"},
+		WindowSeconds: map[string]int64{"TEMP": 4 * 3600},
+	}
+	defer SetWindowMaxEntries(WINDOW_MAX_ENTRIES_DEFAULT)
+
+	fetch := func(maxEntries int) ApiResponse {
+		SetWindowMaxEntries(maxEntries)
+
+		results := CollectResults(context.Background(), sys, Selection{}, 0, 4*3600, 10, 0, "TEMP")
+		if len(results) != 1 || results[0].Status != "success" {
+			t.Fatalf("results = %+v; want one success", results)
+		}
+
+		return results[0]
+	}
+
+	whole, split := fetch(1000), fetch(90)
+
+	if whole.Windows != 1 || split.Windows < 4 {
+		t.Fatalf("windows = %d and %d; want 1 and several", whole.Windows, split.Windows)
+	}
+
+	for key, value := range whole.ProcessedData {
+		if got, ok := split.ProcessedData[key]; !ok || math.Abs(got-value) > 1e-9 {
+			t.Errorf("%s = %v in %d windows; want %v as in one", key, got, split.Windows, value)
+		}
+	}
+
+	if split.Quality.Samples != whole.Quality.Samples || split.Quality.MedianIntervalSecs != whole.Quality.MedianIntervalSecs || split.Quality.Gaps != whole.Quality.Gaps {
+		t.Errorf("quality = %+v in windows; want %+v", split.Quality, whole.Quality)
+	}
+}
+
+func TestFetchFanWindowsMergeLikeOneWindow(t *testing.T) {
+	// The first fan only runs at full control in the first hour, the third never does
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/pis" {
+			w.Write([]byte(`{"data": [{"id": 1, "name": "HNI0001"}]}`))
+			return
+		}
+
+		from, _ := strconv.ParseInt(r.URL.Query().Get("from"), 10, 64)
+		to, _ := strconv.ParseInt(r.URL.Query().Get("to"), 10, 64)
+
+		entries := []string{}
+		for ts := from - from%60; ts <= to; ts += 60 {
+			control := 50
+			if ts < 3600 {
+				control = 100
+			}
+
+			rps := 40 + (ts/60*7)%13
+			entries = append(entries, fmt.Sprintf(`{"timestamp": %d, "rps_fan_pop_0": %d, "control_fan_pop_0": %d, "rps_fan_pop_1": %d, "control_fan_pop_1": 100, "rps_fan_pop_2": %d, "control_fan_pop_2": 0}`, ts, rps, control, rps, rps))
+		}
+
+		fmt.Fprintf(w, `{"data": {"success": true, "data": [%s]}}`, strings.Join(entries, ","))
+	}))
+	defer server.Close()
+
+	sys := &System{
+		Name:          "windows",
+		BaseURL:       server.URL,
+		PiListRoute:   "/pis?folderId=%s",
+		LogRoutes:     map[string]string{"FAN": "/logs/%d?from=%d&to=%d"},
+		Processors:    map[string]string{"FAN": "fan"},
+		Envelope:      Envelope{EntriesPath: "data.data", SuccessPath: "data.success"},
+		WindowSeconds: map[string]int64{"FAN": 4 * 3600},
+	}
+	defer SetWindowMaxEntries(WINDOW_MAX_ENTRIES_DEFAULT)
+
+	fetch := func(maxEntries int) ApiResponse {
+		SetWindowMaxEntries(maxEntries)
+
+		results := CollectResults(context.Background(), sys, Selection{}, 0, 4*3600, 10, 0, "FAN")
+		if len(results) != 1 || results[0].Status != "success" {
+			t.Fatalf("results = %+v; want one success", results)
+		}
+
+		return results[0]
+	}
+
+	whole, split := fetch(1000), fetch(90)
+
+	if whole.Windows != 1 || split.Windows < 4 {
+		t.Fatalf("windows = %d and %d; want 1 and several", whole.Windows, split.Windows)
+	}
+
+	if whole.ProcessedData["f1"] == 0 || whole.ProcessedData["f3"] != 0 {
+		t.Errorf("got %v; want f1 from the first hour and no f3", whole.ProcessedData)
+	}
+
+	for _, key := range []string{"f1", "f2", "f3", "f4"} {
+		if got, want := split.ProcessedData[key], whole.ProcessedData[key]; got != want {
+			t.Errorf("%s = %v in %d windows; want %v as in one", key, got, split.Windows, want)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package jobs
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+var xlsxParts = map[string]string{
+	"[Content_Types].xml": `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">
+<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>
+<Default Extension="xml" ContentType="application/xml"/>
+<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>
+<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>
+</Types>`,
+	"_rels/.rels": `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>
+</Relationships>`,
+	"xl/workbook.xml": `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">
+<sheets><sheet name="Results" sheetId="1" r:id="rId1"/></sheets>
+</workbook>`,
+	"xl/_rels/workbook.xml.rels": `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>
+</Relationships>`,
+}
+
+// writeXlsx writes records as the single sheet of a minimal workbook, numbers as
+// number cells and everything else as inline strings.
+func writeXlsx(w io.Writer, records [][]string) error {
+	archive := zip.NewWriter(w)
+
+	for _, name := range []string{"[Content_Types].xml", "_rels/.rels", "xl/workbook.xml", "xl/_rels/workbook.xml.rels"} {
+		part, err := archive.Create(name)
+		if err != nil {
+			return err
+		}
+
+		if _, err := io.WriteString(part, xlsxParts[name]); err != nil {
+			return err
+		}
+	}
+
+	sheet, err := archive.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return err
+	}
+
+	var rows strings.Builder
+
+	for i, record := range records {
+		fmt.Fprintf(&rows, `<row r="%d">`, i+1)
+
+		for _, value := range record {
+			// An empty cell is no data, not an empty string
+			if value == "" {
+				rows.WriteString(`<c/>`)
+				continue
+			}
+
+			if _, err := strconv.ParseFloat(value, 64); err == nil && i > 0 {
+				fmt.Fprintf(&rows, `<c t="n"><v>%s</v></c>`, value)
+				continue
+			}
+
+			rows.WriteString(`<c t="inlineStr"><is><t xml:space="preserve">`)
+			xml.EscapeText(&rows, []byte(value))
+			rows.WriteString(`</t></is></c>`)
+		}
+
+		rows.WriteString(`</row>`)
+	}
+
+	_, err = fmt.Fprintf(sheet, `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>%s</sheetData></worksheet>`, rows.String())
+	if err != nil {
+		return err
+	}
+
+	return archive.Close()
+}
@@ -1,12 +1,21 @@
 package main
 
 import (
+	"log"
+	"os"
 	"project/jobs"
+	"project/redact"
 	"project/utils"
 )
 
 func main() {
 
+	log.SetOutput(redact.Writer(os.Stderr))
+
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1], os.Args[2:]))
+	}
+
 	t1 := utils.ISOToUnix("2025-04-08T00:00:00Z")
 	t2 := utils.ISOToUnix("2025-04-08T22:59:59Z")
 
@@ -20,7 +29,7 @@ func main() {
 	// )
 
 	// jobs.GetOpmsDataPipeline(
-	// 	limit,
+	// 	jobs.Selection{Limit: limit},
 	// 	t1,
 	// 	t2,
 	// 	rateLimit,
@@ -30,7 +39,7 @@ func main() {
 	// )
 
 	jobs.GetIpmsDataPipeline(
-		limit,
+		jobs.Selection{Limit: limit},
 		t1,
 		t2,
 		rateLimit,
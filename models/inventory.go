@@ -0,0 +1,35 @@
+package models
+
+import "time"
+
+// InventoryPi is one version of a pi in the inventory, without its MQTT credentials.
+// ValidTo is nil for the current version.
+type InventoryPi struct {
+	System      string     `json:"system"`
+	PiId        int        `json:"piId"`
+	Name        string     `json:"name"`
+	Ip          string     `json:"ip"`
+	Address     string     `json:"address"`
+	BackendPort int        `json:"backendPort"`
+	BrokerUrl   string     `json:"brokerUrl"`
+	Role        string     `json:"role"`
+	ValidFrom   time.Time  `json:"validFrom"`
+	ValidTo     *time.Time `json:"validTo,omitempty"`
+}
+
+const (
+	INVENTORY_ADDED       = "added"
+	INVENTORY_REMOVED     = "removed"
+	INVENTORY_RENAMED     = "renamed"
+	INVENTORY_READDRESSED = "readdressed" // ip, address, backend port or broker URL
+	INVENTORY_CHANGED     = "changed"     // role
+)
+
+// InventoryChange is one difference between the inventory and a fresh pi list.
+type InventoryChange struct {
+	System string `json:"system"`
+	PiId   int    `json:"piId"`
+	Kind   string `json:"kind"`
+	Before string `json:"before,omitempty"`
+	After  string `json:"after,omitempty"`
+}
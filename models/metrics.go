@@ -0,0 +1,16 @@
+package models
+
+import "time"
+
+// MetricsRow is the processed metrics of one pi over [Start, End). Bucket is the
+// bucket size of bucketed runs ("1h", "day", ...), "" for a whole run window.
+type MetricsRow struct {
+	System  string             `json:"system"`
+	Mode    string             `json:"mode"`
+	PiId    int                `json:"piId"`
+	Pop     string             `json:"pop"`
+	Bucket  string             `json:"bucket"`
+	Start   time.Time          `json:"start"`
+	End     time.Time          `json:"end"`
+	Metrics map[string]float64 `json:"metrics"`
+}
@@ -0,0 +1,56 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+const (
+	JOB_QUEUED    = "queued"
+	JOB_RUNNING   = "running"
+	JOB_MERGING   = "merging" // every unit is finished, a worker writes the output
+	JOB_SUCCEEDED = "succeeded"
+	JOB_FAILED    = "failed"
+	JOB_CANCELED  = "canceled"
+
+	UNIT_QUEUED   = "queued"
+	UNIT_RUNNING  = "running"
+	UNIT_DONE     = "done"
+	UNIT_FAILED   = "failed"
+	UNIT_CANCELED = "canceled"
+)
+
+// QueuedJob is a crawl of the durable queue. Spec is the jobs.JobSpec it was started with.
+type QueuedJob struct {
+	Id         string          `json:"id"`
+	Spec       json.RawMessage `json:"spec"`
+	Status     string          `json:"status"`
+	Error      string          `json:"error,omitempty"`
+	OutputFile string          `json:"outputFile,omitempty"`
+	CreatedAt  time.Time       `json:"createdAt"`
+	StartedAt  *time.Time      `json:"startedAt,omitempty"`
+	FinishedAt *time.Time      `json:"finishedAt,omitempty"`
+	// Units in total, finished and failed
+	Units  int `json:"units"`
+	Done   int `json:"done"`
+	Failed int `json:"failed"`
+}
+
+// JobUnit is one pi, mode and interval [Start, End) of a queued job. Result is the
+// jobs.ApiResponse of a finished unit.
+type JobUnit struct {
+	Id         int64           `json:"id"`
+	JobId      string          `json:"jobId"`
+	PiId       int             `json:"piId"`
+	Pop        string          `json:"pop"`
+	Mode       string          `json:"mode"`
+	Start      int64           `json:"start"`
+	End        int64           `json:"end"`
+	Status     string          `json:"status"`
+	Attempts   int             `json:"attempts"`
+	Worker     string          `json:"worker,omitempty"`
+	Result     json.RawMessage `json:"result,omitempty"`
+	FinishedAt *time.Time      `json:"finishedAt,omitempty"`
+	// 1-based number of its event once finished, 0 before
+	Event int64 `json:"event,omitempty"`
+}
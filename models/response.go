@@ -1,7 +1,7 @@
 package models
 
 type Response struct {
-	Data        []User `json:"data"`
+	Data        any    `json:"data"`
 	Total       int    `json:"total"`
 	ExecuteTime string `json:"excute_time"`
 }
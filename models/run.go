@@ -0,0 +1,23 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// PipelineRun is one run of the pipeline as recorded in pipeline_runs. Manifest is the
+// whole jobs.RunManifest, the other fields are there to filter and list runs.
+type PipelineRun struct {
+	Id         string          `json:"id"`
+	System     string          `json:"system"`
+	Mode       string          `json:"mode"`
+	From       string          `json:"from"`
+	To         string          `json:"to"`
+	StartedAt  time.Time       `json:"startedAt"`
+	FinishedAt time.Time       `json:"finishedAt"`
+	Pis        int             `json:"pis"`
+	Succeeded  int             `json:"succeeded"`
+	Failed     int             `json:"failed"`
+	OutputFile string          `json:"outputFile"`
+	Manifest   json.RawMessage `json:"manifest,omitempty"`
+}
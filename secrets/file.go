@@ -0,0 +1,65 @@
+package secrets
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/joho/godotenv"
+)
+
+const DEFAULT_SECRETS_DIR = "/run/secrets"
+
+// FileProvider reads one file per secret, the layout of Docker and Kubernetes
+// mounted secrets. For PG_PASSWORD it tries $PG_PASSWORD_FILE, then
+// <Dir>/PG_PASSWORD and <Dir>/pg_password.
+type FileProvider struct {
+	Dir string
+}
+
+func (p FileProvider) Get(key string) (string, error) {
+	candidates := []string{}
+
+	if path := os.Getenv(key + "_FILE"); path != "" {
+		candidates = append(candidates, path)
+	}
+
+	if p.Dir != "" {
+		candidates = append(candidates, filepath.Join(p.Dir, key), filepath.Join(p.Dir, strings.ToLower(key)))
+	}
+
+	for _, path := range candidates {
+		data, err := os.ReadFile(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+
+	return "", fmt.Errorf("%w: %s", ErrNotFound, key)
+}
+
+// EnvFileProvider reads a dotenv style KEY=value file.
+type EnvFileProvider struct {
+	Path string
+}
+
+func (p EnvFileProvider) Get(key string) (string, error) {
+	values, err := godotenv.Read(p.Path)
+	if err != nil {
+		return "", err
+	}
+
+	if value, ok := values[key]; ok && value != "" {
+		return value, nil
+	}
+
+	return "", fmt.Errorf("%w: %s", ErrNotFound, key)
+}
@@ -0,0 +1,155 @@
+package secrets
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"project/redact"
+	"strings"
+	"sync"
+
+	"github.com/joho/godotenv"
+)
+
+var ErrNotFound = errors.New("secret not found")
+
+// Provider resolves a credential such as TOKEN or PG_PASSWORD by its key.
+type Provider interface {
+	Get(key string) (string, error)
+}
+
+// Chain asks each provider in turn and returns the first value found.
+type Chain []Provider
+
+func (c Chain) Get(key string) (string, error) {
+	for _, provider := range c {
+		value, err := provider.Get(key)
+		if err == nil {
+			return value, nil
+		}
+
+		if !errors.Is(err, ErrNotFound) {
+			return "", err
+		}
+	}
+
+	return "", fmt.Errorf("%w: %s", ErrNotFound, key)
+}
+
+// EnvProvider reads environment variables.
+type EnvProvider struct{}
+
+func (EnvProvider) Get(key string) (string, error) {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		return value, nil
+	}
+
+	return "", fmt.Errorf("%w: %s", ErrNotFound, key)
+}
+
+var defaultProvider Provider
+var defaultProviderOnce sync.Once
+
+// Default is built once from the environment (and .env):
+//
+//	SECRETS_PROVIDERS            comma separated, in lookup order (default "env,file")
+//	SECRETS_DIR                  directory of mounted secrets for "file" (default /run/secrets)
+//	SECRETS_ENV_FILE             dotenv style file for "envfile"
+//	SECRETS_VAULT_FILE           encrypted vault for "vault"
+//	SECRETS_VAULT_PASSPHRASE     or SECRETS_VAULT_PASSPHRASE_FILE, unlocks the vault
+func Default() Provider {
+	defaultProviderOnce.Do(func() {
+		godotenv.Load()
+
+		provider, err := FromEnv()
+		if err != nil {
+			fmt.Println("❌ Error setting up secret providers:", err)
+		}
+
+		defaultProvider = provider
+	})
+
+	return defaultProvider
+}
+
+func FromEnv() (Chain, error) {
+	names := os.Getenv("SECRETS_PROVIDERS")
+	if names == "" {
+		names = "env,file"
+	}
+
+	chain := Chain{}
+
+	for _, name := range strings.Split(names, ",") {
+		switch strings.TrimSpace(name) {
+		case "env":
+			chain = append(chain, EnvProvider{})
+		case "file":
+			dir := os.Getenv("SECRETS_DIR")
+			if dir == "" {
+				dir = DEFAULT_SECRETS_DIR
+			}
+			chain = append(chain, FileProvider{Dir: dir})
+		case "envfile":
+			chain = append(chain, EnvFileProvider{Path: os.Getenv("SECRETS_ENV_FILE")})
+		case "vault":
+			vault, err := OpenVaultFromEnv()
+			if err != nil {
+				return chain, err
+			}
+			chain = append(chain, vault)
+		case "":
+		default:
+			return chain, fmt.Errorf("unknown secret provider %q", name)
+		}
+	}
+
+	return chain, nil
+}
+
+// OpenVaultFromEnv opens SECRETS_VAULT_FILE with the configured passphrase.
+func OpenVaultFromEnv() (*VaultProvider, error) {
+	passphrase, err := vaultPassphrase()
+	if err != nil {
+		return nil, err
+	}
+
+	return OpenVault(os.Getenv("SECRETS_VAULT_FILE"), passphrase)
+}
+
+func vaultPassphrase() (string, error) {
+	if path := os.Getenv("SECRETS_VAULT_PASSPHRASE_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+
+	if passphrase := os.Getenv("SECRETS_VAULT_PASSPHRASE"); passphrase != "" {
+		return passphrase, nil
+	}
+
+	return "", errors.New("the vault needs SECRETS_VAULT_PASSPHRASE or SECRETS_VAULT_PASSPHRASE_FILE")
+}
+
+// Get resolves key through the default providers, "" when it is not set anywhere.
+// Values of sensitive keys are registered for redaction.
+func Get(key string) string {
+	value, err := Default().Get(key)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		fmt.Printf("❌ Error reading secret %s: %v\n", key, err)
+	}
+
+	if isSensitive(key) {
+		redact.Register(value)
+	}
+
+	return value
+}
+
+func isSensitive(key string) bool {
+	key = strings.ToUpper(key)
+
+	return strings.Contains(key, "PASSWORD") || strings.Contains(key, "TOKEN") || strings.Contains(key, "SECRET")
+}
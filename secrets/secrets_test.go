@@ -0,0 +1,63 @@
+package secrets
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestVaultRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vault.json")
+
+	vault, err := OpenVault(path, "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vault.Set("PG_PASSWORD", "s3cret")
+
+	if err := vault.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, _ := os.ReadFile(path)
+	if strings.Contains(string(data), "s3cret") {
+		t.Error("vault file contains the plaintext secret")
+	}
+
+	reopened, err := OpenVault(path, "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if value, err := reopened.Get("PG_PASSWORD"); err != nil || value != "s3cret" {
+		t.Errorf("Get() = %s, %v; want s3cret", value, err)
+	}
+
+	if _, err := OpenVault(path, "wrong"); !errors.Is(err, ErrWrongPassphrase) {
+		t.Errorf("OpenVault() with a wrong passphrase error = %v; want ErrWrongPassphrase", err)
+	}
+}
+
+func TestChainFallsThroughToMountedFile(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "pg_password"), []byte("from-file\n"), 0600)
+
+	chain := Chain{EnvProvider{}, FileProvider{Dir: dir}}
+
+	if value, err := chain.Get("PG_PASSWORD"); err != nil || value != "from-file" {
+		t.Errorf("Get() = %s, %v; want from-file", value, err)
+	}
+
+	t.Setenv("PG_PASSWORD", "from-env")
+
+	if value, _ := chain.Get("PG_PASSWORD"); value != "from-env" {
+		t.Errorf("Get() = %s; want the environment to win", value)
+	}
+
+	if _, err := chain.Get("MISSING"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get(MISSING) error = %v; want ErrNotFound", err)
+	}
+}
@@ -0,0 +1,163 @@
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"sync"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// VaultProvider keeps secrets in a local file encrypted with AES-256-GCM, the key
+// being derived from a passphrase with scrypt.
+type VaultProvider struct {
+	path       string
+	passphrase string
+
+	mu      sync.Mutex
+	secrets map[string]string
+}
+
+type vaultFile struct {
+	Version    int    `json:"version"`
+	Salt       []byte `json:"salt"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+var ErrWrongPassphrase = errors.New("wrong vault passphrase or corrupted vault")
+
+// OpenVault decrypts the vault at path, a missing file opens an empty vault.
+func OpenVault(path string, passphrase string) (*VaultProvider, error) {
+	if path == "" {
+		return nil, errors.New("no vault file configured")
+	}
+
+	vault := &VaultProvider{path: path, passphrase: passphrase, secrets: map[string]string{}}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return vault, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var file vaultFile
+
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("reading vault: %w", err)
+	}
+
+	gcm, err := vaultCipher(passphrase, file.Salt)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := gcm.Open(nil, file.Nonce, file.Ciphertext, nil)
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+
+	if err := json.Unmarshal(plaintext, &vault.secrets); err != nil {
+		return nil, fmt.Errorf("reading vault: %w", err)
+	}
+
+	return vault, nil
+}
+
+func vaultCipher(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func (v *VaultProvider) Get(key string) (string, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if value, ok := v.secrets[key]; ok {
+		return value, nil
+	}
+
+	return "", fmt.Errorf("%w: %s", ErrNotFound, key)
+}
+
+func (v *VaultProvider) Set(key string, value string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.secrets[key] = value
+}
+
+func (v *VaultProvider) Delete(key string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	delete(v.secrets, key)
+}
+
+func (v *VaultProvider) Keys() []string {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	keys := []string{}
+	for key := range v.secrets {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// Save encrypts the vault with a fresh salt and nonce and writes it with 0600.
+func (v *VaultProvider) Save() error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	plaintext, err := json.Marshal(v.secrets)
+	if err != nil {
+		return err
+	}
+
+	file := vaultFile{Version: 1, Salt: make([]byte, 16)}
+
+	if _, err := rand.Read(file.Salt); err != nil {
+		return err
+	}
+
+	gcm, err := vaultCipher(v.passphrase, file.Salt)
+	if err != nil {
+		return err
+	}
+
+	file.Nonce = make([]byte, gcm.NonceSize())
+
+	if _, err := rand.Read(file.Nonce); err != nil {
+		return err
+	}
+
+	file.Ciphertext = gcm.Seal(nil, file.Nonce, plaintext, nil)
+
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(v.path, data, 0600)
+}
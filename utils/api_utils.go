@@ -1,15 +1,10 @@
 package utils
 
-import (
-	"github.com/joho/godotenv"
-)
-
 func GetTokenIOT() string {
-	envFile, _ := godotenv.Read(".env")
-
-	envFileToken := envFile["TOKEN"]
-
-	var MOCK_TOKEN = envFileToken
+	token, err := DefaultTokenProvider().Token()
+	if err != nil {
+		Logln("❌ Error getting IoT token:", err)
+	}
 
-	return MOCK_TOKEN
+	return token
 }
@@ -0,0 +1,19 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"project/redact"
+)
+
+// LogOutput receives every Logf/Logln line, always masked by the redact package.
+var LogOutput io.Writer = os.Stdout
+
+func Logf(format string, args ...any) {
+	fmt.Fprint(redact.Writer(LogOutput), fmt.Sprintf(format, args...))
+}
+
+func Logln(args ...any) {
+	fmt.Fprint(redact.Writer(LogOutput), fmt.Sprintln(args...))
+}
@@ -0,0 +1,268 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"project/redact"
+	"project/secrets"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+const DEFAULT_TOKEN_TTL = time.Hour
+const DEFAULT_TOKEN_REFRESH_BEFORE = 2 * time.Minute
+
+var ErrLoginFailed = errors.New("IoT login failed")
+
+// TokenProvider hands out the x-access-token of the IoT API. With an auth URL and
+// credentials it logs in by itself, caches the token in memory and logs in again
+// shortly before the token expires. Without them it falls back to a static token.
+type TokenProvider struct {
+	AuthURL       string
+	Username      string
+	Password      string
+	StaticToken   string
+	TTL           time.Duration // used when the token carries no expiry
+	RefreshBefore time.Duration
+
+	Client *http.Client
+
+	mu        sync.Mutex
+	token     string
+	expiresAt time.Time
+	now       func() time.Time
+}
+
+var defaultTokenProvider *TokenProvider
+var defaultTokenProviderOnce sync.Once
+
+// DefaultTokenProvider is built once from the environment (and .env): IOT_AUTH_URL and
+// IOT_TOKEN_TTL, with IOT_USERNAME, IOT_PASSWORD and TOKEN resolved through the secret providers.
+func DefaultTokenProvider() *TokenProvider {
+	defaultTokenProviderOnce.Do(func() {
+		godotenv.Load()
+
+		ttl, err := time.ParseDuration(os.Getenv("IOT_TOKEN_TTL"))
+		if err != nil {
+			ttl = DEFAULT_TOKEN_TTL
+		}
+
+		defaultTokenProvider = &TokenProvider{
+			AuthURL:       os.Getenv("IOT_AUTH_URL"),
+			Username:      secrets.Get("IOT_USERNAME"),
+			Password:      secrets.Get("IOT_PASSWORD"),
+			StaticToken:   secrets.Get("TOKEN"),
+			TTL:           ttl,
+			RefreshBefore: DEFAULT_TOKEN_REFRESH_BEFORE,
+		}
+	})
+
+	return defaultTokenProvider
+}
+
+func (p *TokenProvider) canLogin() bool {
+	return p.AuthURL != "" && p.Username != ""
+}
+
+func (p *TokenProvider) currentTime() time.Time {
+	if p.now != nil {
+		return p.now()
+	}
+
+	return time.Now()
+}
+
+// Token returns the cached token, logging in first when it is missing or about to expire.
+func (p *TokenProvider) Token() (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.canLogin() {
+		return p.StaticToken, nil
+	}
+
+	if p.token != "" && p.currentTime().Before(p.expiresAt.Add(-p.RefreshBefore)) {
+		return p.token, nil
+	}
+
+	if err := p.login(); err != nil {
+		return "", fmt.Errorf("%w: %v", ErrLoginFailed, err)
+	}
+
+	return p.token, nil
+}
+
+// Status gets a token the way requests do and tells when it expires, known is false
+// for tokens that do not say. An expired static token is an error.
+func (p *TokenProvider) Status() (expiresAt time.Time, known bool, err error) {
+	token, err := p.Token()
+	if err != nil {
+		return time.Time{}, false, err
+	}
+
+	if token == "" {
+		return time.Time{}, false, errors.New("no TOKEN and no IOT_AUTH_URL with IOT_USERNAME")
+	}
+
+	if p.canLogin() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+
+		return p.expiresAt, true, nil
+	}
+
+	expiresAt, known = jwtExpiry(token)
+	if known && !p.currentTime().Before(expiresAt) {
+		return expiresAt, true, fmt.Errorf("TOKEN expired at %s", expiresAt.Format(time.RFC3339))
+	}
+
+	return expiresAt, known, nil
+}
+
+// Invalidate drops the cached token if it is still the one that was rejected,
+// so concurrent requests failing with the same token only trigger one login.
+func (p *TokenProvider) Invalidate(token string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.token == token {
+		p.token = ""
+	}
+}
+
+func (p *TokenProvider) login() error {
+	body, _ := json.Marshal(map[string]string{"username": p.Username, "password": p.Password})
+
+	client := p.Client
+	if client == nil {
+		client = &http.Client{Timeout: 20 * time.Second}
+	}
+
+	resp, err := client.Post(p.AuthURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("login request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("login returned %d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+
+	var loginResponse struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"accessToken"`
+		ExpiresIn   int64  `json:"expiresIn"`
+		Data        struct {
+			Token       string `json:"token"`
+			AccessToken string `json:"accessToken"`
+			ExpiresIn   int64  `json:"expiresIn"`
+		} `json:"data"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&loginResponse); err != nil {
+		return fmt.Errorf("decoding login response: %w", err)
+	}
+
+	token := firstNonEmpty(loginResponse.Token, loginResponse.AccessToken, loginResponse.Data.Token, loginResponse.Data.AccessToken)
+	if token == "" {
+		return errors.New("login response has no token")
+	}
+
+	now := p.currentTime()
+	expiresIn := loginResponse.ExpiresIn + loginResponse.Data.ExpiresIn
+
+	switch exp, ok := jwtExpiry(token); {
+	case ok:
+		p.expiresAt = exp
+	case expiresIn > 0:
+		p.expiresAt = now.Add(time.Duration(expiresIn) * time.Second)
+	default:
+		ttl := p.TTL
+		if ttl <= 0 {
+			ttl = DEFAULT_TOKEN_TTL
+		}
+		p.expiresAt = now.Add(ttl)
+	}
+
+	p.token = token
+
+	redact.Register(token)
+
+	return nil
+}
+
+// Do sends req with the access token and, after a 401, refreshes the token and
+// sends it once more. It returns the number of attempts made.
+func (p *TokenProvider) Do(client *http.Client, req *http.Request) (*http.Response, int, error) {
+	attempts := 0
+
+	for {
+		token, err := p.Token()
+		if err != nil {
+			return nil, attempts, err
+		}
+
+		attempt := req.Clone(req.Context())
+		attempt.Header.Set("x-access-token", token)
+
+		attempts++
+
+		resp, err := client.Do(attempt)
+		if err != nil {
+			return nil, attempts, err
+		}
+
+		if resp.StatusCode != http.StatusUnauthorized || attempts > 1 || !p.canLogin() || req.Body != nil {
+			return resp, attempts, nil
+		}
+
+		resp.Body.Close()
+		p.Invalidate(token)
+	}
+}
+
+// DoIOT sends an IoT API request through the default token provider.
+func DoIOT(client *http.Client, req *http.Request) (*http.Response, int, error) {
+	return DefaultTokenProvider().Do(client, req)
+}
+
+// jwtExpiry reads the exp claim of a JWT without verifying it.
+func jwtExpiry(token string) (time.Time, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, false
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Exp == 0 {
+		return time.Time{}, false
+	}
+
+	return time.Unix(claims.Exp, 0), true
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,79 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTokenProviderRetriesOnceAfter401(t *testing.T) {
+	var logins atomic.Int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/login":
+			n := logins.Add(1)
+			json.NewEncoder(w).Encode(map[string]any{"data": map[string]any{"token": fmt.Sprintf("token-%d", n)}})
+		case "/pis":
+			// Only the second token is accepted, as if the first one had expired server side
+			if r.Header.Get("x-access-token") != "token-2" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte(`{}`))
+		}
+	}))
+	defer server.Close()
+
+	provider := &TokenProvider{AuthURL: server.URL + "/login", Username: "crawler", Password: "secret"}
+
+	req, _ := http.NewRequest("GET", server.URL+"/pis", nil)
+
+	resp, attempts, err := provider.Do(server.Client(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || attempts != 2 || logins.Load() != 2 {
+		t.Errorf("status = %d, attempts = %d, logins = %d; want 200, 2, 2", resp.StatusCode, attempts, logins.Load())
+	}
+}
+
+func TestTokenProviderRefreshesBeforeExpiry(t *testing.T) {
+	var logins atomic.Int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := logins.Add(1)
+		json.NewEncoder(w).Encode(map[string]any{"token": fmt.Sprintf("token-%d", n), "expiresIn": 600})
+	}))
+	defer server.Close()
+
+	now := time.Unix(1_700_000_000, 0)
+	provider := &TokenProvider{AuthURL: server.URL, Username: "crawler", RefreshBefore: time.Minute, now: func() time.Time { return now }}
+
+	first, _ := provider.Token()
+	second, _ := provider.Token()
+
+	if first != "token-1" || second != "token-1" {
+		t.Errorf("tokens = %s, %s; want the cached token-1", first, second)
+	}
+
+	now = now.Add(9*time.Minute + 30*time.Second)
+
+	if third, _ := provider.Token(); third != "token-2" {
+		t.Errorf("token = %s; want token-2 refreshed before expiry", third)
+	}
+}
+
+func TestTokenProviderStaticToken(t *testing.T) {
+	provider := &TokenProvider{StaticToken: "static"}
+
+	if token, err := provider.Token(); err != nil || token != "static" {
+		t.Errorf("Token() = %s, %v; want static", token, err)
+	}
+}